@@ -0,0 +1,170 @@
+package batching
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ryanleh/secure-inference/lhe"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+// Private aggregate queries: rather than retrieving entries, the client
+// encrypts a weighted selection vector over the DB columns, so that the LHE
+// answer for each DB row is the weighted sum of the selected entries in that
+// row. The server learns nothing about which entries are selected.
+//
+// Entries in the same DB row are summed by a single query, so aggregating over
+// entries spread across `k` rows takes `k` queries. Each of the `Ne` elems of
+// an entry is summed separately mod the plaintext modulus, so a query is only
+// correct if none of these sums overflow (see `CheckAggregate`).
+
+// Secret for an aggregate query
+type AggregateSecret[T m.Elem] struct {
+	// The DB row summed by each query
+	Rows    []uint64
+	Secrets []lhe.Secret[T]
+}
+
+// Check that the weighted sum of any entries of a single DB row with total
+// weight `weight` can be computed without overflow
+func CheckAggregate[T m.Elem](info *lhe.DBInfo, weight uint64) error {
+	mod, _, bounds := elemDigits[T](info)
+	for j, bound := range bounds {
+		sum := new(big.Int).Mul(bound, new(big.Int).SetUint64(weight))
+		if sum.Cmp(mod) >= 0 {
+			return fmt.Errorf("sums of elem %v up to %v overflow the modulus %v", j, sum, mod)
+		}
+	}
+	return nil
+}
+
+// Build a query for the sum of the entries at `indices`, e.g. to count records
+// when entries are 0/1-valued
+func (c *DirectClient[T]) Sum(indices []uint64) (*AggregateSecret[T], Query[T], error) {
+	weights := make([]uint64, len(indices))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return c.Aggregate(indices, weights)
+}
+
+// Build a query for the sum of the entries at `indices`, weighted by
+// `weights`. Returns an error if the selected entries span more than `Load` DB
+// rows, or if a sum may overflow.
+func (c *DirectClient[T]) Aggregate(indices, weights []uint64) (*AggregateSecret[T], Query[T], error) {
+	if len(indices) != len(weights) {
+		return nil, nil, fmt.Errorf("%v indices but %v weights", len(indices), len(weights))
+	}
+	dbInfo := c.lheClient.DBInfo()
+
+	// Build one selection vector per DB row
+	secret := &AggregateSecret[T]{}
+	rows := make(map[uint64]int)
+	inputs := []*m.Matrix[T]{}
+	totals := []uint64{}
+	for i, idx := range indices {
+		if idx >= dbInfo.N {
+			return nil, nil, fmt.Errorf("index %v out of range", idx)
+		}
+		row := dbInfo.Row(idx)
+		slot, ok := rows[row]
+		if !ok {
+			slot = len(inputs)
+			rows[row] = slot
+			secret.Rows = append(secret.Rows, row)
+			inputs = append(inputs, m.New[T](dbInfo.M, 1))
+			totals = append(totals, 0)
+		}
+		col := dbInfo.Column(idx)
+		inputs[slot].Set(col, 0, inputs[slot].Get(col, 0)+T(weights[i]))
+		if totals[slot]+weights[i] < totals[slot] {
+			return nil, nil, fmt.Errorf("total weight overflows")
+		}
+		totals[slot] += weights[i]
+	}
+	if uint64(len(inputs)) > c.load {
+		return nil, nil, fmt.Errorf("entries span %v DB rows, above the load %v", len(inputs), c.load)
+	}
+	for _, total := range totals {
+		if err := CheckAggregate[T](dbInfo, total); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Build query, padding with dummy queries to hide the number of rows
+	s, q := c.lheClient.Query(inputs)
+	secret.Secrets = s
+	query := &DirectQuery[T]{Queries: q}
+	if remaining := c.load - uint64(len(inputs)); remaining > 0 {
+		s, q = c.lheClient.DummyQuery(remaining)
+		secret.Secrets = append(secret.Secrets, s...)
+		query.Queries = append(query.Queries, q...)
+	}
+	return secret, query, nil
+}
+
+// Recover the weighted sum from the answer to an aggregate query
+func (c *DirectClient[T]) RecoverAggregate(secret *AggregateSecret[T], a Answer[T]) (*big.Int, error) {
+	answer := a.(*DirectAnswer[T])
+	dbInfo := c.lheClient.DBInfo()
+	_, weights, _ := elemDigits[T](dbInfo)
+
+	total := big.NewInt(0)
+	elem := big.NewInt(0)
+	recovered, err := c.lheClient.Recover(secret.Secrets, answer.Answers)
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range secret.Rows {
+		for j, weight := range weights {
+			elem.SetUint64(uint64(recovered[i].Get(row+uint64(j), 0)))
+			total.Add(total, elem.Mul(elem, weight))
+		}
+	}
+	return total, nil
+}
+
+/*
+* Util Functions
+ */
+
+// The modulus that sums of elems are computed mod, along with the weight of
+// each of the `Ne` elems of an entry in its value and a bound on each elem.
+//
+// Entries are packed into Z_p elems in little-endian order, or stored as raw
+// big-endian 32-bit limbs (with a partial last limb) if `P = 0`, in which case sums are computed in the
+// clear mod 2^Bitlen(T).
+func elemDigits[T m.Elem](info *lhe.DBInfo) (*big.Int, []*big.Int, []*big.Int) {
+	weights := make([]*big.Int, info.Ne)
+	bounds := make([]*big.Int, info.Ne)
+	one := big.NewInt(1)
+	largest := new(big.Int).Sub(new(big.Int).Lsh(one, uint(info.BitsPer)), one)
+
+	if info.P == 0 {
+		mod := new(big.Int).Lsh(one, uint(T(0).Bitlen()))
+		// All limbs but the last are full
+		lastBits := info.BitsPer - (info.Ne-1)*32
+		for j := range weights[:info.Ne-1] {
+			weights[j] = new(big.Int).Lsh(one, uint(lastBits+32*(info.Ne-2-uint64(j))))
+			bounds[j] = big.NewInt(1<<32 - 1)
+		}
+		weights[info.Ne-1] = big.NewInt(1)
+		bounds[info.Ne-1] = new(big.Int).Sub(new(big.Int).Lsh(one, uint(lastBits)), one)
+		return mod, weights, bounds
+	}
+
+	p := new(big.Int).SetUint64(info.P)
+	weight := big.NewInt(1)
+	for j := range weights {
+		weights[j] = new(big.Int).Set(weight)
+		bounds[j] = new(big.Int).Sub(p, one)
+		weight.Mul(weight, p)
+	}
+
+	// The most significant elem is bounded by the entry size
+	top := new(big.Int).Quo(largest, weights[info.Ne-1])
+	if top.Cmp(bounds[info.Ne-1]) < 0 {
+		bounds[info.Ne-1] = top
+	}
+	return p, weights, bounds
+}
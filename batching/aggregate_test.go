@@ -0,0 +1,104 @@
+package batching
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/ryanleh/secure-inference/crypto/rand"
+	"github.com/ryanleh/secure-inference/lhe"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+var key = rand.PRGKey([16]byte{
+	100, 121, 60, 254, 76, 111, 7, 102, 199, 220, 220, 5, 95, 174, 252, 221,
+})
+
+// The value of entry `i` of `matrix`, given as big-endian limbs
+func entryValue(matrix *m.Matrix[m.Elem32], i, bitsPer uint64) *big.Int {
+	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+	val := big.NewInt(0)
+	for j := range numLimbs {
+		val.Lsh(val, uint(min(32, bitsPer-32*j)))
+		val.Add(val, big.NewInt(int64(matrix.Data()[i*numLimbs+j])))
+	}
+	return val
+}
+
+func testAggregate(t *testing.T, bitsPer uint64) {
+	rows, cols, load := uint64(16), uint64(32), uint64(4)
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+	matrix := m.Rand[m.Elem32](prg, rows*numLimbs, cols, 0)
+	for i := range rows * cols {
+		matrix.Data()[(i+1)*numLimbs-1] %= m.Elem32(1 << (bitsPer - (numLimbs-1)*32))
+	}
+
+	server := NewDirectServer[m.Elem64](lhe.MakeServer[m.Elem64](lhe.Local, matrix, bitsPer, 0, lhe.RowMajor, &key, false), load)
+	defer server.Free()
+	client := server.Params().NewClient().(*DirectClient[m.Elem64])
+	client.Init(server.Params())
+	defer client.Free()
+
+	// A weighted sum over entries spread across several rows, with a
+	// repeated index
+	indices := []uint64{0, 5, 31, 32, 40, 5, 100}
+	weights := []uint64{1, 2, 3, 4, 5, 6, 7}
+	secret, query, err := client.Aggregate(indices, weights)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(query.(*DirectQuery[m.Elem64]).Queries) != int(load) {
+		t.Fatalf("Query is not padded to the load")
+	}
+	expected := big.NewInt(0)
+	for i, idx := range indices {
+		val := entryValue(matrix, idx, bitsPer)
+		expected.Add(expected, val.Mul(val, new(big.Int).SetUint64(weights[i])))
+	}
+	if result, err := client.RecoverAggregate(secret, server.Answer(query)); err != nil || result.Cmp(expected) != 0 {
+		t.Fatalf("Weighted sum: %v vs. %v (%v)", result, expected, err)
+	}
+
+	secret, query, err = client.Sum(indices[:3])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected.SetInt64(0)
+	for _, idx := range indices[:3] {
+		expected.Add(expected, entryValue(matrix, idx, bitsPer))
+	}
+	if result, err := client.RecoverAggregate(secret, server.Answer(query)); err != nil || result.Cmp(expected) != 0 {
+		t.Fatalf("Sum: %v vs. %v (%v)", result, expected, err)
+	}
+
+	// Entries spanning more rows than the load are rejected
+	if _, _, err := client.Sum([]uint64{0, 32, 64, 96, 128}); err == nil {
+		t.Fatalf("Expected an error above the load")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	testAggregate(t, 20)
+	testAggregate(t, 48)
+}
+
+func TestCheckAggregate(t *testing.T) {
+	// A single Zp elem per entry, with headroom for sums of up to 16 entries
+	info := lhe.NewEmptyDB(64, 8, 8, 1<<12, lhe.RowMajor).Info
+	if CheckAggregate[m.Elem32](info, 16) != nil || CheckAggregate[m.Elem32](info, 17) == nil {
+		t.Fatalf("Unexpected overflow check")
+	}
+
+	// Sums of multiple full Zp elems always overflow
+	info = lhe.NewEmptyDB(64, 24, 8, 1<<12, lhe.RowMajor).Info
+	if CheckAggregate[m.Elem32](info, 1) != nil || CheckAggregate[m.Elem32](info, 2) == nil {
+		t.Fatalf("Unexpected overflow check")
+	}
+
+	// Raw limbs are summed mod 2^Bitlen(T)
+	info = lhe.NewEmptyDB(64, 48, 8, 0, lhe.RowMajor).Info
+	if CheckAggregate[m.Elem64](info, 1<<32) != nil || CheckAggregate[m.Elem32](info, 2) == nil {
+		t.Fatalf("Unexpected overflow check")
+	}
+}
@@ -0,0 +1,98 @@
+package batching
+
+import (
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+// The interfaces below capture any scheme that retrieves a batch of DB entries
+// at once (e.g. batch codes or dPIR). Queries are given as DB indices and
+// results map each retrieved index to its entry, given as 32-bit limbs.
+//
+// Schemes may not retrieve every queried index, so results also report why
+// each missing index was not retrieved.
+//
+// As with the LHE interfaces, we can't express the associated types of each
+// scheme in Go's type system, so the various input/output types are
+// interfaces which each scheme type-casts to its own implementation.
+
+// The interface for a batch client
+type Client[T m.Elem] interface {
+	// Initialize a client using the server's parameters. Clients may refuse
+	// parameters (e.g. a dPIR tier configuration that leaks too much).
+	Init(Params[T]) error
+
+	// Generate a query for a batch of indices
+	Query([]uint64) (Secret[T], Query[T])
+
+	// Recover the entries retrieved by a query. This fails if the query's
+	// secret was already used (see `lhe.ErrSecretReused`).
+	Recover(Secret[T], Answer[T]) (*Result, error)
+
+	// Get the client state size
+	StateSize() uint64
+
+	// Free the client
+	Free()
+}
+
+// The interface for a batch server
+type Server[T m.Elem] interface {
+	// Produce the parameters needed to initialize a client
+	Params() Params[T]
+
+	// Answer a batch query
+	Answer(Query[T]) Answer[T]
+
+	// Answer the batch queries of several clients at once
+	AnswerBatch([]Query[T]) []Answer[T]
+
+	// Get the server state size
+	StateSize() uint64
+
+	// Free the server
+	Free()
+}
+
+type Params[T m.Elem] interface {
+	// Create an uninitialized client for these parameters
+	NewClient() Client[T]
+}
+
+type Secret[T m.Elem] interface {
+	// The indices that will be retrieved by the corresponding query. This may
+	// be a subset of the queried indices if the scheme drops some of them.
+	Keys() []uint64
+}
+
+type Query[T m.Elem] interface {
+	Size() uint64
+}
+
+type Answer[T m.Elem] interface {
+	Size() uint64
+}
+
+// The outcome of a batch query. Every distinct queried index appears in
+// exactly one of `Values`, `Unselected` or `Overflow`.
+type Result struct {
+	// The retrieved entries
+	Values map[uint64][]m.Elem32
+
+	// Indices which were not queried because they aren't held by the part of
+	// the DB that was queried (e.g. the dPIR tier)
+	Unselected []uint64
+
+	// Indices which were not queried because the batch exceeded the capacity
+	// of the scheme (e.g. batch code overflow)
+	Overflow []uint64
+}
+
+// Whether every queried index was retrieved
+func (r *Result) Complete() bool {
+	return len(r.Unselected) == 0 && len(r.Overflow) == 0
+}
+
+// The indices which were not retrieved
+func (r *Result) Missing() []uint64 {
+	return append(append([]uint64{}, r.Unselected...), r.Overflow...)
+}
@@ -1,6 +1,7 @@
 package batching
 
 import (
+	"fmt"
 	"math"
 	"sort"
 
@@ -9,8 +10,6 @@ import (
 	"github.com/ryanleh/secure-inference/matrix/gpu"
 )
 
-// TODO: Create an abstraction that captures both dPIR and batch codes
-
 // An enum representing the different ways to pack buckets
 type Packing int
 
@@ -48,6 +47,16 @@ func getOptions[T m.Elem]() ([]uint64, map[uint64]uint64) {
 // Approximate square dimensions + plaintext modulus for the given set of elements.
 // Returns rows, cols, pMod
 func ApproxSquareDims[T m.Elem](entries, bitsPer uint64) (uint64, uint64, uint64) {
+	rows, cols, pMod, err := SquareDims[T](entries, bitsPer)
+	if err != nil {
+		panic(err)
+	}
+	return rows, cols, pMod
+}
+
+// Same as `ApproxSquareDims`, but returns an error if there are no supported
+// parameters
+func SquareDims[T m.Elem](entries, bitsPer uint64) (uint64, uint64, uint64, error) {
 	// Find the largest pMod which supports square dimensions
 	options, pMods := getOptions[T]()
 
@@ -63,19 +72,27 @@ func ApproxSquareDims[T m.Elem](entries, bitsPer uint64) (uint64, uint64, uint64
 		}
 		cols := uint64(math.Ceil(float64(size) / float64(rows)))
 		if cols <= cutoff {
-			return rows, cols, pMod
+			return rows, cols, pMod, nil
 		}
 	}
-	panic("Invalid LWE parameters (?)")
+	return 0, 0, 0, errNoParams(entries)
 }
 
 // Approximate square dimensions + plaintext modulus for the given set of elements where
 // the columns are constrainted by a given amount
 func ApproxColConstraint[T m.Elem](entries, bitsPer, maxCols uint64) (uint64, uint64, uint64) {
+	rows, cols, pMod, err := colConstraintDims[T](entries, bitsPer, maxCols)
+	if err != nil {
+		panic(err)
+	}
+	return rows, cols, pMod
+}
+
+func colConstraintDims[T m.Elem](entries, bitsPer, maxCols uint64) (uint64, uint64, uint64, error) {
 	// If square dimensions satisfy the constraint then we're done
-	rows, cols, pMod := ApproxSquareDims[T](entries, bitsPer)
-	if cols <= maxCols {
-		return rows, cols, pMod
+	rows, cols, pMod, err := SquareDims[T](entries, bitsPer)
+	if err != nil || cols <= maxCols {
+		return rows, cols, pMod, err
 	}
 
 	// Find the largest pMod which supports the constraints
@@ -92,19 +109,27 @@ func ApproxColConstraint[T m.Elem](entries, bitsPer, maxCols uint64) (uint64, ui
 			for rows%elemWidth != 0 {
 				rows += 1
 			}
-			return rows, cols, pMod
+			return rows, cols, pMod, nil
 		}
 	}
-	panic("Invalid LWE parameters (?)")
+	return 0, 0, 0, errNoParams(entries)
 }
 
 // Approximate square dimensions + plaintext modulus for the given set of elements where
 // the rows are constrainted by a given amount
 func ApproxRowConstraint[T m.Elem](entries, bitsPer, maxRows uint64) (uint64, uint64, uint64) {
+	rows, cols, pMod, err := rowConstraintDims[T](entries, bitsPer, maxRows)
+	if err != nil {
+		panic(err)
+	}
+	return rows, cols, pMod
+}
+
+func rowConstraintDims[T m.Elem](entries, bitsPer, maxRows uint64) (uint64, uint64, uint64, error) {
 	// If square dimensions satisfy the constraint then we're done
-	rows, cols, pMod := ApproxSquareDims[T](entries, bitsPer)
-	if rows <= maxRows {
-		return rows, cols, pMod
+	rows, cols, pMod, err := SquareDims[T](entries, bitsPer)
+	if err != nil || rows <= maxRows {
+		return rows, cols, pMod, err
 	}
 
 	// Find the largest pMod which supports the constraints
@@ -119,12 +144,19 @@ func ApproxRowConstraint[T m.Elem](entries, bitsPer, maxRows uint64) (uint64, ui
 		for rows%elemWidth != 0 {
 			rows -= 1
 		}
+		if rows == 0 {
+			continue
+		}
 		cols := uint64(math.Ceil(float64(size) / float64(rows)))
 		if cols <= cutoff {
-			return rows, cols, pMod
+			return rows, cols, pMod, nil
 		}
 	}
-	panic("Invalid LWE parameters (?)")
+	return 0, 0, 0, errNoParams(entries)
+}
+
+func errNoParams(entries uint64) error {
+	return fmt.Errorf("no supported LWE parameters for %v entries", entries)
 }
 
 // Computes matrix / plaintext parameters for a given set of buckets to balance
@@ -133,13 +165,15 @@ func ApproxRowConstraint[T m.Elem](entries, bitsPer, maxRows uint64) (uint64, ui
 // The output corresponds to parameters _after_ DB encoding, so you might need to
 // multiply by `numLimbs / elemWidth` if you're allocating based on this
 //
+// Returns an error if there are no supported parameters for some bucket.
+//
 // TODO: Clean up this API at some point (e.g. have some form of config file we
 // pass around)
 func PackingDims[T m.Elem](
 	sizes []uint64,
 	bitsPer, origRows, origCols, origP uint64,
 	method Packing,
-) ([]uint64, []uint64, []uint64) {
+) ([]uint64, []uint64, []uint64, error) {
 	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
 
 	// We assumes `sizes` refers to un-encoded DB. Get the number of rows after theoretically encoding the
@@ -158,6 +192,7 @@ func PackingDims[T m.Elem](
 	cols := make([]uint64, len(sizes))
 	pMods := make([]uint64, len(sizes))
 	free := uint64(0)
+	var err error
 	for _, permSize := range sortedSizes {
 		// Get the size of the bucket after encoding into Zp elements
 		i := permSize.Idx
@@ -165,7 +200,7 @@ func PackingDims[T m.Elem](
 		switch method {
 		case Balanced:
 			// To balance, each bucket should be square
-			rows[i], cols[i], pMods[i] = ApproxSquareDims[T](permSize.Entries, bitsPer)
+			rows[i], cols[i], pMods[i], err = SquareDims[T](permSize.Entries, bitsPer)
 		case Comm:
 			// To keep communication unchanged, the total number of columns
 			// should not exceed origCols. We use a simple greedy algorithm to
@@ -174,7 +209,7 @@ func PackingDims[T m.Elem](
 			// Maximum columns for this bucket is its own allocation + whatever
 			// previous buckets didn't use
 			maxCols := uint64(math.Floor(float64(origCols)/float64(len(sizes)))) + free
-			rows[i], cols[i], pMods[i] = ApproxColConstraint[T](permSize.Entries, bitsPer, maxCols)
+			rows[i], cols[i], pMods[i], err = colConstraintDims[T](permSize.Entries, bitsPer, maxCols)
 			free = maxCols - cols[i]
 		case Storage:
 			// To keep communication unchanged, the total number of rows
@@ -184,9 +219,12 @@ func PackingDims[T m.Elem](
 			// Maximum rows for this bucket is its own allocation + whatever
 			// previous buckets didn't use
 			maxRows := uint64(math.Floor(float64(origRows)/float64(len(sizes)))) + free
-			rows[i], cols[i], pMods[i] = ApproxRowConstraint[T](permSize.Entries, bitsPer, maxRows)
+			rows[i], cols[i], pMods[i], err = rowConstraintDims[T](permSize.Entries, bitsPer, maxRows)
 			free = maxRows - rows[i]
 		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
 	}
-	return rows, cols, pMods
+	return rows, cols, pMods, nil
 }
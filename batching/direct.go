@@ -0,0 +1,222 @@
+package batching
+
+import (
+	"github.com/ryanleh/secure-inference/lhe"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+// A batch scheme that queries a single LHE scheme over the full DB directly:
+// the client makes one LHE query per DB column holding a queried index and
+// pads the batch with dummy queries up to a fixed load so that the number of
+// real indices is hidden.
+
+// Params
+type DirectParams[T m.Elem] struct {
+	Load uint64
+	Hint lhe.Hint[T]
+}
+
+func (p *DirectParams[T]) NewClient() Client[T] {
+	return &DirectClient[T]{}
+}
+
+// Secret
+type DirectSecret[T m.Elem] struct {
+	Indices  []uint64
+	Overflow []uint64
+
+	// The query answering each index. Indices in the same DB column share a
+	// query.
+	Slots   []int
+	Secrets []lhe.Secret[T]
+}
+
+func (s *DirectSecret[T]) Keys() []uint64 {
+	return s.Indices
+}
+
+// Query
+type DirectQuery[T m.Elem] struct {
+	Queries []lhe.Query[T]
+}
+
+func (q *DirectQuery[T]) Size() uint64 {
+	size := uint64(0)
+	for _, query := range q.Queries {
+		size += query.Size()
+	}
+	return size
+}
+
+// Answer
+type DirectAnswer[T m.Elem] struct {
+	Answers []lhe.Answer[T]
+}
+
+func (a *DirectAnswer[T]) Size() uint64 {
+	size := uint64(0)
+	for _, answer := range a.Answers {
+		size += answer.Size()
+	}
+	return size
+}
+
+/*
+* Client
+ */
+
+type DirectClient[T m.Elem] struct {
+	lheClient lhe.Client[T]
+	load      uint64
+}
+
+func (c *DirectClient[T]) Init(p Params[T]) error {
+	params := p.(*DirectParams[T])
+	c.load = params.Load
+	c.lheClient = lhe.NewClient[T](params.Hint)
+	c.lheClient.Init(params.Hint)
+	return nil
+}
+
+// Indices in the same DB column are retrieved by a single query. Only the
+// indices in the first `Load` distinct columns are queried, any others are
+// dropped.
+func (c *DirectClient[T]) Query(indices []uint64) (Secret[T], Query[T]) {
+	dbInfo := c.lheClient.DBInfo()
+	secret := &DirectSecret[T]{Indices: []uint64{}, Overflow: []uint64{}}
+
+	// Translate columns to vector queries
+	columns := make(map[uint64]int)
+	inputs := []*m.Matrix[T]{}
+	for _, idx := range indices {
+		col := dbInfo.Column(idx)
+		slot, ok := columns[col]
+		if !ok {
+			if uint64(len(inputs)) == c.load {
+				secret.Overflow = append(secret.Overflow, idx)
+				continue
+			}
+			slot = len(inputs)
+			columns[col] = slot
+			input := m.New[T](dbInfo.M, 1)
+			input.Set(col, 0, 1)
+			inputs = append(inputs, input)
+		}
+		secret.Indices = append(secret.Indices, idx)
+		secret.Slots = append(secret.Slots, slot)
+	}
+
+	// Build query
+	s, q := c.lheClient.Query(inputs)
+	secret.Secrets = s
+	query := &DirectQuery[T]{Queries: q}
+
+	// Generate dummy queries if needed
+	if remaining := c.load - uint64(len(inputs)); remaining > 0 {
+		s, q = c.lheClient.DummyQuery(remaining)
+		secret.Secrets = append(secret.Secrets, s...)
+		query.Queries = append(query.Queries, q...)
+	}
+	return secret, query
+}
+
+// Retrieve the `count` entries starting at `start` with a single batch query,
+// where `answer` sends the query to the server and returns its answer. Entries
+// in the same column share an LHE query, so with a column-major DB (see
+// `lhe.ColumnMajor`) a range spanning up to `Load` columns is retrieved in
+// full. Entries in any further columns are reported as overflow.
+func (c *DirectClient[T]) GetRange(start, count uint64, answer func(Query[T]) Answer[T]) (*Result, error) {
+	indices := make([]uint64, count)
+	for i := range indices {
+		indices[i] = start + uint64(i)
+	}
+	secret, query := c.Query(indices)
+	return c.Recover(secret, answer(query))
+}
+
+func (c *DirectClient[T]) Recover(s Secret[T], a Answer[T]) (*Result, error) {
+	secret := s.(*DirectSecret[T])
+	answer := a.(*DirectAnswer[T])
+
+	results := make(map[uint64][]m.Elem32, len(secret.Indices))
+	recovered, err := c.lheClient.Recover(secret.Secrets, answer.Answers)
+	if err != nil {
+		return nil, err
+	}
+	dbInfo := c.lheClient.DBInfo()
+	for j, idx := range secret.Indices {
+		results[idx] = ExtractEntry(dbInfo, recovered[secret.Slots[j]], idx)
+	}
+	return &Result{Values: results, Overflow: secret.Overflow}, nil
+}
+
+func (c *DirectClient[T]) StateSize() uint64 {
+	return c.lheClient.StateSize()
+}
+
+func (c *DirectClient[T]) Free() {
+	c.lheClient.Free()
+}
+
+/*
+* Server
+ */
+
+type DirectServer[T m.Elem] struct {
+	lheServer lhe.Server[T]
+	load      uint64
+}
+
+// Serve batches of `load` indices using `server`
+func NewDirectServer[T m.Elem](server lhe.Server[T], load uint64) *DirectServer[T] {
+	server.SetBatch(load)
+	return &DirectServer[T]{server, load}
+}
+
+func (s *DirectServer[T]) Params() Params[T] {
+	return &DirectParams[T]{Load: s.load, Hint: s.lheServer.Hint()}
+}
+
+func (s *DirectServer[T]) Answer(q Query[T]) Answer[T] {
+	query := q.(*DirectQuery[T])
+	return &DirectAnswer[T]{s.lheServer.Answer(query.Queries)}
+}
+
+func (s *DirectServer[T]) AnswerBatch(qs []Query[T]) []Answer[T] {
+	batches := make([][]lhe.Query[T], len(qs))
+	for i, q := range qs {
+		batches[i] = q.(*DirectQuery[T]).Queries
+	}
+	answers := lhe.AnswerBatch(s.lheServer, batches)
+	s.lheServer.SetBatch(s.load)
+
+	results := make([]Answer[T], len(qs))
+	for i := range results {
+		results[i] = &DirectAnswer[T]{answers[i]}
+	}
+	return results
+}
+
+func (s *DirectServer[T]) StateSize() uint64 {
+	return s.lheServer.StateSize()
+}
+
+func (s *DirectServer[T]) Free() {
+	s.lheServer.Free()
+}
+
+/*
+* Util Functions
+ */
+
+// Extract the entry at DB index `idx` from a decrypted LHE answer for the
+// column containing `idx`
+func ExtractEntry[T m.Elem](dbInfo *lhe.DBInfo, column *m.Matrix[T], idx uint64) []m.Elem32 {
+	// TODO: This is necessary due to typing stuff atm
+	index := dbInfo.Row(idx)
+	rawResult := make([]m.Elem32, dbInfo.Ne)
+	for k := range dbInfo.Ne {
+		rawResult[k] = m.Elem32(column.Data()[index+k])
+	}
+	return dbInfo.ReconstructElem(rawResult)
+}
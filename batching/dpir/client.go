@@ -1,157 +1,286 @@
 package dpir
 
 import (
-	"math/rand"
+	"fmt"
+	"math"
 
-	"github.com/ryanleh/secure-inference/batching/pbc"
+	"github.com/ryanleh/secure-inference/batching"
+	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
 
 type Client[T m.Elem] struct {
-	// Parameters for the distribution + buckets
+	// Parameters for the distribution + tiers
 	Params[T]
 
-	// LHE Clients for each bucket
-	types      []PirType
-	pirClients []interface{} // TODO
+	// Batch clients for each tier
+	pirClients []batching.Client[T]
+
+	// Source of the tier coin. The privacy of dPIR relies on the server not
+	// being able to predict it, so this must be a CSPRNG.
+	prg *rand.BufPRGReader
+
+	// Leakage the client accepts, if any
+	policy *LeakagePolicy
 }
 
-func (c *Client[T]) Init(params Params[T]) {
-	c.types = params.Types
-	hints := params.Hints
+// Use `prg` to select tiers instead of a randomly-keyed PRG. This is only
+// meant for deterministic tests, and must be called before `Init`.
+func (c *Client[T]) SetPRG(prg *rand.BufPRGReader) {
+	c.prg = prg
+}
+
+// Refuse tier configurations that leak more than `policy` allows, in which case
+// `Init` returns the reason. Must be called before `Init`.
+func (c *Client[T]) SetLeakagePolicy(policy *LeakagePolicy) {
+	c.policy = policy
+}
+
+func (c *Client[T]) Init(p batching.Params[T]) error {
+	params := p.(*Params[T])
+	if c.policy != nil {
+		if err := c.policy.Check(&params.TierConfig, params.Leakage); err != nil {
+			return fmt.Errorf("tier configuration rejected: %v", err)
+		}
+	}
 
 	// Initialize relevant fields
-	c.Params = params
-	c.pirClients = make([]interface{}, len(c.types))
-	for i := range c.pirClients {
-		// Set the correct type of LHE client for each bucket
-		switch c.types[i] {
-		case Local:
-			client := &lhe.LocalClient[T]{}
-			client.Init(hints[i].(lhe.Hint[T]))
-			c.pirClients[i] = client
-		case Simple, SimpleHybrid:
-			client := &lhe.SimpleClient[T]{}
-			client.Init(hints[i].(lhe.Hint[T]))
-			c.pirClients[i] = client
-		case PBC, PBCAngel:
-			client := &pbc.Client[T]{}
-			client.Init(hints[i].(*pbc.Params[T]))
-			c.pirClients[i] = client
-		default:
-			panic("Invalid LHE client type")
+	c.Params = *params
+	if c.prg == nil {
+		c.prg = rand.NewRandomBufPRG()
+	}
+
+	// The parameters of each tier determine the type of client to use
+	c.pirClients = make([]batching.Client[T], len(params.Hints))
+	for i, hint := range params.Hints {
+		// Derive hints which are a prefix of another tier's hint
+		if j, ok := params.Shared[i]; ok {
+			prefix := hint.(*batching.DirectParams[T])
+			full := params.Hints[j].(*batching.DirectParams[T])
+			hint = &batching.DirectParams[T]{Load: prefix.Load, Hint: lhe.RestoreHint[T](prefix.Hint, full.Hint)}
+		}
+		c.pirClients[i] = hint.NewClient()
+		if err := c.pirClients[i].Init(hint); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-// TODO: Need to free stuff
-func (c *Client[T]) Query(indices []uint64) (*Secret[T], *Query[T]) {
-    // Randomly choose which bucket to query by flipping a coin
-    bucket := 0
-    if rand.Float64() < c.Alpha {
-        bucket = 1
-    }
-
-    queryIndices := []uint64{}
-    if bucket == 0 {
-        // Only allocate queries for indices that are in the popular subset
-        for _, idx := range indices {
-            if idx < c.Cutoff {
-                queryIndices = append(queryIndices, idx)
-            }
-        }
-    } else {
-        queryIndices = indices
-    }
-
-    // Build queries for the bucket
-	var secret *Secret[T]
-	var query *Query[T]
-    if c.types[bucket] == PBC || c.types[bucket] == PBCAngel {
-        client := c.pirClients[bucket].(*pbc.Client[T])
-
-        // Build query
-        s, q := client.Query(queryIndices)
-        secret = &Secret[T]{Bucket: bucket, BatchSecret: s}
-        query = &Query[T]{Bucket: bucket, BatchQuery: q}
-    } else {
-        client := c.pirClients[bucket].(lhe.Client[T])
-        dbInfo := client.DBInfo()
-
-        // Translate indices to vector queries
-        inputs := make([]*m.Matrix[T], len(queryIndices))
-        for j, idx := range queryIndices {
-            inputs[j] = m.New[T](dbInfo.M, 1)
-            inputs[j].Set(uint64(idx%dbInfo.M), 0, 1)
-        }
-
-        // Build query
-        s, q := client.Query(inputs)
-        secret = &Secret[T]{Bucket: bucket, Keys: queryIndices, Secret: s}
-        query = &Query[T]{Bucket: bucket, Query: q}
-
-        // Generate dummy queries if needed
-        s, q = client.DummyQuery(c.Load - uint64(len(inputs)))
-        secret.Secret = append(secret.Secret, s...)
-        query.Query = append(query.Query, q...)
-    }
-	return secret, query
-}
-
-func (c *Client[T]) Recover(secret *Secret[T], answer *Answer[T]) map[uint64][]m.Elem32 {
-	results := make(map[uint64][]m.Elem32, c.Load)
-    bucket := secret.Bucket
-    pirType := c.Types[bucket]
-
-    if pirType == PBC || pirType == PBCAngel {
-        client := c.pirClients[bucket].(*pbc.Client[T])
-        for key, val := range client.Recover(secret.BatchSecret, answer.BatchAnswer) {
-            results[key] = val
-        }
-    } else {
-        client := c.pirClients[bucket].(lhe.Client[T])
-        recovered := client.Recover(secret.Secret, answer.Answer)
-        dbInfo := client.DBInfo()
-        for j, answer := range recovered {
-            // Extract individual elements from each result
-            //
-            // TODO: For now just single elements instead of full LHE
-            index := dbInfo.Ne * (secret.Keys[j] / dbInfo.M)
-
-            // TODO: This is necessary due to typing stuff atm
-            rawResult := make([]m.Elem32, 0)
-            for k := range dbInfo.Ne {
-                rawResult = append(rawResult, m.Elem32(answer.Data()[index+k]))
-            }
-            results[secret.Keys[j]] = dbInfo.ReconstructElem(rawResult)
-        }
-    }
-
-	return results
-}
+// Secrets are released by `Recover`, and otherwise by a finalizer once they
+// are unreachable (see `lhe.SimpleSecret`)
+func (c *Client[T]) Query(indices []uint64) (batching.Secret[T], batching.Query[T]) {
+	// Randomly choose which tier to query
+	tier := c.sampleTier()
 
-func (c *Client[T]) StateSize() uint64 {
-	size := uint64(0)
-	for i, pirType := range c.types {
-		if pirType == PBC || pirType == PBCAngel {
-			client := c.pirClients[i].(*pbc.Client[T])
-			size += client.StateSize()
+	// Only allocate queries for keys that are in the chosen tier, given by
+	// their position in the tier
+	queryIndices := []uint64{}
+	unselected := []uint64{}
+	keys := make(map[uint64]uint64)
+	for _, key := range indices {
+		if pos, ok := c.position(tier, key); ok {
+			queryIndices = append(queryIndices, pos)
+			keys[pos] = key
 		} else {
-			client := c.pirClients[i].(lhe.Client[T])
-			size += client.StateSize()
+			unselected = append(unselected, key)
+		}
+	}
+
+	// Build queries for the tier
+	s, q := c.pirClients[tier].Query(queryIndices)
+	secret := &Secret[T]{Bucket: tier, Secret: s, Unselected: unselected, keys: keys}
+	return secret, &Query[T]{Bucket: tier, Query: q}
+}
+
+func (c *Client[T]) Recover(s batching.Secret[T], a batching.Answer[T]) (*batching.Result, error) {
+	secret := s.(*Secret[T])
+	answer := a.(*Answer[T])
+	recovered, err := c.pirClients[secret.Bucket].Recover(secret.Secret, answer.Answer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Translate tier positions back to logical keys
+	result := &batching.Result{
+		Values:     make(map[uint64][]m.Elem32, len(recovered.Values)),
+		Unselected: secret.Unselected,
+	}
+	for pos, value := range recovered.Values {
+		result.Values[secret.keys[pos]] = value
+	}
+	for _, pos := range recovered.Unselected {
+		result.Unselected = append(result.Unselected, secret.keys[pos])
+	}
+	for _, pos := range recovered.Overflow {
+		result.Overflow = append(result.Overflow, secret.keys[pos])
+	}
+	return result, nil
+}
+
+// Retry policy for `Retrieve`
+type RetryPolicy struct {
+	// Number of follow-up queries issued after the first one. These are
+	// always issued, even if every index has already been retrieved, so that
+	// the number of queries the server sees doesn't depend on the outcome.
+	// Each follow-up is a regular query (with a fresh tier coin) and counts
+	// as such towards the client's privacy accounting.
+	Rounds int
+
+	// Which failures to retry
+	RetryUnselected bool
+	RetryOverflow   bool
+}
+
+// Retrieve `indices`, re-querying any that were not retrieved according to
+// `policy`. `answer` sends a query to the server and returns its answer.
+//
+// Indices that are still missing after the last round are reported under
+// the reason they failed in that round.
+func (c *Client[T]) Retrieve(
+	indices []uint64,
+	policy *RetryPolicy,
+	answer func(batching.Query[T]) batching.Answer[T],
+) (*batching.Result, error) {
+	secret, query := c.Query(indices)
+	result, err := c.Recover(secret, answer(query))
+	if err != nil || policy == nil {
+		return result, err
+	}
+
+	for range policy.Rounds {
+		// Only retry the failures allowed by the policy
+		retry := []uint64{}
+		if policy.RetryUnselected {
+			retry = append(retry, result.Unselected...)
+		}
+		if policy.RetryOverflow {
+			retry = append(retry, result.Overflow...)
+		}
+
+		secret, query := c.Query(retry)
+		retried, err := c.Recover(secret, answer(query))
+		if err != nil {
+			return nil, err
+		}
+
+		// Anything retried is either retrieved or failed again in this round
+		for key, value := range retried.Values {
+			result.Values[key] = value
+		}
+		if policy.RetryUnselected {
+			result.Unselected = nil
+		}
+		if policy.RetryOverflow {
+			result.Overflow = nil
+		}
+		result.Unselected = append(result.Unselected, retried.Unselected...)
+		result.Overflow = append(result.Overflow, retried.Overflow...)
+	}
+	return result, nil
+}
+
+// Uniform in [0, 1) with 53 bits of precision
+func (c *Client[T]) coin() float64 {
+	return float64(c.prg.Uint64()>>11) / (1 << 53)
+}
+
+// Retrieve the `count` keys starting at `start` with a single query (see
+// `Retrieve`). Within a tier with a column-major DB (see `Tier.DBLayout`),
+// keys that are adjacent in the tier share an LHE query, so short ranges are
+// retrieved in full if the chosen tier holds them.
+func (c *Client[T]) GetRange(
+	start, count uint64,
+	answer func(batching.Query[T]) batching.Answer[T],
+) (*batching.Result, error) {
+	indices := make([]uint64, count)
+	for i := range indices {
+		indices[i] = start + uint64(i)
+	}
+	return c.Retrieve(indices, nil, answer)
+}
+
+// Pick a tier according to the tier probabilities
+func (c *Client[T]) sampleTier() int {
+	return selectTier(c.Tiers, c.coin())
+}
+
+// Check that the empirical rate at which each tier is selected over `trials`
+// samples matches its probability (i.e., `Alpha` for two tiers). This draws
+// from the same source as `Query`, so it can be run as a health check on a
+// live client.
+func (c *Client[T]) SelfTest(trials uint64) error {
+	probs := make([]float64, len(c.Tiers))
+	for i, tier := range c.Tiers {
+		probs[i] = tier.Prob
+	}
+	return selectionTest(probs, trials, c.sampleTier)
+}
+
+// The tier selected by a uniform `coin` in [0, 1)
+func selectTier(tiers []Tier, coin float64) int {
+	for i, tier := range tiers {
+		if coin < tier.Prob {
+			return i
 		}
+		coin -= tier.Prob
+	}
+
+	// Only reachable due to rounding, return the last tier that can be chosen
+	for i := len(tiers) - 1; i > 0; i-- {
+		if tiers[i].Prob > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// Maximum deviation (in standard deviations) of a tier's selection count
+// before the self-test fails. A correct sampler fails with probability less
+// than 1e-6 per tier.
+const selectionMaxDeviation = 5.0
+
+func selectionTest(probs []float64, trials uint64, sample func() int) error {
+	if trials == 0 {
+		return fmt.Errorf("no trials")
+	}
+	counts := make([]uint64, len(probs))
+	for range trials {
+		counts[sample()] += 1
+	}
+
+	n := float64(trials)
+	for i, p := range probs {
+		count := float64(counts[i])
+		if p == 0 || p == 1 {
+			if count != p*n {
+				return fmt.Errorf("tier %d selected %d times with probability %v", i, counts[i], p)
+			}
+			continue
+		}
+		deviation := math.Abs(count-n*p) / math.Sqrt(n*p*(1-p))
+		if deviation > selectionMaxDeviation {
+			return fmt.Errorf(
+				"tier %d selected at rate %v vs. %v (%0.1f std. devs.)", i, count/n, p, deviation,
+			)
+		}
+	}
+	return nil
+}
+
+func (c *Client[T]) StateSize() uint64 {
+	// Each rank is stored as a (key, rank) pair
+	size := 16 * uint64(len(c.Ranks))
+	for _, client := range c.pirClients {
+		size += client.StateSize()
 	}
 	return size
 }
 
 func (c *Client[T]) Free() {
-	for i, pirType := range c.types {
-		if pirType == PBC || pirType == PBCAngel {
-			c.pirClients[i].(*pbc.Client[T]).Free()
-		} else {
-			c.pirClients[i].(lhe.Client[T]).Free()
-		}
+	for _, client := range c.pirClients {
+		client.Free()
 	}
 	c.pirClients = nil
 }
@@ -1,6 +1,12 @@
 package dpir
 
 import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/ryanleh/secure-inference/batching"
 	"github.com/ryanleh/secure-inference/batching/pbc"
 	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -17,57 +23,338 @@ const (
 	PBCAngel
 )
 
-// TODO: Temporary Params impl until we figure out something better
+// How the DB ranges of the tiers relate to each other
+type TierLayout int
+
+const (
+	// Tier `i` holds the prefix [0, Cutoff_i) of the DB
+	Nested TierLayout = iota
+
+	// Tier `i` holds the range [Cutoff_{i-1}, Cutoff_i) of the DB
+	Disjoint
+)
+
+// A single popularity tier. On each query the client picks exactly one tier,
+// with probability `Prob`, and retrieves the queried indices that fall in it.
+//
+// `Packing` only applies to batch code tiers, and `DBLayout` only to the
+// others (see `Client.GetRange`).
+type Tier struct {
+	Cutoff   uint64
+	Prob     float64
+	Type     PirType
+	Packing  batching.Packing
+	DBLayout lhe.Layout
+}
+
+// The tiers that a DB is split into.
 //
-// Assumes that the DB is already ordered by popularity, just gives the bucket
+// Assumes that the DB is already ordered by popularity, just gives the tier
 // boundaries
+type TierConfig struct {
+	Tiers  []Tier
+	Layout TierLayout
+
+	// Lay out tiers which start at the beginning of the DB like a tier of the
+	// same type holding the full DB, so that their hints are a prefix of its
+	// hint. Clients then only store the full hint and servers only compute it
+	// once, but queries to those tiers become as large as queries to the full
+	// DB. Only applies to Simple and SimpleHybrid tiers over a DB which is
+	// already ordered by popularity.
+	ShareHints bool
+}
+
+// Rank keys by decreasing access count, breaking ties by key. Returns the key
+// at each popularity rank.
+func RankByCounts(counts []uint64) []uint64 {
+	ranking := make([]uint64, len(counts))
+	for i := range ranking {
+		ranking[i] = uint64(i)
+	}
+	slices.SortStableFunc(ranking, func(a, b uint64) int {
+		return cmp.Compare(counts[b], counts[a])
+	})
+	return ranking
+}
+
+// The classic two-tier configuration: the popular `cutoff`-prefix is queried
+// with probability `1 - alpha` and the full DB of `n` entries otherwise
+func TwoTiers(cutoff, n uint64, alpha float64, popular, full PirType) *TierConfig {
+	return &TierConfig{
+		Tiers: []Tier{
+			{Cutoff: cutoff, Prob: 1 - alpha, Type: popular, Packing: batching.Balanced},
+			{Cutoff: n, Prob: alpha, Type: full, Packing: batching.Balanced},
+		},
+		Layout: Nested,
+	}
+}
+
+// TODO: Temporary Params impl until we figure out something better
 type Params[T m.Elem] struct {
-	Cutoff uint64
-    Alpha  float64
-	Load   uint64
-	Types  []PirType
-	Hints  []interface{} // TODO
+	TierConfig
+	Load  uint64
+	Hints []batching.Params[T]
+
+	// The popularity rank of each logical key that is stored in a tier which
+	// doesn't hold the full DB (those are kept in key order). Nil if the DB
+	// is already ordered by popularity.
+	Ranks map[uint64]uint64
+
+	// For each tier whose hint is a prefix of another tier's hint, the index
+	// of that tier. The hints of those tiers are sent without the hint matrix.
+	Shared map[int]int
+
+	// Leakage of the tier choice under the server's popularity estimate, if
+	// the server computed it
+	Leakage *Leakage
+}
+
+func (p *Params[T]) NewClient() batching.Client[T] {
+	return &Client[T]{}
+}
+
+// The position of logical key `key` within tier `i`, if the tier holds it
+func (p *Params[T]) position(i int, key uint64) (uint64, bool) {
+	rank := key
+	if p.Ranks != nil && !p.holdsAll(i) {
+		var ok bool
+		if rank, ok = p.Ranks[key]; !ok {
+			return 0, false
+		}
+	}
+
+	r := p.Range(i)
+	if !r.Contains(rank) {
+		return 0, false
+	}
+	return rank - r.Start, true
 }
 
 // Secret
 type Secret[T m.Elem] struct {
-    Bucket      int
-	Keys        []uint64
-	Secret      []lhe.Secret[T]
-	BatchSecret []*pbc.Secret[T]
+	Bucket int
+	Secret batching.Secret[T]
+
+	// Keys which are not held by the chosen tier
+	Unselected []uint64
+
+	// Maps positions in the tier back to logical keys
+	keys map[uint64]uint64
+}
+
+func (s *Secret[T]) Keys() []uint64 {
+	positions := s.Secret.Keys()
+	keys := make([]uint64, len(positions))
+	for i, pos := range positions {
+		keys[i] = s.keys[pos]
+	}
+	return keys
 }
 
 // Query
 type Query[T m.Elem] struct {
-    Bucket     int
-	Query      []lhe.Query[T]
-	BatchQuery []*pbc.Query[T]
+	Bucket int
+	Query  batching.Query[T]
 }
 
 func (q *Query[T]) Size() uint64 {
-	size := uint64(0)
-	for _, query := range q.Query {
-		size += query.Size()
-	}
-	for _, query := range q.BatchQuery {
-		size += query.Size()
-	}
-	return size
+	return q.Query.Size()
 }
 
 // Answer
 type Answer[T m.Elem] struct {
-	Answer      []lhe.Answer[T]
-	BatchAnswer []*pbc.Answer[T]
+	Answer batching.Answer[T]
 }
 
 func (a *Answer[T]) Size() uint64 {
-	size := uint64(0)
-	for _, answer := range a.Answer {
-		size += answer.Size()
+	return a.Answer.Size()
+}
+
+/*
+* PirType Impl
+ */
+
+// The LHE scheme used for non-batched PIR types
+func (t PirType) lheType() lhe.LHEType {
+	switch t {
+	case Simple:
+		return lhe.Simple
+	case SimpleHybrid:
+		return lhe.SimpleHybrid
+	case Local:
+		return lhe.Local
+	default:
+		panic("Not an LHE type")
 	}
-	for _, answer := range a.BatchAnswer {
-		size += answer.Size()
+}
+
+// The batch code mode used for batch code PIR types
+func (t PirType) pbcMode() pbc.Mode {
+	switch t {
+	case PBC:
+		return pbc.Hash
+	case PBCAngel:
+		return pbc.Cuckoo
+	default:
+		panic("Not a batch code type")
+	}
+}
+
+func (t PirType) String() string {
+	switch t {
+	case Simple:
+		return "Simple"
+	case SimpleHybrid:
+		return "SimpleHybrid"
+	case Local:
+		return "Local"
+	case PBC:
+		return "PBC"
+	case PBCAngel:
+		return "PBCAngel"
+	default:
+		return fmt.Sprintf("PirType(%d)", int(t))
+	}
+}
+
+/*
+* TierConfig Impl
+ */
+
+// Tolerance when checking that the tier probabilities sum to one
+const probEpsilon = 1e-9
+
+// Check that the tiers are well-formed for a DB of `n` entries.
+//
+// The tier is chosen independently of the queried indices and every tier
+// answers a fixed number of queries, so the queries of a well-formed
+// configuration never leak the indices (though their outcomes may, see
+// `Leakage`). However, an index is only retrieved
+// if it falls in the chosen tier, so we also require that every index is
+// retrievable with non-zero probability (see `RetrievalProb`).
+func (c *TierConfig) Validate(n uint64) error {
+	if len(c.Tiers) == 0 {
+		return fmt.Errorf("no tiers given")
+	}
+	if c.Layout != Nested && c.Layout != Disjoint {
+		return fmt.Errorf("invalid tier layout %d", c.Layout)
+	}
+
+	total := 0.0
+	prev := uint64(0)
+	for i, tier := range c.Tiers {
+		if tier.Cutoff <= prev {
+			return fmt.Errorf("tier %d: cutoffs must be strictly increasing (%d <= %d)", i, tier.Cutoff, prev)
+		}
+		if tier.Prob < 0 || tier.Prob > 1 || math.IsNaN(tier.Prob) {
+			return fmt.Errorf("tier %d: invalid probability %v", i, tier.Prob)
+		}
+		if tier.Type < Simple || tier.Type > PBCAngel {
+			return fmt.Errorf("tier %d: invalid PIR type %d", i, tier.Type)
+		}
+		if tier.Packing < batching.Balanced || tier.Packing > batching.Storage {
+			return fmt.Errorf("tier %d: invalid packing %d", i, tier.Packing)
+		}
+		if tier.DBLayout != lhe.RowMajor && tier.DBLayout != lhe.ColumnMajor {
+			return fmt.Errorf("tier %d: invalid DB layout %d", i, tier.DBLayout)
+		}
+		if tier.DBLayout != lhe.RowMajor && (tier.Type == PBC || tier.Type == PBCAngel) {
+			return fmt.Errorf("tier %d: batch code tiers only support the row-major DB layout", i)
+		}
+		// Under the disjoint layout, a tier that is never chosen leaves its
+		// range unreachable
+		if c.Layout == Disjoint && tier.Prob == 0 {
+			return fmt.Errorf("tier %d: indices [%d, %d) are never retrieved", i, prev, tier.Cutoff)
+		}
+		total += tier.Prob
+		prev = tier.Cutoff
+	}
+
+	if math.Abs(total-1) > probEpsilon {
+		return fmt.Errorf("tier probabilities sum to %v", total)
+	}
+	if prev != n {
+		return fmt.Errorf("last tier ends at %d but the DB has %d entries", prev, n)
+	}
+	if c.Layout == Nested && c.Tiers[len(c.Tiers)-1].Prob == 0 {
+		return fmt.Errorf("indices [%d, %d) are never retrieved", c.Range(len(c.Tiers)-2).End, n)
+	}
+	return nil
+}
+
+// The range of DB indices held by tier `i`
+func (c *TierConfig) Range(i int) TierRange {
+	if i < 0 {
+		return TierRange{0, 0}
+	}
+	if c.Layout == Disjoint && i > 0 {
+		return TierRange{c.Tiers[i-1].Cutoff, c.Tiers[i].Cutoff}
+	}
+	return TierRange{0, c.Tiers[i].Cutoff}
+}
+
+// For each tier whose hint can be shared with a tier holding the full DB (see
+// `ShareHints`), the index of that tier
+func (c *TierConfig) sharedHints() map[int]int {
+	if !c.ShareHints {
+		return nil
+	}
+	shared := make(map[int]int)
+	for i, tier := range c.Tiers {
+		if (tier.Type != Simple && tier.Type != SimpleHybrid) || !c.holdsAll(i) || tier.DBLayout != lhe.RowMajor {
+			continue
+		}
+		for j, other := range c.Tiers {
+			if _, ok := shared[j]; ok || other.Type != tier.Type || other.DBLayout != lhe.RowMajor {
+				continue
+			}
+			if c.Range(j).Start == 0 && !c.holdsAll(j) {
+				shared[j] = i
+			}
+		}
+	}
+	return shared
+}
+
+// Whether tier `i` holds the full DB
+func (c *TierConfig) holdsAll(i int) bool {
+	r := c.Range(i)
+	return r.Start == 0 && r.End == c.Tiers[len(c.Tiers)-1].Cutoff
+}
+
+// The probability that `idx` is retrieved by a query for it
+func (c *TierConfig) RetrievalProb(idx uint64) float64 {
+	prob := 0.0
+	for i, tier := range c.Tiers {
+		if c.Range(i).Contains(idx) {
+			prob += tier.Prob
+		}
 	}
-	return size
+	return prob
+}
+
+// The expected fraction of queried indices that are retrieved, when indices
+// are drawn from a distribution over the DB with CDF `cdf` (i.e., `cdf(k)` is
+// the probability of querying an index below `k`)
+func (c *TierConfig) ExpectedRecovery(cdf func(uint64) float64) float64 {
+	recovered := 0.0
+	for i, tier := range c.Tiers {
+		r := c.Range(i)
+		recovered += tier.Prob * (cdf(r.End) - cdf(r.Start))
+	}
+	return recovered
+}
+
+// A range of DB indices [Start, End)
+type TierRange struct {
+	Start uint64
+	End   uint64
+}
+
+func (r TierRange) Contains(idx uint64) bool {
+	return r.Start <= idx && idx < r.End
+}
+
+func (r TierRange) Size() uint64 {
+	return r.End - r.Start
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/ryanleh/secure-inference/batching"
 	"github.com/ryanleh/secure-inference/crypto/rand"
+	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
 
@@ -17,10 +18,10 @@ var key = rand.PRGKey([16]byte{
 
 // ------- Tests -------
 func randInstance[T m.Elem](
-	cutoff, load uint64,
-    alpha float64,
+	tiers *TierConfig,
+	ranking []uint64,
+	load uint64,
 	bitsPer, rows, cols, pMod uint64,
-	types []PirType,
 ) (*Server[T], *m.Matrix[m.Elem32]) {
 	if bitsPer > 63 || bitsPer%32 == 0 {
 		panic("Unsupported entry bits")
@@ -37,7 +38,7 @@ func randInstance[T m.Elem](
 		matrix.Data()[(i+1)*numLimbs-1] %= m.Elem32(truncateMod)
 	}
 
-	server := MakeServer[T](matrix, cutoff, alpha, load, bitsPer, pMod, types, batching.Balanced, &key, false)
+	server := MakeRankedServer[T](matrix, ranking, tiers, load, bitsPer, pMod, &key, false)
 	return server, matrix
 }
 
@@ -46,18 +47,19 @@ func testBucketing[T m.Elem](
 	client *Client[T],
 	server *Server[T],
 	matrix *m.Matrix[m.Elem32],
+	ranking []uint64,
+	iters int,
 	bitsPer, pMod uint64,
 ) {
 	defer client.Free()
 	defer server.Free()
 	prg := rand.NewBufPRG(rand.NewPRG(&key))
-	params := server.Params()
+	params := server.Params().(*Params[T])
 
     // Run query / answer a number of times
     //
     // TODO: Might need to make sure we free stuff here
 	client.Init(params)
-    iters := 50
     correct := 0.0 
     for range iters {
         // Generate client queries. Generate one less than the batch size to
@@ -65,18 +67,39 @@ func testBucketing[T m.Elem](
         numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
         indices := make([]uint64, params.Load-1)
         for i := range len(indices) {
-            // Generate queries according to step distribution
-            if r.Float64() < 1 - params.Alpha {
-                indices[i] = prg.Uint64() % params.Cutoff
-            } else {
-                indices[i] = prg.Uint64() % (matrix.Size() / numLimbs)
+            // Generate queries according to step distribution, where each
+            // tier is weighted by its probability
+            coin := r.Float64()
+            tier := len(params.Tiers) - 1
+            for j := range params.Tiers {
+                if coin < params.Tiers[j].Prob {
+                    tier = j
+                    break
+                }
+                coin -= params.Tiers[j].Prob
+            }
+            tierRange := params.Range(tier)
+            indices[i] = tierRange.Start + prg.Uint64()%tierRange.Size()
+            if ranking != nil {
+                indices[i] = ranking[indices[i]]
             }
         }
         secret, query := client.Query(indices)
 
         // Answer queries
         answer := server.Answer(query)
-        results := client.Recover(secret, answer)
+        result, err := client.Recover(secret, answer)
+        if err != nil {
+            t.Fatalf("Unexpected error: %v", err)
+        }
+        results := result.Values
+
+        // Every queried index is either retrieved or reported as missing
+        for _, idx := range indices {
+            if _, ok := results[idx]; !ok && !slices.Contains(result.Missing(), idx) {
+                t.Fatalf("Index %v neither retrieved nor reported", idx)
+            }
+        }
         
         // Check results
         for index, result := range results {
@@ -86,12 +109,23 @@ func testBucketing[T m.Elem](
                 t.Fatalf("Recovery error @ %v: %v vs. %v", index, result, expected)
             }
         }
-        correct += float64(len(results) + 1)
+        correct += float64(len(results))
     }
 
-    percentCorrect := correct / float64(iters * int(params.Load))
-    if percentCorrect < 0.88 {
-        t.Fatalf("Error rate too high: %v vs. %v", percentCorrect, 0.9)
+    // Compare against the recovery rate expected for the step distribution
+    cdf := func(k uint64) float64 {
+        mass := 0.0
+        for j, tier := range params.Tiers {
+            tierRange := params.Range(j)
+            below := min(max(k, tierRange.Start), tierRange.End) - tierRange.Start
+            mass += tier.Prob * float64(below) / float64(tierRange.Size())
+        }
+        return mass
+    }
+    expected := params.ExpectedRecovery(cdf)
+    percentCorrect := correct / float64(iters * int(params.Load-1))
+    if percentCorrect < expected-0.05 {
+        t.Fatalf("Error rate too high: %v vs. %v", percentCorrect, expected)
     }
 }
 
@@ -107,8 +141,69 @@ func testBasicSplit[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
 		{SimpleHybrid, PBCAngel},
 	}
 	for i := range rows {
-		server, matrix := randInstance[T](cutoffs[i], loads[i], alpha, bitsPer, rows[i], cols[i], pMod, types[i])
-		testBucketing[T](t, &Client[T]{}, server, matrix, bitsPer, pMod)
+		tiers := TwoTiers(cutoffs[i], rows[i]*cols[i], alpha, types[i][0], types[i][1])
+		server, matrix := randInstance[T](tiers, nil, loads[i], bitsPer, rows[i], cols[i], pMod)
+		testBucketing[T](t, &Client[T]{}, server, matrix, nil, 50, bitsPer, pMod)
+	}
+}
+
+func testMultiTier[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
+	rows, cols := uint64(512), uint64(512)
+	N := rows * cols
+	for _, layout := range []TierLayout{Nested, Disjoint} {
+		tiers := &TierConfig{
+			Tiers: []Tier{
+				{Cutoff: N / 64, Prob: 0.8, Type: SimpleHybrid},
+				{Cutoff: N / 8, Prob: 0.15, Type: PBCAngel},
+				{Cutoff: N, Prob: 0.05, Type: PBCAngel},
+			},
+			Layout: layout,
+		}
+		server, matrix := randInstance[T](tiers, nil, 10, bitsPer, rows, cols, pMod)
+
+		// All queries in an iteration go to the same tier, so the recovery
+		// rate of the disjoint layout needs more iterations to stabilize
+		testBucketing[T](t, &Client[T]{}, server, matrix, nil, 500, bitsPer, pMod)
+	}
+}
+
+// Popular tiers that share the hint of the full tier
+func testSharedHints[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
+	rows, cols := uint64(512), uint64(512)
+	N := rows * cols
+	for _, pirType := range []PirType{Simple, SimpleHybrid} {
+		tiers := &TierConfig{
+			Tiers: []Tier{
+				{Cutoff: N / 64, Prob: 0.6, Type: pirType},
+				{Cutoff: N / 8, Prob: 0.3, Type: pirType},
+				{Cutoff: N, Prob: 0.1, Type: pirType},
+			},
+			Layout: Nested,
+		}
+		server, _ := randInstance[T](tiers, nil, 10, bitsPer, rows, cols, pMod)
+		client := &Client[T]{}
+		client.Init(server.Params())
+		separate := client.StateSize()
+		serverSeparate := server.StateSize()
+		client.Free()
+		server.Free()
+
+		tiers.ShareHints = true
+		server, matrix := randInstance[T](tiers, nil, 10, bitsPer, rows, cols, pMod)
+		params := server.Params().(*Params[T])
+		if len(params.Shared) != 2 {
+			t.Fatalf("Expected two tiers to share a hint: %v", params.Shared)
+		}
+		client = &Client[T]{}
+		client.Init(params)
+		if client.StateSize() >= separate {
+			t.Fatalf("Sharing hints didn't reduce client state: %v vs. %v", client.StateSize(), separate)
+		}
+		if server.StateSize() >= serverSeparate {
+			t.Fatalf("Sharing hints didn't reduce server state: %v vs. %v", server.StateSize(), serverSeparate)
+		}
+		client.Free()
+		testBucketing[T](t, &Client[T]{}, server, matrix, nil, 50, bitsPer, pMod)
 	}
 }
 
@@ -124,3 +219,344 @@ func TestBasicSplit64(t *testing.T) {
 	testBasicSplit[m.Elem64](t, 24, uint64(1<<16))
 	testBasicSplit[m.Elem64](t, 48, uint64(1<<16))
 }
+
+func TestMultiTier32(t *testing.T) {
+	testMultiTier[m.Elem32](t, 24, uint64(1<<8))
+}
+
+func TestMultiTier64(t *testing.T) {
+	testMultiTier[m.Elem64](t, 24, uint64(1<<16))
+}
+
+func TestSharedHints32(t *testing.T) {
+	testSharedHints[m.Elem32](t, 24, uint64(1<<8))
+}
+
+func TestSharedHints64(t *testing.T) {
+	testSharedHints[m.Elem64](t, 24, uint64(1<<16))
+}
+
+// Local tiers over a DB in key order with a random popularity ranking
+func testRanked[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
+	rows, cols := uint64(256), uint64(256)
+	N := rows * cols
+	ranking := make([]uint64, N)
+	for i, j := range r.New(r.NewSource(1)).Perm(int(N)) {
+		ranking[i] = uint64(j)
+	}
+	configs := []*TierConfig{
+		TwoTiers(N/16, N, 0.3, Local, Local),
+		{
+			Tiers: []Tier{
+				{Cutoff: N / 64, Prob: 0.6, Type: Local},
+				{Cutoff: N / 8, Prob: 0.3, Type: Local},
+				{Cutoff: N, Prob: 0.1, Type: Local},
+			},
+			Layout: Disjoint,
+		},
+	}
+	for _, tiers := range configs {
+		server, matrix := randInstance[T](tiers, ranking, 10, bitsPer, rows, cols, pMod)
+
+		// Only keys in partial tiers should be published
+		ranked := uint64(len(server.Params().(*Params[T]).Ranks))
+		if tiers.Layout == Nested && ranked != N/16 || tiers.Layout == Disjoint && ranked != N {
+			t.Fatalf("Unexpected number of published ranks: %v", ranked)
+		}
+		testBucketing[T](t, &Client[T]{}, server, matrix, ranking, 1000, bitsPer, pMod)
+	}
+}
+
+func TestRanked32(t *testing.T) {
+	testRanked[m.Elem32](t, 24, uint64(1<<8))
+	testRanked[m.Elem32](t, 48, uint64(1<<8))
+}
+
+func TestRanked64(t *testing.T) {
+	testRanked[m.Elem64](t, 24, uint64(1<<16))
+}
+
+func TestTierSelection(t *testing.T) {
+	rows, cols := uint64(64), uint64(64)
+	N := rows * cols
+	alpha := 0.1
+	server, _ := randInstance[m.Elem32](TwoTiers(N/16, N, alpha, Local, Local), nil, 10, 24, rows, cols, 1<<8)
+	defer server.Free()
+
+	// Clients with the same seed select the same tiers
+	clients := make([]*Client[m.Elem32], 2)
+	for i := range clients {
+		clients[i] = &Client[m.Elem32]{}
+		clients[i].SetPRG(rand.NewBufPRG(rand.NewPRG(&key)))
+		clients[i].Init(server.Params())
+		defer clients[i].Free()
+	}
+	for range 1000 {
+		secret0, _ := clients[0].Query([]uint64{})
+		secret1, _ := clients[1].Query([]uint64{})
+		if secret0.(*Secret[m.Elem32]).Bucket != secret1.(*Secret[m.Elem32]).Bucket {
+			t.Fatalf("Seeded clients selected different tiers")
+		}
+	}
+
+	// The full DB should be selected at rate `alpha`
+	if err := clients[0].SelfTest(100000); err != nil {
+		t.Fatalf("Self-test failed: %v", err)
+	}
+
+	// A biased coin should be caught
+	biased := r.New(r.NewSource(1))
+	err := selectionTest([]float64{1 - alpha, alpha}, 100000, func() int {
+		if biased.Float64() < alpha+0.01 {
+			return 1
+		}
+		return 0
+	})
+	if err == nil {
+		t.Fatalf("Self-test passed for a biased coin")
+	}
+}
+
+func TestRetrieve(t *testing.T) {
+	rows, cols := uint64(64), uint64(64)
+	N := rows * cols
+	tiers := TwoTiers(N/16, N, 0.5, Local, Local)
+	server, matrix := randInstance[m.Elem32](tiers, nil, 10, 24, rows, cols, 1<<8)
+	defer server.Free()
+	client := &Client[m.Elem32]{}
+	client.SetPRG(rand.NewBufPRG(rand.NewPRG(&key)))
+	client.Init(server.Params())
+	defer client.Free()
+
+	// Half of the indices are outside of the popular tier
+	indices := []uint64{0, 1, 2, N - 3, N - 2, N - 1}
+	policy := &RetryPolicy{Rounds: 8, RetryUnselected: true}
+	for range 20 {
+		calls := 0
+		result, err := client.Retrieve(indices, policy, func(q batching.Query[m.Elem32]) batching.Answer[m.Elem32] {
+			calls += 1
+			return server.Answer(q)
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if calls != policy.Rounds+1 {
+			t.Fatalf("Expected %v queries, got %v", policy.Rounds+1, calls)
+		}
+		if len(result.Values)+len(result.Missing()) != len(indices) {
+			t.Fatalf("Inconsistent result: %v retrieved, %v missing", len(result.Values), result.Missing())
+		}
+		if len(result.Overflow) != 0 {
+			t.Fatalf("Unexpected overflow: %v", result.Overflow)
+		}
+		for idx, value := range result.Values {
+			if !slices.Equal(value, matrix.Data()[idx:idx+1]) {
+				t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, matrix.Data()[idx:idx+1])
+			}
+		}
+
+		// Popular indices are retrieved in the first round
+		for _, idx := range indices[:3] {
+			if _, ok := result.Values[idx]; !ok {
+				t.Fatalf("Popular index %v not retrieved", idx)
+			}
+		}
+	}
+}
+
+// Answer the queries of many clients in a single batch
+func TestAnswerBatch(t *testing.T) {
+	rows, cols := uint64(64), uint64(64)
+	N := rows * cols
+	tiers := &TierConfig{
+		Tiers:  []Tier{{Cutoff: N / 16, Prob: 0.6, Type: Local}, {Cutoff: N / 4, Prob: 0.3, Type: Local}, {Cutoff: N, Prob: 0.1, Type: Local}},
+		Layout: Nested,
+	}
+	load := uint64(4)
+	server, matrix := randInstance[m.Elem32](tiers, nil, load, 24, rows, cols, 1<<8)
+	defer server.Free()
+
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	clients := make([]*Client[m.Elem32], 32)
+	secrets := make([]batching.Secret[m.Elem32], len(clients))
+	queries := make([]batching.Query[m.Elem32], len(clients))
+	for i := range clients {
+		clients[i] = &Client[m.Elem32]{}
+		clients[i].Init(server.Params())
+		defer clients[i].Free()
+
+		indices := make([]uint64, load)
+		for j := range indices {
+			indices[j] = prg.Uint64() % N
+		}
+		secrets[i], queries[i] = clients[i].Query(indices)
+	}
+
+	answers := server.AnswerBatch(queries)
+	if len(answers) != len(clients) {
+		t.Fatalf("Expected %v answers, got %v", len(clients), len(answers))
+	}
+	for i, client := range clients {
+		result, err := client.Recover(secrets[i], answers[i])
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(result.Values)+len(result.Missing()) != int(load) {
+			t.Fatalf("Inconsistent result: %v retrieved, %v missing", len(result.Values), result.Missing())
+		}
+		for idx, value := range result.Values {
+			if !slices.Equal(value, matrix.Data()[idx:idx+1]) {
+				t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, matrix.Data()[idx:idx+1])
+			}
+		}
+	}
+}
+
+// Indices in the same column are retrieved by a single query, so more indices
+// than the load can be retrieved
+func TestSharedColumns(t *testing.T) {
+	rows, cols := uint64(64), uint64(64)
+	N := rows * cols
+	tiers := &TierConfig{Tiers: []Tier{{Cutoff: N, Prob: 1, Type: Local}}, Layout: Nested}
+	load := uint64(4)
+	server, matrix := randInstance[m.Elem32](tiers, nil, load, 24, rows, cols, 1<<8)
+	defer server.Free()
+	client := &Client[m.Elem32]{}
+	client.Init(server.Params())
+	defer client.Free()
+
+	// Two columns hold eight indices between them, and only two of the other
+	// indices fit in the load. The full tier keeps the DB's dimensions.
+	indices := []uint64{}
+	for i := range uint64(4) {
+		indices = append(indices, i*cols, i*cols+1)
+	}
+	for i := range load {
+		indices = append(indices, 2+i)
+	}
+	secret, query := client.Query(indices)
+	result, err := client.Recover(secret, server.Answer(query))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.Values) != 8+int(load)-2 || len(result.Overflow) != 2 {
+		t.Fatalf("Unexpected result: %v retrieved, %v overflow", len(result.Values), result.Overflow)
+	}
+	for idx, value := range result.Values {
+		if !slices.Equal(value, matrix.Data()[idx:idx+1]) {
+			t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, matrix.Data()[idx:idx+1])
+		}
+	}
+}
+
+// Adjacent keys in a column-major tier are retrieved by a single query
+func TestGetRange(t *testing.T) {
+	rows, cols := uint64(64), uint64(64)
+	N := rows * cols
+	load := uint64(2)
+	for _, layout := range []lhe.Layout{lhe.RowMajor, lhe.ColumnMajor} {
+		tiers := &TierConfig{Tiers: []Tier{{Cutoff: N, Prob: 1, Type: Local, DBLayout: layout}}, Layout: Nested}
+		server, matrix := randInstance[m.Elem32](tiers, nil, load, 24, rows, cols, 1<<8)
+		client := &Client[m.Elem32]{}
+		client.Init(server.Params())
+
+		// The range spans two columns of the column-major DB
+		start, count := uint64(10), uint64(100)
+		result, err := client.GetRange(start, count, server.Answer)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for idx, value := range result.Values {
+			if !slices.Equal(value, matrix.Data()[idx:idx+1]) {
+				t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, matrix.Data()[idx:idx+1])
+			}
+		}
+		retrieved := uint64(len(result.Values))
+		if layout == lhe.ColumnMajor && retrieved != count {
+			t.Fatalf("Expected the full range, got %v of %v", retrieved, count)
+		}
+		if layout == lhe.RowMajor && (retrieved >= count || retrieved+uint64(len(result.Overflow)) != count) {
+			t.Fatalf("Expected a partial range, got %v of %v", retrieved, count)
+		}
+		client.Free()
+		server.Free()
+	}
+}
+
+func TestRankByCounts(t *testing.T) {
+	ranking := RankByCounts([]uint64{3, 9, 0, 9, 5})
+	if !slices.Equal(ranking, []uint64{1, 3, 4, 0, 2}) {
+		t.Fatalf("Unexpected ranking: %v", ranking)
+	}
+}
+
+func TestTierValidation(t *testing.T) {
+	N := uint64(1000)
+	valid := []*TierConfig{
+		TwoTiers(100, N, 0.1, SimpleHybrid, PBC),
+		{Tiers: []Tier{{Cutoff: N, Prob: 1, Type: Local}}, Layout: Nested},
+		{Tiers: []Tier{{Cutoff: 10, Prob: 0.5, Type: Local}, {Cutoff: 100, Prob: 0.3, Type: Simple}, {Cutoff: N, Prob: 0.2, Type: PBC}}, Layout: Disjoint},
+		{Tiers: []Tier{{Cutoff: 10, Prob: 0, Type: Local}, {Cutoff: 100, Prob: 0.3, Type: Simple}, {Cutoff: N, Prob: 0.7, Type: PBC}}, Layout: Nested},
+	}
+	for _, tiers := range valid {
+		if err := tiers.Validate(N); err != nil {
+			t.Fatalf("Unexpected validation error: %v", err)
+		}
+	}
+
+	invalid := []*TierConfig{
+		{Tiers: []Tier{}, Layout: Nested},
+		{Tiers: []Tier{{Cutoff: 100, Prob: 0.5, Type: Simple}, {Cutoff: 100, Prob: 0.5, Type: PBC}}, Layout: Nested},
+		{Tiers: []Tier{{Cutoff: 100, Prob: 0.5, Type: Simple}, {Cutoff: N, Prob: 0.4, Type: PBC}}, Layout: Nested},
+		{Tiers: []Tier{{Cutoff: 100, Prob: 1.5, Type: Simple}, {Cutoff: N, Prob: -0.5, Type: PBC}}, Layout: Nested},
+		{Tiers: []Tier{{Cutoff: 100, Prob: 0.5, Type: Simple}, {Cutoff: N / 2, Prob: 0.5, Type: PBC}}, Layout: Nested},
+		{Tiers: []Tier{{Cutoff: 100, Prob: 1, Type: Simple}, {Cutoff: N, Prob: 0, Type: PBC}}, Layout: Nested},
+		{Tiers: []Tier{{Cutoff: 100, Prob: 0, Type: Simple}, {Cutoff: N, Prob: 1, Type: PBC}}, Layout: Disjoint},
+		{Tiers: []Tier{{Cutoff: N, Prob: 1, Type: PirType(10)}}, Layout: Nested},
+	}
+	for i, tiers := range invalid {
+		if err := tiers.Validate(N); err == nil {
+			t.Fatalf("Expected validation error for config %d", i)
+		}
+	}
+}
+
+func TestTierRecovery(t *testing.T) {
+	N := uint64(1000)
+	nested := &TierConfig{
+		Tiers:  []Tier{{Cutoff: 10, Prob: 0.5, Type: Local}, {Cutoff: 100, Prob: 0.3, Type: Simple}, {Cutoff: N, Prob: 0.2, Type: PBC}},
+		Layout: Nested,
+	}
+	disjoint := &TierConfig{Tiers: nested.Tiers, Layout: Disjoint}
+
+	probs := map[uint64][2]float64{
+		0:     {1.0, 0.5},
+		9:     {1.0, 0.5},
+		10:    {0.5, 0.3},
+		99:    {0.5, 0.3},
+		100:   {0.2, 0.2},
+		N - 1: {0.2, 0.2},
+		N:     {0.0, 0.0},
+	}
+	for idx, expected := range probs {
+		if p := nested.RetrievalProb(idx); math.Abs(p-expected[0]) > 1e-9 {
+			t.Fatalf("Nested retrieval probability @ %v: %v vs. %v", idx, p, expected[0])
+		}
+		if p := disjoint.RetrievalProb(idx); math.Abs(p-expected[1]) > 1e-9 {
+			t.Fatalf("Disjoint retrieval probability @ %v: %v vs. %v", idx, p, expected[1])
+		}
+	}
+
+	// Under a uniform distribution, the expected recovery is the average
+	// retrieval probability
+	uniform := func(k uint64) float64 { return float64(min(k, N)) / float64(N) }
+	for _, tiers := range []*TierConfig{nested, disjoint} {
+		expected := 0.0
+		for idx := range N {
+			expected += tiers.RetrievalProb(idx) / float64(N)
+		}
+		if r := tiers.ExpectedRecovery(uniform); math.Abs(r-expected) > 1e-9 {
+			t.Fatalf("Expected recovery: %v vs. %v", r, expected)
+		}
+	}
+}
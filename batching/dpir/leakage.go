@@ -0,0 +1,197 @@
+package dpir
+
+import (
+	"fmt"
+	"math"
+)
+
+// Leakage accounting for tier configurations. The tier of each query is
+// chosen with a coin that doesn't depend on the queried keys, so a query on
+// its own reveals nothing. However, whether a key is retrieved depends on how
+// popular it is, and clients typically react to missing keys (e.g. by querying
+// them again), so we assume the worst case where the server also learns the
+// outcome of every query.
+//
+// Keys whose smallest holding tier is the same are held by the same tiers, so
+// they are indistinguishable. We group them into classes (one per tier) and
+// measure how well the server can tell the classes apart after repeated
+// queries for the same key:
+//
+//   - Delta: the largest statistical distance between the server's views of
+//     queries for two keys. This holds for any prior. A query only separates
+//     two classes if it picks a tier holding exactly one of them, so if a
+//     single query does with probability at most `d`, `k` queries do with
+//     probability at most `1 - (1 - d)^k`.
+//   - Advantage: how much more likely the server is to guess the class of a
+//     key drawn from a prior after seeing the outcomes, compared to guessing
+//     from the prior alone.
+
+// The leakage of a tier configuration
+type Leakage struct {
+	// Number of queries the bounds apply to
+	Queries int
+
+	// Bound on the statistical distance between the server's views of
+	// queries for any two keys
+	Delta float64
+
+	// Bayes advantage of the server in guessing the class of a key drawn from
+	// the prior
+	Advantage float64
+}
+
+// Limits on the leakage a client accepts. The leakage is recomputed from the
+// tiers and the client's own prior rather than trusting the server's figures.
+type LeakagePolicy struct {
+	// Number of queries the client plans to issue for the same key, including
+	// retries
+	Queries int
+
+	// The client's estimate of the popularity of the keys it queries (over
+	// popularity ranks)
+	Prior Popularity
+
+	MaxDelta     float64
+	MaxAdvantage float64
+}
+
+// Whether tier `t` holds the keys of the class of tier `class`
+func (c *TierConfig) holdsClass(t, class int) bool {
+	start := uint64(0)
+	if class > 0 {
+		start = c.Tiers[class-1].Cutoff
+	}
+	return c.Range(t).Contains(start)
+}
+
+// The leakage bound for `queries` queries, which doesn't depend on the prior
+func (c *TierConfig) Delta(queries int) float64 {
+	if queries <= 0 {
+		return 0
+	}
+
+	d := 0.0
+	for a := range c.Tiers {
+		for b := a + 1; b < len(c.Tiers); b++ {
+			separating := 0.0
+			for t, tier := range c.Tiers {
+				if c.holdsClass(t, a) != c.holdsClass(t, b) {
+					separating += tier.Prob
+				}
+			}
+			d = max(d, separating)
+		}
+	}
+	return -math.Expm1(float64(queries) * math.Log1p(-min(d, 1)))
+}
+
+// The leakage of `queries` queries for the same key, drawn from `prior`
+// (over popularity ranks)
+func (c *TierConfig) Leakage(prior Popularity, queries int) *Leakage {
+	// Prior mass of each class, i.e., of the keys whose smallest holding tier
+	// is that tier. Under both layouts these are the ranks between consecutive
+	// cutoffs.
+	classes := make([]float64, len(c.Tiers))
+	prev := uint64(0)
+	for i, tier := range c.Tiers {
+		classes[i] = prior.CDF(tier.Cutoff) - prior.CDF(prev)
+		prev = tier.Cutoff
+	}
+
+	// The server sees the tiers that were chosen, which don't depend on the
+	// key, and whether each of them holds the key. So only the set of tiers
+	// chosen matters: classes held by the same tiers in that set are
+	// indistinguishable, and the server guesses the most likely one.
+	success := 0.0
+	for set := range 1 << len(c.Tiers) {
+		if p := c.chosenExactly(set, queries); p > 0 {
+			success += p * c.bestGuess(set, classes)
+		}
+	}
+
+	guess := 0.0
+	for _, mass := range classes {
+		guess = max(guess, mass)
+	}
+	return &Leakage{
+		Queries:   queries,
+		Delta:     c.Delta(queries),
+		Advantage: max(success-guess, 0),
+	}
+}
+
+// Probability that the tiers chosen by `queries` queries are exactly the tiers
+// in the bitmask `set`, by inclusion-exclusion over its subsets
+func (c *TierConfig) chosenExactly(set, queries int) float64 {
+	prob := 0.0
+	for sub := set; ; sub = (sub - 1) & set {
+		mass := 0.0
+		for t, tier := range c.Tiers {
+			if sub&(1<<t) != 0 {
+				mass += tier.Prob
+			}
+		}
+		term := math.Pow(mass, float64(queries))
+		if popcount(set^sub)%2 == 1 {
+			term = -term
+		}
+		prob += term
+		if sub == 0 {
+			break
+		}
+	}
+	return max(prob, 0)
+}
+
+// Probability that the server guesses the class correctly after seeing which
+// tiers in the bitmask `set` hold the key
+func (c *TierConfig) bestGuess(set int, classes []float64) float64 {
+	best := make(map[int]float64)
+	for class, mass := range classes {
+		pattern := 0
+		for t := range c.Tiers {
+			if set&(1<<t) != 0 && c.holdsClass(t, class) {
+				pattern |= 1 << t
+			}
+		}
+		best[pattern] = max(best[pattern], mass)
+	}
+
+	total := 0.0
+	for _, mass := range best {
+		total += mass
+	}
+	return total
+}
+
+func popcount(x int) int {
+	count := 0
+	for ; x != 0; x &= x - 1 {
+		count++
+	}
+	return count
+}
+
+// Check the leakage of a configuration against the policy. The server must
+// attach its leakage, but the bounds are recomputed from the tiers and the
+// client's prior, and `attached` is only checked for consistency.
+func (p *LeakagePolicy) Check(tiers *TierConfig, attached *Leakage) error {
+	if attached == nil {
+		return fmt.Errorf("no leakage bound attached")
+	}
+	if p.Prior == nil {
+		return fmt.Errorf("no prior to compute the leakage with")
+	}
+	if delta := tiers.Delta(attached.Queries); attached.Delta < delta {
+		return fmt.Errorf("attached leakage of %d queries is %v, but the tiers give %v", attached.Queries, attached.Delta, delta)
+	}
+
+	leakage := tiers.Leakage(p.Prior, p.Queries)
+	if leakage.Delta > p.MaxDelta {
+		return fmt.Errorf("leakage of %d queries is %v, above the limit of %v", p.Queries, leakage.Delta, p.MaxDelta)
+	}
+	if leakage.Advantage > p.MaxAdvantage {
+		return fmt.Errorf("advantage of %v is above the limit of %v", leakage.Advantage, p.MaxAdvantage)
+	}
+	return nil
+}
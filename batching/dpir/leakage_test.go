@@ -0,0 +1,177 @@
+package dpir
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ryanleh/secure-inference/crypto/rand"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+// The server's success in guessing the class of a key, by enumerating every
+// sequence of tiers the queries can pick
+func bruteForceGuess(tiers *TierConfig, prior Popularity, queries int) float64 {
+	classes := make([]float64, len(tiers.Tiers))
+	prev := uint64(0)
+	for i, tier := range tiers.Tiers {
+		classes[i] = prior.CDF(tier.Cutoff) - prior.CDF(prev)
+		prev = tier.Cutoff
+	}
+
+	success := 0.0
+	var visit func(seq []int, prob float64)
+	visit = func(seq []int, prob float64) {
+		if len(seq) == queries {
+			// Group the classes by the outcomes of the queries
+			best := make(map[string]float64)
+			for class, mass := range classes {
+				outcome := make([]byte, len(seq))
+				for i, t := range seq {
+					if tiers.Range(t).Contains(tiers.Range(class).End - 1) {
+						outcome[i] = 1
+					}
+				}
+				best[string(outcome)] = max(best[string(outcome)], mass)
+			}
+			for _, mass := range best {
+				success += prob * mass
+			}
+			return
+		}
+		for t, tier := range tiers.Tiers {
+			visit(append(seq, t), prob*tier.Prob)
+		}
+	}
+	visit(nil, 1)
+	return success
+}
+
+func TestLeakage(t *testing.T) {
+	N := uint64(1 << 16)
+	prior := NewZipf(N, 1.0)
+	tiers := &TierConfig{
+		Tiers:  []Tier{{Cutoff: N / 64, Prob: 0.5, Type: Local}, {Cutoff: N / 8, Prob: 0.3, Type: Local}, {Cutoff: N, Prob: 0.2, Type: Local}},
+		Layout: Nested,
+	}
+
+	// The least and most popular keys are only both retrieved by the full
+	// tier, and delta composes over queries
+	for queries := range 6 {
+		if delta, expected := tiers.Delta(queries), 1-math.Pow(0.2, float64(queries)); math.Abs(delta-expected) > 1e-12 {
+			t.Fatalf("Delta of %v queries: %v vs. %v", queries, delta, expected)
+		}
+	}
+
+	guess := max(prior.CDF(N/64), prior.CDF(N/8)-prior.CDF(N/64), 1-prior.CDF(N/8))
+	prev := 0.0
+	for queries := range 5 {
+		leakage := tiers.Leakage(prior, queries)
+		expected := bruteForceGuess(tiers, prior, queries) - guess
+		if math.Abs(leakage.Advantage-expected) > 1e-9 {
+			t.Fatalf("Advantage of %v queries: %v vs. %v", queries, leakage.Advantage, expected)
+		}
+
+		// The advantage grows with the number of queries, and is bounded by
+		// delta
+		if leakage.Advantage < prev-1e-12 || leakage.Advantage > leakage.Delta {
+			t.Fatalf("Advantage of %v queries: %v (previously %v, delta %v)", queries, leakage.Advantage, prev, leakage.Delta)
+		}
+		prev = leakage.Advantage
+	}
+	if prev == 0 {
+		t.Fatalf("Expected the outcomes to leak")
+	}
+
+	// Under the disjoint layout each tier only retrieves its own keys
+	tiers.Layout = Disjoint
+	if delta := tiers.Delta(1); math.Abs(delta-0.8) > 1e-12 {
+		t.Fatalf("Disjoint delta: %v vs. %v", delta, 0.8)
+	}
+	if leakage, expected := tiers.Leakage(prior, 3), bruteForceGuess(tiers, prior, 3)-guess; math.Abs(leakage.Advantage-expected) > 1e-9 {
+		t.Fatalf("Disjoint advantage: %v vs. %v", leakage.Advantage, expected)
+	}
+
+	// Always querying the full DB leaks nothing
+	tiers.Layout = Nested
+	tiers.Tiers[0].Prob, tiers.Tiers[1].Prob, tiers.Tiers[2].Prob = 0, 0, 1
+	if leakage := tiers.Leakage(prior, 8); leakage.Delta != 0 || leakage.Advantage > 1e-12 {
+		t.Fatalf("Unexpected leakage of the full tier: %+v", leakage)
+	}
+}
+
+func TestLeakagePolicy(t *testing.T) {
+	rows, cols := uint64(64), uint64(64)
+	N := rows * cols
+	prior := NewZipf(N, 1.0)
+	tiers := TwoTiers(N/16, N, 0.5, Local, Local)
+	server, matrix := randInstance[m.Elem32](tiers, nil, 10, 24, rows, cols, 1<<8)
+	defer server.Free()
+
+	init := func(policy *LeakagePolicy, params *Params[m.Elem32]) (*Client[m.Elem32], error) {
+		client := &Client[m.Elem32]{}
+		client.SetPRG(rand.NewBufPRG(rand.NewPRG(&key)))
+		client.SetLeakagePolicy(policy)
+		return client, client.Init(params)
+	}
+	leakage := tiers.Leakage(prior, 8)
+	accepted := &LeakagePolicy{Queries: 8, Prior: prior, MaxDelta: leakage.Delta, MaxAdvantage: leakage.Advantage}
+
+	// Without an attached bound the configuration is refused, without
+	// initializing the client
+	if client, err := init(accepted, server.Params().(*Params[m.Elem32])); err == nil || client.pirClients != nil {
+		t.Fatalf("Expected configuration without a leakage bound to be rejected")
+	}
+
+	// The server's figures aren't trusted: the client recomputes the leakage
+	// under its own prior
+	server.SetLeakage(NewZipf(N, 0.1), 1)
+	params := server.Params().(*Params[m.Elem32])
+	rejected := []*LeakagePolicy{
+		{Queries: 8, MaxDelta: 1, MaxAdvantage: 1},
+		{Queries: 1, Prior: prior, MaxDelta: tiers.Delta(1) / 2, MaxAdvantage: 1},
+		{Queries: 8, Prior: prior, MaxDelta: 1, MaxAdvantage: leakage.Advantage / 2},
+		{Queries: 16, Prior: prior, MaxDelta: leakage.Delta, MaxAdvantage: 1},
+	}
+	for _, policy := range rejected {
+		if _, err := init(policy, params); err == nil {
+			t.Fatalf("Expected configuration to be rejected by %+v", policy)
+		}
+	}
+
+	// Nor is a server which under-reports the leakage
+	lying := *params
+	lying.Leakage = &Leakage{Queries: 1}
+	if _, err := init(accepted, &lying); err == nil {
+		t.Fatalf("Expected configuration with an under-reported bound to be rejected")
+	}
+
+	client, err := init(accepted, params)
+	if err != nil {
+		t.Fatalf("Unexpected rejection: %v", err)
+	}
+	defer client.Free()
+
+	// The popular tier is picked at the rate of the tier coin, whatever the
+	// queried keys
+	indices := []uint64{0, 1, 2}
+	iters := 2000
+	popular := 0
+	for range iters {
+		secret, query := client.Query(indices)
+		result, err := client.Recover(secret, server.Answer(query))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for idx, value := range result.Values {
+			if value[0] != matrix.Data()[idx] {
+				t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, matrix.Data()[idx])
+			}
+		}
+		if secret.(*Secret[m.Elem32]).Bucket == 0 {
+			popular += 1
+		}
+	}
+	if rate := float64(popular) / float64(iters); math.Abs(rate-0.5) > 0.05 {
+		t.Fatalf("Popular tier rate: %v vs. %v", rate, 0.5)
+	}
+}
@@ -0,0 +1,656 @@
+package dpir
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ryanleh/secure-inference/batching"
+	"github.com/ryanleh/secure-inference/batching/pbc"
+	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/lhe"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+// The planner picks the tiers for a DB from its access distribution. It
+// estimates the cost of each candidate tier (a cutoff, PIR type and packing)
+// and then chooses the selection probabilities which minimize the expected
+// per-query cost subject to the correctness targets.
+//
+// Since the expected cost and recovery are both linear in the probabilities,
+// an optimal plan never needs more than two popular tiers on top of the full
+// DB, so we search over all such combinations.
+
+/*
+* Access distributions
+ */
+
+// A distribution over the indices of a DB ordered by popularity
+type Popularity interface {
+	// Number of entries in the DB
+	Entries() uint64
+
+	// Probability of querying an index below `k`
+	CDF(k uint64) float64
+}
+
+// An empirical distribution given by the access count of each index
+type Histogram struct {
+	prefix []float64
+}
+
+// `counts[i]` is the number of accesses to index `i`
+func NewHistogram(counts []uint64) *Histogram {
+	total := uint64(0)
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		panic("Empty histogram")
+	}
+
+	prefix := make([]float64, len(counts)+1)
+	acc := uint64(0)
+	for i, count := range counts {
+		acc += count
+		prefix[i+1] = float64(acc) / float64(total)
+	}
+	return &Histogram{prefix}
+}
+
+func (h *Histogram) Entries() uint64 {
+	return uint64(len(h.prefix) - 1)
+}
+
+func (h *Histogram) CDF(k uint64) float64 {
+	return h.prefix[min(k, h.Entries())]
+}
+
+// Number of terms of the Zipf normalization that are summed exactly
+const zipfExactTerms = 1 << 16
+
+// A Zipf distribution where index `i` is queried with probability
+// proportional to `(i+1)^-s`
+type Zipf struct {
+	n    uint64
+	s    float64
+	head []float64 // Exact partial sums for the first `zipfExactTerms` ranks
+}
+
+func NewZipf(n uint64, s float64) *Zipf {
+	if n == 0 || s < 0 {
+		panic("Invalid Zipf parameters")
+	}
+	head := make([]float64, min(n, zipfExactTerms)+1)
+	for i := 1; i < len(head); i++ {
+		head[i] = head[i-1] + math.Pow(float64(i), -s)
+	}
+	return &Zipf{n, s, head}
+}
+
+func (z *Zipf) Entries() uint64 {
+	return z.n
+}
+
+func (z *Zipf) CDF(k uint64) float64 {
+	return z.harmonic(min(k, z.n)) / z.harmonic(z.n)
+}
+
+// The generalized harmonic number H(k, s). Beyond the exactly summed terms
+// this uses the midpoint approximation of the remaining sum by an integral,
+// which is very accurate for large `k`.
+func (z *Zipf) harmonic(k uint64) float64 {
+	exact := uint64(len(z.head) - 1)
+	if k <= exact {
+		return z.head[k]
+	}
+	lo, hi := float64(exact)+0.5, float64(k)+0.5
+	if z.s == 1 {
+		return z.head[exact] + math.Log(hi/lo)
+	}
+	return z.head[exact] + (math.Pow(hi, 1-z.s)-math.Pow(lo, 1-z.s))/(1-z.s)
+}
+
+/*
+* Cost model
+ */
+
+// The (estimated) cost of a single query to a tier
+type Cost struct {
+	Upload   float64 // Bytes
+	Download float64 // Bytes
+	Compute  float64 // Server multiply-adds
+	State    float64 // Bytes of client state
+}
+
+func (c Cost) add(other Cost) Cost {
+	return Cost{
+		c.Upload + other.Upload,
+		c.Download + other.Download,
+		c.Compute + other.Compute,
+		c.State + other.State,
+	}
+}
+
+// Weights for combining a cost into a single objective (in arbitrary units)
+type CostModel struct {
+	CommWeight    float64 // Per byte of upload or download
+	ComputeWeight float64 // Per server multiply-add
+	StateWeight   float64 // Per byte of client state
+}
+
+// Weights one byte of communication the same as 64 multiply-adds. Client
+// state (e.g. hints) is downloaded once, so it is weighted as communication
+// amortized over 64 queries.
+var DefaultCostModel = CostModel{
+	CommWeight:    1,
+	ComputeWeight: 1.0 / 64,
+	StateWeight:   1.0 / 64,
+}
+
+// The per-query part of the objective
+func (c *CostModel) perQuery(cost Cost) float64 {
+	return c.CommWeight*(cost.Upload+cost.Download) + c.ComputeWeight*cost.Compute
+}
+
+// The one-off part of the objective
+func (c *CostModel) oneOff(cost Cost) float64 {
+	return c.StateWeight * cost.State
+}
+
+// Estimate the cost of a batch of `load` queries to a tier of `entries`
+// entries, built from a matrix of shape `shape` as in `MakeServer` (see
+// `PlanOptions.DB`). Returns an error if there are no supported LWE parameters
+// for the tier (e.g. when a packing can't satisfy its constraints).
+func EstimateCost[T m.Elem](
+	pirType PirType,
+	packing batching.Packing,
+	entries, bitsPer, load uint64,
+	shape Shape,
+) (Cost, error) {
+	switch pirType {
+	case Local:
+		// The client downloads the whole tier once, converted to `T`
+		info := lhe.NewDBInfo(entries, bitsPer, shape.Cols, 0)
+		return Cost{State: float64(info.L*info.M) * float64(T(0).Bitlen()/8)}, nil
+
+	case Simple, SimpleHybrid:
+		info := lhe.NewDBInfo(entries, bitsPer, shape.Cols, shape.PMod)
+		return lweCost[T](info.L, info.M, info.P, load, pirType == SimpleHybrid)
+
+	case PBC, PBCAngel:
+		// Mirror the bucketing and packing done in `pbc.MakeServer`
+		mode := pirType.pbcMode()
+		numBuckets := mode.NumBuckets(load)
+		bucketEntries := (mode.NumChoices()*entries + numBuckets - 1) / numBuckets
+		numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+		sizes := make([]uint64, numBuckets)
+		for i := range sizes {
+			sizes[i] = bucketEntries * numLimbs
+		}
+		_, cols, pMods, err := batching.PackingDims[T](sizes, bitsPer, shape.Rows, shape.Cols, shape.PMod, packing)
+		if err != nil {
+			return Cost{}, err
+		}
+
+		cost := Cost{}
+		for i := range sizes {
+			info := lhe.NewDBInfo(bucketEntries, bitsPer, cols[i], pMods[i])
+			bucket, err := lweCost[T](info.L, info.M, info.P, mode.NumQueriesPer(), true)
+			if err != nil {
+				return Cost{}, err
+			}
+			cost = cost.add(bucket)
+		}
+		return cost, nil
+
+	default:
+		return Cost{}, fmt.Errorf("invalid PIR type %v", pirType)
+	}
+}
+
+// Cost of `queries` SimplePIR queries to an encoded `rows x cols` DB. The hint
+// is downloaded once and counts towards the client state.
+func lweCost[T m.Elem](rows, cols, pMod, queries uint64, hybrid bool) (Cost, error) {
+	bytes := float64(T(0).Bitlen() / 8)
+	params := crypto.NewParamsFixedP(T(0).Bitlen(), cols, pMod)
+	if params == nil {
+		return Cost{}, fmt.Errorf("no supported LWE parameters for %v columns with plaintext modulus %v", cols, pMod)
+	}
+
+	// Hybrid queries are sent as RLWE ciphertexts of two ring elements each
+	upload := float64(cols) * bytes
+	if hybrid {
+		numCts := (cols + params.N - 1) / params.N
+		upload = float64(2*numCts*params.N) * bytes
+	}
+	return Cost{
+		Upload:   float64(queries) * upload,
+		Download: float64(queries*rows) * bytes,
+		Compute:  float64(queries*rows) * float64(cols),
+		State:    float64(rows*params.N) * bytes,
+	}, nil
+}
+
+// Expected fraction of a full batch of `load` indices retrieved by a tier
+func recoveryRate(pirType PirType, load uint64) float64 {
+	if pirType != PBC || load <= pbc.P {
+		return 1
+	}
+
+	// Each bucket answers at most `P` of the indices hashed to it, where the
+	// number of indices per bucket is Binomial(load, 1/load)
+	q := 1 / float64(load)
+	expected := float64(pbc.P)
+	for k := range pbc.P {
+		expected -= float64(pbc.P-k) * binomialPMF(load, q, k)
+	}
+	return expected
+}
+
+// Pr[Binomial(n, q) = k]
+func binomialPMF(n uint64, q float64, k uint64) float64 {
+	a, _ := math.Lgamma(float64(n + 1))
+	b, _ := math.Lgamma(float64(k + 1))
+	c, _ := math.Lgamma(float64(n - k + 1))
+	return math.Exp(a - b - c + float64(k)*math.Log(q) + float64(n-k)*math.Log1p(-q))
+}
+
+/*
+* Planner
+ */
+
+// Correctness targets for a plan
+type Target struct {
+	// Maximum expected fraction of queried indices that are not retrieved,
+	// for indices drawn from the access distribution
+	AvgError float64
+
+	// Maximum probability that any single index is not retrieved. Must be
+	// below one so that every index can be retrieved.
+	WorstError float64
+}
+
+type PlanOptions struct {
+	BitsPer uint64
+	Load    uint64
+
+	// Candidate PIR types and packings for each tier. Packings only apply to
+	// batch code tiers.
+	Types    []PirType
+	Packings []batching.Packing
+
+	Cost CostModel
+
+	// The shape of the DB matrix passed to `MakeServer`, which the tier
+	// holding the full DB keeps. If nil, the DB is assumed to have
+	// approximately square dimensions.
+	DB *Shape
+
+	// Candidate cutoffs are spaced geometrically with `Steps` cutoffs per
+	// halving of the DB, down to `MinTierSize` entries
+	Steps       uint64
+	MinTierSize uint64
+}
+
+func DefaultPlanOptions(bitsPer, load uint64) *PlanOptions {
+	return &PlanOptions{
+		BitsPer:     bitsPer,
+		Load:        load,
+		Types:       []PirType{Simple, SimpleHybrid, Local, PBC, PBCAngel},
+		Packings:    []batching.Packing{batching.Balanced, batching.Comm, batching.Storage},
+		Cost:        DefaultCostModel,
+		Steps:       4,
+		MinTierSize: 1 << 10,
+	}
+}
+
+// The output of the planner. `Config` can be passed to `MakeServer`.
+type Plan struct {
+	Config *TierConfig
+	Load   uint64
+
+	// Estimated cost of each tier
+	Costs []Cost
+
+	// Expected per-query cost, weighted by the tier probabilities. The state
+	// is the total over all tiers.
+	Expected Cost
+
+	// Expected fraction of queries retrieved, over the access distribution
+	// and in the worst case
+	Recovery      float64
+	WorstRecovery float64
+
+	Objective float64
+}
+
+// A candidate tier
+type candidate struct {
+	tier     Tier
+	cost     Cost
+	rate     float64 // Fraction of the tier's indices that are retrieved
+	coverage float64 // Fraction of queries retrieved when the tier is chosen
+	perQuery float64
+	oneOff   float64
+}
+
+// Plan the tiers for a DB with access distribution `dist`
+func MakePlan[T m.Elem](dist Popularity, target Target, opts *PlanOptions) (*Plan, error) {
+	n := dist.Entries()
+	if target.AvgError < 0 || target.AvgError > 1 {
+		return nil, fmt.Errorf("invalid average-case error %v", target.AvgError)
+	}
+	if target.WorstError < 0 || target.WorstError >= 1 {
+		return nil, fmt.Errorf("invalid worst-case error %v", target.WorstError)
+	}
+	if len(opts.Types) == 0 || opts.Load == 0 || opts.Steps == 0 {
+		return nil, fmt.Errorf("invalid planner options")
+	}
+
+	newCandidate := func(cutoff uint64, pirType PirType, packing batching.Packing) *candidate {
+		var full *Shape
+		if cutoff == n {
+			full = opts.DB
+		}
+		shape, err := tierShape[T](cutoff, opts.BitsPer, full)
+		if err != nil {
+			return nil
+		}
+		cost, err := EstimateCost[T](pirType, packing, cutoff, opts.BitsPer, opts.Load, shape)
+		if err != nil {
+			return nil
+		}
+		rate := recoveryRate(pirType, opts.Load)
+		return &candidate{
+			tier:     Tier{Cutoff: cutoff, Type: pirType, Packing: packing},
+			cost:     cost,
+			rate:     rate,
+			coverage: rate * dist.CDF(cutoff),
+			perQuery: opts.Cost.perQuery(cost),
+			oneOff:   opts.Cost.oneOff(cost),
+		}
+	}
+	variants := func(cutoff uint64) []*candidate {
+		candidates := []*candidate{}
+		for _, pirType := range opts.Types {
+			if pirType == PBC || pirType == PBCAngel {
+				for _, packing := range opts.Packings {
+					candidates = append(candidates, newCandidate(cutoff, pirType, packing))
+				}
+			} else {
+				candidates = append(candidates, newCandidate(cutoff, pirType, batching.Balanced))
+			}
+		}
+		return slices.DeleteFunc(candidates, func(c *candidate) bool { return c == nil })
+	}
+
+	// Every variant is a candidate for the full DB, while for the popular
+	// tiers we only keep the variant that is cheapest per retrieved index
+	full := variants(n)
+	popular := []*candidate{}
+	for j := uint64(1); ; j++ {
+		cutoff := uint64(float64(n) * math.Pow(2, -float64(j)/float64(opts.Steps)))
+		if cutoff < max(opts.MinTierSize, 1) {
+			break
+		}
+		if len(popular) > 0 && popular[len(popular)-1].tier.Cutoff == cutoff {
+			continue
+		}
+		var best *candidate
+		for _, c := range variants(cutoff) {
+			if best == nil || c.perQuery/c.rate+c.oneOff < best.perQuery/best.rate+best.oneOff {
+				best = c
+			}
+		}
+		if best != nil {
+			popular = append(popular, best)
+		}
+	}
+
+	recovery := 1 - target.AvgError
+	worst := 1 - target.WorstError
+	var bestTiers []*candidate
+	var bestProbs []float64
+	bestObjective := math.Inf(1)
+	for _, f := range full {
+		if f.rate < worst {
+			continue
+		}
+		// Just the full DB
+		if f.rate >= recovery && f.perQuery+f.oneOff < bestObjective {
+			bestTiers, bestProbs, bestObjective = []*candidate{f}, []float64{1}, f.perQuery+f.oneOff
+		}
+		for i, a := range popular {
+			for j := i; j < len(popular); j++ {
+				b := popular[j]
+				tiers := []*candidate{b, a, f}
+				if i == j {
+					tiers = []*candidate{a, f}
+				}
+				probs, ok := solvePlan(tiers, recovery, worst/f.rate)
+				if !ok {
+					continue
+				}
+				objective := 0.0
+				for k, c := range tiers {
+					if probs[k] > 0 {
+						objective += probs[k]*c.perQuery + c.oneOff
+					}
+				}
+				if objective < bestObjective {
+					bestTiers, bestProbs, bestObjective = tiers, probs, objective
+				}
+			}
+		}
+	}
+	if bestTiers == nil {
+		return nil, fmt.Errorf("no candidate tiers satisfy the target")
+	}
+
+	// Drop unused tiers and order by cutoff
+	plan := &Plan{Config: &TierConfig{Layout: Nested}, Load: opts.Load, Objective: bestObjective}
+	chosen := []*candidate{}
+	for k, c := range bestTiers {
+		if probs := bestProbs[k]; probs > 0 {
+			c.tier.Prob = probs
+			chosen = append(chosen, c)
+		}
+	}
+	sort.Slice(chosen, func(i, j int) bool { return chosen[i].tier.Cutoff < chosen[j].tier.Cutoff })
+
+	// Make sure the probabilities sum to one exactly, assigning any rounding
+	// error to the full DB
+	total := 0.0
+	for _, c := range chosen[:len(chosen)-1] {
+		total += c.tier.Prob
+	}
+	chosen[len(chosen)-1].tier.Prob = 1 - total
+
+	for _, c := range chosen {
+		plan.Config.Tiers = append(plan.Config.Tiers, c.tier)
+		plan.Costs = append(plan.Costs, c.cost)
+		plan.Expected.Upload += c.tier.Prob * c.cost.Upload
+		plan.Expected.Download += c.tier.Prob * c.cost.Download
+		plan.Expected.Compute += c.tier.Prob * c.cost.Compute
+		plan.Expected.State += c.cost.State
+		plan.Recovery += c.tier.Prob * c.coverage
+	}
+	last := chosen[len(chosen)-1]
+	plan.WorstRecovery = last.tier.Prob * last.rate
+	return plan, nil
+}
+
+// Tolerance for the LP feasibility checks
+const planEpsilon = 1e-12
+
+// Find the probabilities for `tiers` (ordered with the full DB last) that
+// minimize the expected per-query cost, subject to:
+//
+//	sum(p) = 1,  sum(p * coverage) >= recovery,  p_full >= minFull,  p >= 0
+//
+// Each optimum lies on a vertex of the feasible region, where the equality
+// and `len(tiers) - 1` of the inequalities are tight, so we simply check all
+// of them.
+func solvePlan(tiers []*candidate, recovery, minFull float64) ([]float64, bool) {
+	k := len(tiers)
+
+	// Inequalities as (coefficients, bound) with coefficients * p >= bound
+	type constraint struct {
+		coeffs []float64
+		bound  float64
+	}
+	constraints := []constraint{}
+	coverage := make([]float64, k)
+	for i, c := range tiers {
+		coverage[i] = c.coverage
+	}
+	constraints = append(constraints, constraint{coverage, recovery})
+	for i := range k {
+		coeffs := make([]float64, k)
+		coeffs[i] = 1
+		bound := 0.0
+		if i == k-1 {
+			bound = minFull
+		}
+		constraints = append(constraints, constraint{coeffs, bound})
+	}
+	ones := make([]float64, k)
+	for i := range ones {
+		ones[i] = 1
+	}
+
+	var best []float64
+	bestCost := math.Inf(1)
+	for _, tight := range subsets(len(constraints), k-1) {
+		system := [][]float64{append(append([]float64{}, ones...), 1)}
+		for _, i := range tight {
+			system = append(system, append(append([]float64{}, constraints[i].coeffs...), constraints[i].bound))
+		}
+		probs, ok := solveLinear(system)
+		if !ok {
+			continue
+		}
+
+		feasible := true
+		for _, c := range constraints {
+			dot := 0.0
+			for i := range probs {
+				dot += c.coeffs[i] * probs[i]
+			}
+			if dot < c.bound-planEpsilon {
+				feasible = false
+				break
+			}
+		}
+		if !feasible {
+			continue
+		}
+
+		cost := 0.0
+		for i, c := range tiers {
+			probs[i] = max(probs[i], 0)
+			cost += probs[i] * c.perQuery
+		}
+		if cost < bestCost {
+			best, bestCost = probs, cost
+		}
+	}
+	return best, best != nil
+}
+
+// All subsets of size `k` of [0, n)
+func subsets(n, k int) [][]int {
+	if k == 0 {
+		return [][]int{{}}
+	}
+	result := [][]int{}
+	for i := n - 1; i >= k-1; i-- {
+		for _, rest := range subsets(i, k-1) {
+			result = append(result, append(rest, i))
+		}
+	}
+	return result
+}
+
+// Solve a square linear system given as an augmented matrix using Gaussian
+// elimination with partial pivoting
+func solveLinear(system [][]float64) ([]float64, bool) {
+	k := len(system)
+	for col := range k {
+		pivot := col
+		for row := col + 1; row < k; row++ {
+			if math.Abs(system[row][col]) > math.Abs(system[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(system[pivot][col]) < planEpsilon {
+			return nil, false
+		}
+		system[col], system[pivot] = system[pivot], system[col]
+		for row := range k {
+			if row == col {
+				continue
+			}
+			factor := system[row][col] / system[col][col]
+			for i := col; i <= k; i++ {
+				system[row][i] -= factor * system[col][i]
+			}
+		}
+	}
+
+	result := make([]float64, k)
+	for i := range k {
+		result[i] = system[i][k] / system[i][i]
+	}
+	return result, true
+}
+
+func (p *Plan) String() string {
+	var b strings.Builder
+	mb := func(bytes float64) float64 { return bytes / math.Pow(1024.0, 2) }
+
+	n := p.Config.Tiers[len(p.Config.Tiers)-1].Cutoff
+	fmt.Fprintf(&b, "dPIR plan for %d entries (load %d):\n", n, p.Load)
+	for i, tier := range p.Config.Tiers {
+		r := p.Config.Range(i)
+		cost := p.Costs[i]
+		scheme := tier.Type.String()
+		if tier.Type == PBC || tier.Type == PBCAngel {
+			scheme += fmt.Sprintf(" (%v packing)", packingName(tier.Packing))
+		}
+		fmt.Fprintf(
+			&b,
+			"  Tier %d: [%d, %d) w.p. %0.4f using %v: "+
+				"Upload: %0.2fMB, Download: %0.2fMB, Compute: %0.3g ops, State: %0.2fMB\n",
+			i, r.Start, r.End, tier.Prob, scheme,
+			mb(cost.Upload), mb(cost.Download), cost.Compute, mb(cost.State),
+		)
+	}
+	fmt.Fprintf(
+		&b,
+		"  Expected: Upload: %0.2fMB, Download: %0.2fMB, Compute: %0.3g ops, Client State: %0.2fMB\n",
+		mb(p.Expected.Upload), mb(p.Expected.Download), p.Expected.Compute, mb(p.Expected.State),
+	)
+	fmt.Fprintf(
+		&b,
+		"  Recovery: %0.2f%% (average-case), %0.2f%% (worst-case)\n",
+		100.0*p.Recovery, 100.0*p.WorstRecovery,
+	)
+	return b.String()
+}
+
+func packingName(packing batching.Packing) string {
+	switch packing {
+	case batching.Balanced:
+		return "Balanced"
+	case batching.Comm:
+		return "Comm"
+	case batching.Storage:
+		return "Storage"
+	default:
+		return fmt.Sprintf("Packing(%d)", int(packing))
+	}
+}
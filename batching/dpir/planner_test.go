@@ -0,0 +1,187 @@
+package dpir
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ryanleh/secure-inference/batching"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+func TestZipf(t *testing.T) {
+	n := uint64(300000)
+	for _, s := range []float64{0.5, 1.0, 1.2} {
+		zipf := NewZipf(n, s)
+
+		// Compare against the exact CDF
+		total := 0.0
+		for i := range n {
+			total += math.Pow(float64(i+1), -s)
+		}
+		partial := 0.0
+		for i := range n {
+			if i%10007 == 0 {
+				if cdf := zipf.CDF(i); math.Abs(cdf-partial/total) > 1e-6 {
+					t.Fatalf("Zipf CDF @ %v: %v vs. %v", i, cdf, partial/total)
+				}
+			}
+			partial += math.Pow(float64(i+1), -s)
+		}
+		if zipf.CDF(n) != 1 || zipf.CDF(2*n) != 1 {
+			t.Fatalf("Zipf CDF should be one at the end of the DB")
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	hist := NewHistogram([]uint64{5, 3, 0, 2})
+	expected := []float64{0, 0.5, 0.8, 0.8, 1, 1}
+	for k, cdf := range expected {
+		if math.Abs(hist.CDF(uint64(k))-cdf) > 1e-9 {
+			t.Fatalf("Histogram CDF @ %v: %v vs. %v", k, hist.CDF(uint64(k)), cdf)
+		}
+	}
+}
+
+func testPlan[T m.Elem](t *testing.T, dist Popularity, target Target, opts *PlanOptions) *Plan {
+	plan, err := MakePlan[T](dist, target, opts)
+	if err != nil {
+		t.Fatalf("Planning failed: %v", err)
+	}
+	n := dist.Entries()
+	if err := plan.Config.Validate(n); err != nil {
+		t.Fatalf("Invalid plan: %v\n%v", err, plan)
+	}
+
+	if plan.Recovery < 1-target.AvgError-1e-9 {
+		t.Fatalf("Average-case target not met: %v vs. %v\n%v", plan.Recovery, 1-target.AvgError, plan)
+	}
+	if plan.WorstRecovery < 1-target.WorstError-1e-9 {
+		t.Fatalf("Worst-case target not met: %v vs. %v\n%v", plan.WorstRecovery, 1-target.WorstError, plan)
+	}
+
+	// The plan should never be worse than querying the full DB directly
+	for _, pirType := range opts.Types {
+		if recoveryRate(pirType, opts.Load) < 1-target.AvgError {
+			continue
+		}
+		shape, err := tierShape[T](n, opts.BitsPer, opts.DB)
+		if err != nil {
+			continue
+		}
+		cost, err := EstimateCost[T](pirType, batching.Balanced, n, opts.BitsPer, opts.Load, shape)
+		if err != nil {
+			continue
+		}
+		objective := opts.Cost.perQuery(cost) + opts.Cost.oneOff(cost)
+		if plan.Objective > objective*(1+1e-9) {
+			t.Fatalf("Plan is worse than a single %v tier: %v vs. %v\n%v", pirType, plan.Objective, objective, plan)
+		}
+	}
+	return plan
+}
+
+func testPlanner[T m.Elem](t *testing.T) {
+	n := uint64(1 << 24)
+	opts := DefaultPlanOptions(64, 32)
+	dist := NewZipf(n, 1.0)
+
+	// Without any error budget we must always query the full DB
+	plan := testPlan[T](t, dist, Target{AvgError: 0, WorstError: 0}, opts)
+	if len(plan.Config.Tiers) != 1 {
+		t.Fatalf("Expected a single tier:\n%v", plan)
+	}
+
+	// A skewed distribution with a loose target should use popular tiers
+	plan = testPlan[T](t, dist, Target{AvgError: 0.2, WorstError: 0.99}, opts)
+	if len(plan.Config.Tiers) < 2 {
+		t.Fatalf("Expected multiple tiers:\n%v", plan)
+	}
+
+	// Tightening the worst-case target can only make the plan more expensive
+	tight := testPlan[T](t, dist, Target{AvgError: 0.2, WorstError: 0.5}, opts)
+	if tight.Objective < plan.Objective {
+		t.Fatalf("Tighter target gave a cheaper plan: %v vs. %v", tight.Objective, plan.Objective)
+	}
+
+	// Restrict the candidate types
+	opts.Types = []PirType{SimpleHybrid, PBCAngel}
+	plan = testPlan[T](t, dist, Target{AvgError: 0.1, WorstError: 0.9}, opts)
+	for _, tier := range plan.Config.Tiers {
+		if tier.Type != SimpleHybrid && tier.Type != PBCAngel {
+			t.Fatalf("Unexpected tier type %v", tier.Type)
+		}
+	}
+
+	// Plans from an empirical histogram
+	counts := make([]uint64, 1<<20)
+	for i := range counts {
+		counts[i] = uint64(1e6 / float64(i+1))
+	}
+	testPlan[T](t, NewHistogram(counts), Target{AvgError: 0.05, WorstError: 0.9}, opts)
+}
+
+func TestPlanner32(t *testing.T) {
+	testPlanner[m.Elem32](t)
+}
+
+func TestPlanner64(t *testing.T) {
+	testPlanner[m.Elem64](t)
+}
+
+// The estimated client state matches the state of the tiers `MakeServer`
+// actually builds, including a full tier which keeps non-square dimensions
+func testCostModel[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
+	rows, cols := uint64(64), uint64(2048)
+	n := rows * cols
+	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+	full := &Shape{rows * numLimbs, cols, pMod}
+	for _, popular := range []PirType{Local, Simple} {
+		tiers := TwoTiers(n/64, n, 0.1, popular, Simple)
+		server, _ := randInstance[T](tiers, nil, 8, bitsPer, rows, cols, pMod)
+		client := &Client[T]{}
+		client.Init(server.Params())
+
+		expected := 0.0
+		for i, tier := range tiers.Tiers {
+			var shapeFull *Shape
+			if tier.Cutoff == n {
+				shapeFull = full
+			}
+			shape, err := tierShape[T](tier.Cutoff, bitsPer, shapeFull)
+			if err != nil {
+				t.Fatalf("Tier %v: %v", i, err)
+			}
+			cost, err := EstimateCost[T](tier.Type, tier.Packing, tier.Cutoff, bitsPer, 8, shape)
+			if err != nil {
+				t.Fatalf("Tier %v: %v", i, err)
+			}
+			expected += cost.State
+		}
+		if float64(client.StateSize()) != expected {
+			t.Fatalf("Estimated state %v vs. %v with a %v tier", expected, client.StateSize(), popular)
+		}
+		client.Free()
+		server.Free()
+	}
+}
+
+func TestCostModel32(t *testing.T) {
+	testCostModel[m.Elem32](t, 24, 1<<8)
+}
+
+func TestCostModel64(t *testing.T) {
+	testCostModel[m.Elem64](t, 24, 1<<16)
+}
+
+func TestRecoveryRate(t *testing.T) {
+	// Each bucket retrieves at most two indices, so recovery should be
+	// E[min(X, 2)] for X ~ Poisson(1) in the limit
+	limit := 2 - 2*math.Exp(-1) - math.Exp(-1)
+	if rate := recoveryRate(PBC, 1<<16); math.Abs(rate-limit) > 1e-4 {
+		t.Fatalf("Recovery rate: %v vs. %v", rate, limit)
+	}
+	if recoveryRate(PBCAngel, 32) != 1 || recoveryRate(SimpleHybrid, 32) != 1 {
+		t.Fatalf("Expected full recovery")
+	}
+}
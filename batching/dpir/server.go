@@ -1,6 +1,7 @@
 package dpir
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/ryanleh/secure-inference/batching"
@@ -12,163 +13,255 @@ import (
 )
 
 type Server[T m.Elem] struct {
-	cutoff     uint64
-    alpha      float64
+	tiers      *TierConfig
 	load       uint64
-	types      []PirType
-	pirServers []interface{}
+	ranks      map[uint64]uint64
+	pirServers []batching.Server[T]
+	shared     map[int]int
+	leakage    *Leakage
 }
 
+// Create a server for a DB that is already ordered by popularity
+//
 // TODO: Depending on params type, may need to refactor things here
 func MakeServer[T m.Elem](
 	matrix *m.Matrix[m.Elem32],
-	cutoff uint64,
-    alpha float64,
-    load uint64,
+	tiers *TierConfig,
+	load uint64,
+	bitsPer uint64,
+	pMod uint64,
+	seed *rand.PRGKey,
+	bench bool, // TODO: Remove
+) *Server[T] {
+	return MakeRankedServer[T](matrix, nil, tiers, load, bitsPer, pMod, seed, bench)
+}
+
+// Create a server for a DB in logical key order, where `ranking[r]` is the
+// key with popularity rank `r`. Tiers are cut from the DB in rank order,
+// except for tiers which hold the full DB and stay in key order. A nil
+// `ranking` means the DB is already ordered by popularity.
+func MakeRankedServer[T m.Elem](
+	matrix *m.Matrix[m.Elem32],
+	ranking []uint64,
+	tiers *TierConfig,
+	load uint64,
 	bitsPer uint64,
 	pMod uint64,
-	types []PirType,
-	packing batching.Packing,
 	seed *rand.PRGKey,
 	bench bool, // TODO: Remove
 ) *Server[T] {
 	// PRG for creating seeds
 	prg := rand.NewBufPRG(rand.NewPRG(seed))
 
-    // Copy into two buckets
 	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
-	buckets := make([][]m.Elem32, 2)
-    buckets[0] = matrix.Data()[:cutoff*numLimbs] // Popular
-    buckets[1] = matrix.Data()                   // Full
-
-    // Approximate square dimensions for 
-    pop_rows, pop_cols, pop_p := batching.ApproxSquareDims[T](cutoff, bitsPer)
-    rows := []uint64{pop_rows, matrix.Rows()}
-    cols := []uint64{pop_cols, matrix.Cols()}
-    pMods := []uint64{pop_p, pMod}
-	
-    // Initialize a PIR Server for each bucket
-	pirServers := make([]interface{}, len(buckets))
-	for i := range buckets {
-		ctx := crypto.NewContext[T](T(0).Bitlen(), cols[i], pMods[i])
-		elemWidth := uint64(math.Ceil(float64(bitsPer) / math.Log2(float64(pMods[i]))))
-		matrix := m.NewFromRaw(buckets[i], (rows[i]*numLimbs)/elemWidth, cols[i])
-		switch types[i] {
-		case Local:
-			server := lhe.MakeLocalServer[T](matrix, bitsPer)
-			server.SetBatch(load)
-			pirServers[i] = server
-
-		case Simple:
-			server := lhe.MakeSimpleServer[T](
-				matrix,
-				bitsPer,
-				ctx,
-				prg.GenPRGKey(),
-				lhe.None,
-                false,
-				bench,
-			)
-			server.SetBatch(load)
-			pirServers[i] = server
+	numEntries := uint64(len(matrix.Data())) / numLimbs
+	if err := tiers.Validate(numEntries); err != nil {
+		panic("Invalid tiers: " + err.Error())
+	}
 
-		case SimpleHybrid:
-			server := lhe.MakeSimpleServer[T](
-				matrix,
-				bitsPer,
-				ctx,
-				prg.GenPRGKey(),
-				lhe.Hybrid,
-                false,
-				bench,
-			)
-			server.SetBatch(load)
-			pirServers[i] = server
+	// Clients only need the ranks of keys which are stored in rank order
+	var ranks map[uint64]uint64
+	if ranking != nil {
+		if !isPermutation(ranking, numEntries) {
+			panic("Invalid ranking")
+		}
+		ranked := uint64(0)
+		for i := range tiers.Tiers {
+			if !tiers.holdsAll(i) {
+				ranked = max(ranked, tiers.Range(i).End)
+			}
+		}
+		ranks = make(map[uint64]uint64, ranked)
+		for rank, key := range ranking[:ranked] {
+			ranks[key] = uint64(rank)
+		}
+	}
+
+	// Tiers in rank order can't share the hint of a tier in key order
+	var shared map[int]int
+	if ranking == nil {
+		shared = tiers.sharedHints()
+	}
+
+	// Initialize a PIR Server for each tier
+	pirServers := make([]batching.Server[T], len(tiers.Tiers))
+	lheServers := make(map[int]lhe.Server[T])
+	for i := range tiers.Tiers {
+		if _, ok := shared[i]; ok {
+			continue
+		}
+
+		r := tiers.Range(i)
+		var full *Shape
+		if r.Size() == numEntries {
+			full = &Shape{matrix.Rows(), matrix.Cols(), pMod}
+		}
+		shape, err := tierShape[T](r.Size(), bitsPer, full)
+		if err != nil {
+			panic("Invalid LWE Parameters: " + err.Error())
+		}
+		data := matrix.Data()[r.Start*numLimbs : r.End*numLimbs]
+		if ranking != nil && !tiers.holdsAll(i) {
+			data = make([]m.Elem32, r.Size()*numLimbs)
+			for j, key := range ranking[r.Start:r.End] {
+				copy(data[uint64(j)*numLimbs:], matrix.Data()[key*numLimbs:(key+1)*numLimbs])
+			}
+		}
 
-		case PBC:
-			server := pbc.MakeServer[T](
+		matrix := m.NewFromRaw(data, shape.Rows, shape.Cols)
+		switch tiers.Tiers[i].Type {
+		case Local, Simple, SimpleHybrid:
+			server := lhe.MakeServer[T](
+				tiers.Tiers[i].Type.lheType(),
 				matrix,
-				load,
-				ctx.Params.P,
 				bitsPer,
+				shape.PMod,
+				tiers.Tiers[i].DBLayout,
 				prg.GenPRGKey(),
-				packing,
-				pbc.Hash,
 				bench,
 			)
-			pirServers[i] = server
+			lheServers[i] = server
+			pirServers[i] = batching.NewDirectServer[T](server, load)
 
-		case PBCAngel:
-			server := pbc.MakeServer[T](
+		case PBC, PBCAngel:
+			pirServers[i] = pbc.MakeServer[T](
 				matrix,
 				load,
-				ctx.Params.P,
+				shape.PMod,
 				bitsPer,
 				prg.GenPRGKey(),
-				packing,
-				pbc.Cuckoo,
+				tiers.Tiers[i].Packing,
+				tiers.Tiers[i].Type.pbcMode(),
+				pbc.UniformScheme(lhe.SimpleHybrid),
 				bench,
 			)
-			pirServers[i] = server
 
 		default:
 			panic("Invalid LHE type")
 		}
 	}
 
-	return &Server[T]{cutoff, alpha, load, types, pirServers}
+	// Tiers sharing a hint are a prefix of the full DB with the same layout
+	for i, j := range shared {
+		server := lheServers[j].(*lhe.SimpleServer[T]).Prefix(tiers.Range(i).End)
+		pirServers[i] = batching.NewDirectServer[T](server, load)
+	}
+
+	return &Server[T]{tiers: tiers, load: load, ranks: ranks, pirServers: pirServers, shared: shared}
 }
 
-func (s *Server[T]) Params() Params[T] {
-	hints := make([]interface{}, len(s.pirServers))
-	for i, pirType := range s.types {
-		if pirType == PBC || pirType == PBCAngel {
-			server := s.pirServers[i].(*pbc.Server[T])
-			hints[i] = server.Params()
-		} else {
-			server := s.pirServers[i].(lhe.Server[T])
-			hints[i] = server.Hint()
-		}
+func (s *Server[T]) Params() batching.Params[T] {
+	hints := make([]batching.Params[T], len(s.pirServers))
+	for i, server := range s.pirServers {
+		hints[i] = server.Params()
+	}
+	for i := range s.shared {
+		params := hints[i].(*batching.DirectParams[T])
+		hints[i] = &batching.DirectParams[T]{Load: params.Load, Hint: lhe.DropHint[T](params.Hint)}
 	}
 
-	return Params[T]{
-		Cutoff: s.cutoff,
-        Alpha:  s.alpha,
-		Load:   s.load,
-		Types:   s.types,
-		Hints:   hints,
+	return &Params[T]{
+		TierConfig: *s.tiers,
+		Load:       s.load,
+		Hints:      hints,
+		Ranks:      s.ranks,
+		Shared:     s.shared,
+		Leakage:    s.leakage,
 	}
 }
 
-func (s *Server[T]) Answer(query *Query[T]) *Answer[T] {
-	var answer *Answer[T]
-    bucket := query.Bucket
-    pirType := s.types[bucket]
-    if pirType == PBC || pirType == PBCAngel {
-        server := s.pirServers[bucket].(*pbc.Server[T])
-        answer = &Answer[T]{
-            BatchAnswer: server.Answer(query.BatchQuery),
-        }
-    } else {
-        server := s.pirServers[bucket].(lhe.Server[T])
-        answer = &Answer[T]{
-            Answer: server.Answer(query.Query),
-        }
-    }
-	return answer
+// Publish the leakage of `queries` queries under the popularity estimate
+// `prior` with the params, so that clients can check it against their policy
+func (s *Server[T]) SetLeakage(prior Popularity, queries int) {
+	s.leakage = s.tiers.Leakage(prior, queries)
+}
+
+func (s *Server[T]) Answer(q batching.Query[T]) batching.Answer[T] {
+	query := q.(*Query[T])
+	return &Answer[T]{s.pirServers[query.Bucket].Answer(query.Query)}
+}
+
+// Answer the queries of several clients at once. Queries are grouped by tier
+// and each tier answers its group in a single batch, so popular tiers (which
+// most clients hit) see the largest batches.
+func (s *Server[T]) AnswerBatch(qs []batching.Query[T]) []batching.Answer[T] {
+	groups := make([][]batching.Query[T], len(s.pirServers))
+	clients := make([][]int, len(s.pirServers))
+	for i, q := range qs {
+		query := q.(*Query[T])
+		groups[query.Bucket] = append(groups[query.Bucket], query.Query)
+		clients[query.Bucket] = append(clients[query.Bucket], i)
+	}
+
+	answers := make([]batching.Answer[T], len(qs))
+	for tier, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		for j, answer := range s.pirServers[tier].AnswerBatch(group) {
+			answers[clients[tier][j]] = &Answer[T]{answer}
+		}
+	}
+	return answers
 }
 
 func (s *Server[T]) StateSize() uint64 {
-	panic("Unimplemented")
+	// Tiers sharing a hint don't hold any state of their own
+	size := uint64(0)
+	for i, server := range s.pirServers {
+		if _, ok := s.shared[i]; !ok {
+			size += server.StateSize()
+		}
+	}
+	return size
 }
 
 func (s *Server[T]) Free() {
-	for i, pirType := range s.types {
-		if pirType == PBC || pirType == PBCAngel {
-			s.pirServers[i].(*pbc.Server[T]).Free()
-		} else {
-			s.pirServers[i].(lhe.Server[T]).Free()
-		}
+	for _, server := range s.pirServers {
+		server.Free()
 	}
 	s.pirServers = nil
 }
+
+// The shape of a matrix of raw limbs, and the plaintext modulus to encode it
+// with
+type Shape struct {
+	Rows, Cols, PMod uint64
+}
+
+// The shape of the matrix that `MakeServer` builds a tier of `entries` entries
+// from. If `full` is non-nil the tier holds the full DB, and keeps the shape
+// `full` of the DB matrix. Otherwise, we use approximately square dimensions.
+func tierShape[T m.Elem](entries, bitsPer uint64, full *Shape) (Shape, error) {
+	var rows, cols, pMod uint64
+	if full != nil {
+		rows, cols, pMod = full.Rows, full.Cols, full.PMod
+	} else {
+		var err error
+		if rows, cols, pMod, err = batching.SquareDims[T](entries, bitsPer); err != nil {
+			return Shape{}, err
+		}
+	}
+	if !crypto.CheckParams(T(0).Bitlen(), cols, pMod) {
+		return Shape{}, fmt.Errorf("no supported LWE parameters for %v columns with plaintext modulus %v", cols, pMod)
+	}
+
+	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+	elemWidth := uint64(math.Ceil(float64(bitsPer) / math.Log2(float64(pMod))))
+	return Shape{(rows * numLimbs) / elemWidth, cols, pMod}, nil
+}
+
+// Whether `ranking` is a permutation of [0, n)
+func isPermutation(ranking []uint64, n uint64) bool {
+	if uint64(len(ranking)) != n {
+		return false
+	}
+	seen := make([]bool, n)
+	for _, key := range ranking {
+		if key >= n || seen[key] {
+			return false
+		}
+		seen[key] = true
+	}
+	return true
+}
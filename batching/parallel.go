@@ -0,0 +1,56 @@
+package batching
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/ryanleh/secure-inference/matrix/gpu"
+)
+
+// Default number of workers to use when processing independent buckets
+// concurrently.
+//
+// Answering a bucket is a memory-bound matrix-vector product, so there is no
+// benefit to running more workers than there are cores. When a GPU is in use
+// all buckets share a single device, so we fall back to sequential processing.
+func DefaultWorkers() int {
+	if gpu.UseGPU() {
+		return 1
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// Call `f` on every index in [0, n) using a pool of at most `workers`
+// goroutines. Returns once all calls have completed.
+func ParallelFor(n, workers int, f func(i int)) {
+	if workers <= 0 {
+		workers = DefaultWorkers()
+	}
+	workers = min(workers, n)
+
+	// Run inline if there is nothing to parallelize
+	if workers <= 1 {
+		for i := range n {
+			f(i)
+		}
+		return
+	}
+
+	jobs := make(chan int, n)
+	for i := range n {
+		jobs <- i
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for range workers {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
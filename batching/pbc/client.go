@@ -1,6 +1,7 @@
 package pbc
 
 import (
+	"github.com/ryanleh/secure-inference/batching"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -10,24 +11,26 @@ type Client[T m.Elem] struct {
 	lheClients []lhe.Client[T]
 	batchSize  uint64
 	numBuckets int64
-	mapping    map[uint64]KeyChoices
+	mapping    *Mapping
+	hash       *BucketHash
 	mode       Mode
 	prg        *rand.BufPRGReader
 }
 
-func (c *Client[T]) Init(params *Params[T]) {
+func (c *Client[T]) Init(p batching.Params[T]) error {
 	// Copy relevant fields
+	params := p.(*Params[T])
 	c.mapping = params.Mapping
 	c.batchSize = params.BatchSize
 	c.numBuckets = params.NumBuckets
 	c.mode = params.Mode
+	c.hash = NewBucketHash(params.HashKey, uint64(params.NumBuckets))
 
-	// Initialize each LHE scheme
-	//
-	// TODO: Make this general if we need
+	// Initialize each LHE scheme. The hint for each bucket determines which
+	// type of LHE client to use.
 	c.lheClients = make([]lhe.Client[T], c.numBuckets)
 	for i := range c.lheClients {
-		c.lheClients[i] = &lhe.SimpleClient[T]{}
+		c.lheClients[i] = lhe.NewClient[T](params.LHEHints[i])
 		c.lheClients[i].Init(params.LHEHints[i])
 	}
 
@@ -35,36 +38,51 @@ func (c *Client[T]) Init(params *Params[T]) {
 	//
 	// TODO: Might want to make this seeded for testing
 	c.prg = rand.NewRandomBufPRG()
+	return nil
 }
 
-// TODO: Need to free stuff
-func (c *Client[T]) Query(indices []uint64) ([]*Secret[T], []*Query[T]) {
-	// First, generate a schedule for the given batch
+// Secrets are released by `Recover`, and otherwise by a finalizer once they
+// are unreachable (see `lhe.SimpleSecret`)
+func (c *Client[T]) Query(indices []uint64) (batching.Secret[T], batching.Query[T]) {
+	// Find the position of each key in its buckets
+	positions := c.positions(indices)
+	column := func(key uint64, bucket uint32) uint64 {
+		return c.lheClients[bucket].DBInfo().Column(uint64(positions[key][bucket]))
+	}
+
+	// Generate a schedule for the given batch
 	//
 	// The schedule maps bucket -> key
-	schedule := GenSchedule(indices, c.mode, c.numBuckets, c.prg)
-	if schedule == nil {
-		panic("Cuckoo Insertion Error")
-	}
+	schedule := GenSchedule(indices, c.mode, c.hash, c.prg, column)
 
 	// Build query for each bucket
 	queriesPer := c.mode.NumQueriesPer()
-	secrets := make([]*Secret[T], c.numBuckets)
-	queries := make([]*Query[T], c.numBuckets)
+	secrets := make([]*BucketSecret[T], c.numBuckets)
+	queries := make([]*BucketQuery[T], c.numBuckets)
 	for i := range uint32(c.numBuckets) {
 		if keys, ok := schedule[i]; ok {
-			inputs := make([]*m.Matrix[T], len(keys))
+			// Keys in the same column share a query
+			cols := c.lheClients[i].DBInfo().M
+			slots := make([]int, len(keys))
+			columns := make(map[uint64]int)
+			inputs := []*m.Matrix[T]{}
 			for j, key := range keys {
-				// Build the input for this bucket
-				cols := c.lheClients[i].DBInfo().M
-				input := m.New[T](cols, 1)
-				input.Set(uint64(c.mapping[key][i])%cols, 0, 1)
-				inputs[j] = input
+				col := column(key, i)
+				slot, ok := columns[col]
+				if !ok {
+					slot = len(inputs)
+					columns[col] = slot
+					input := m.New[T](cols, 1)
+					input.Set(col, 0, 1)
+					inputs = append(inputs, input)
+				}
+				slots[j] = slot
 			}
+
 			// Compute the query
 			s, q := c.lheClients[i].Query(inputs)
-			secrets[i] = &Secret[T]{keys, s}
-			queries[i] = &Query[T]{q}
+			secrets[i] = &BucketSecret[T]{keys, slots, s}
+			queries[i] = &BucketQuery[T]{q}
 
 			// Generate dummy queries if needed
 			remaining := queriesPer - uint64(len(inputs))
@@ -75,35 +93,64 @@ func (c *Client[T]) Query(indices []uint64) ([]*Secret[T], []*Query[T]) {
 			}
 		} else {
 			s, q := c.lheClients[i].DummyQuery(queriesPer)
-			secrets[i] = &Secret[T]{nil, s}
-			queries[i] = &Query[T]{q}
+			secrets[i] = &BucketSecret[T]{nil, nil, s}
+			queries[i] = &BucketQuery[T]{q}
 		}
 	}
 
-	return secrets, queries
+	// Any keys missing from the schedule overflowed their buckets, or couldn't
+	// be placed by cuckoo insertion
+	scheduled := make(map[uint64]bool, len(indices))
+	for _, keys := range schedule {
+		for _, key := range keys {
+			scheduled[key] = true
+		}
+	}
+	overflow := []uint64{}
+	for _, key := range indices {
+		if !scheduled[key] {
+			scheduled[key] = true
+			overflow = append(overflow, key)
+		}
+	}
+
+	return &Secret[T]{secrets, overflow, positions}, &Query[T]{queries}
 }
 
-func (c *Client[T]) Recover(secrets []*Secret[T], answers []*Answer[T]) map[uint64][]m.Elem32 {
+func (c *Client[T]) Recover(s batching.Secret[T], a batching.Answer[T]) (*batching.Result, error) {
+	secret := s.(*Secret[T])
+	secrets := secret.Buckets
+	answers := a.(*Answer[T]).Buckets
+
 	results := make(map[uint64][]m.Elem32, c.batchSize)
 	for i := range uint32(c.numBuckets) {
-		recovered := c.lheClients[i].Recover(secrets[i].Secrets, answers[i].Answers)
+		recovered, err := c.lheClients[i].Recover(secrets[i].Secrets, answers[i].Answers)
+		if err != nil {
+			return nil, err
+		}
 
-		for j, answer := range recovered {
+		dbInfo := c.lheClients[i].DBInfo()
+		for j, key := range secrets[i].Keys {
 			// Extract the exact part we want
-			//
-			// TODO: For now just a single element
-			dbInfo := c.lheClients[i].DBInfo()
-
-			// TODO: This is necessary due to typing stuff atm
-			rawResult := make([]m.Elem32, 0)
-			index := dbInfo.Ne * (uint64(c.mapping[secrets[i].Keys[j]][i]) / dbInfo.M)
-			for j := range dbInfo.Ne {
-				rawResult = append(rawResult, m.Elem32(answer.Data()[index+j]))
-			}
-			results[secrets[i].Keys[j]] = dbInfo.ReconstructElem(rawResult)
+			answer := recovered[secrets[i].Slots[j]]
+			results[key] = batching.ExtractEntry(dbInfo, answer, uint64(secret.positions[key][i]))
 		}
 	}
-	return results
+	return &batching.Result{Values: results, Overflow: secret.Overflow}, nil
+}
+
+// The buckets holding each of `keys`, and the index of the key in each
+func (c *Client[T]) positions(keys []uint64) map[uint64]KeyChoices {
+	choices := make([]KeyChoices, len(keys))
+	batching.ParallelFor(len(keys), 0, func(i int) {
+		choices[i] = c.mapping.Choices(c.hash, keys[i])
+	})
+
+	positions := make(map[uint64]KeyChoices, len(keys))
+	for i, key := range keys {
+		positions[key] = choices[i]
+	}
+	return positions
 }
 
 func (c *Client[T]) StateSize() uint64 {
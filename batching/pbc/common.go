@@ -1,12 +1,14 @@
 package pbc
 
 import (
-	"crypto/sha256"
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/binary"
 	"math"
-	"math/big"
+	"math/bits"
 	"slices"
 
+	"github.com/ryanleh/secure-inference/batching"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -31,27 +33,88 @@ const (
 // Bucket -> bucket index
 type KeyChoices map[uint32]uint32
 
+// Chooses the LHE scheme used to serve a bucket given its index and the number
+// of DB entries it holds
+type SchemeSelector func(bucket int, entries uint64) lhe.LHEType
+
+// Serve every bucket using the same LHE scheme
+func UniformScheme(scheme lhe.LHEType) SchemeSelector {
+	return func(int, uint64) lhe.LHEType {
+		return scheme
+	}
+}
+
+// Send buckets with at most `maxLocal` entries to the client in full and serve
+// the remaining buckets using `scheme`
+func ThresholdScheme(maxLocal uint64, scheme lhe.LHEType) SchemeSelector {
+	return func(_ int, entries uint64) lhe.LHEType {
+		if entries <= maxLocal {
+			return lhe.Local
+		}
+		return scheme
+	}
+}
+
 // Params
 type Params[T m.Elem] struct {
 	BatchSize  uint64
 	NumBuckets int64
 	Mode       Mode
-	Mapping    map[uint64]KeyChoices // TODO: This shouldn't be included
+	Mapping    *Mapping
+	HashKey    *rand.PRGKey // Key for mapping entries to buckets
 	LHEHints   []lhe.Hint[T]
 }
 
+func (p *Params[T]) NewClient() batching.Client[T] {
+	return &Client[T]{}
+}
+
 // Secret
 type Secret[T m.Elem] struct {
-	Keys    []uint64
+	Buckets []*BucketSecret[T]
+
+	// Keys that couldn't be scheduled into any bucket
+	Overflow []uint64
+
+	// Bucket -> index in bucket of each key
+	positions map[uint64]KeyChoices
+}
+
+func (s *Secret[T]) Keys() []uint64 {
+	keys := make([]uint64, 0)
+	for _, bucket := range s.Buckets {
+		keys = append(keys, bucket.Keys...)
+	}
+	return keys
+}
+
+type BucketSecret[T m.Elem] struct {
+	Keys []uint64
+
+	// The query answering each key. Keys in the same bucket column share a
+	// query.
+	Slots   []int
 	Secrets []lhe.Secret[T]
 }
 
 // Query
 type Query[T m.Elem] struct {
-	Queries []lhe.Query[T]
+	Buckets []*BucketQuery[T]
 }
 
 func (q *Query[T]) Size() uint64 {
+	size := uint64(0)
+	for _, bucket := range q.Buckets {
+		size += bucket.Size()
+	}
+	return size
+}
+
+type BucketQuery[T m.Elem] struct {
+	Queries []lhe.Query[T]
+}
+
+func (q *BucketQuery[T]) Size() uint64 {
 	size := uint64(0)
 	for _, query := range q.Queries {
 		size += query.Size()
@@ -61,10 +124,22 @@ func (q *Query[T]) Size() uint64 {
 
 // Answer
 type Answer[T m.Elem] struct {
-	Answers []lhe.Answer[T]
+	Buckets []*BucketAnswer[T]
 }
 
 func (a *Answer[T]) Size() uint64 {
+	size := uint64(0)
+	for _, bucket := range a.Buckets {
+		size += bucket.Size()
+	}
+	return size
+}
+
+type BucketAnswer[T m.Elem] struct {
+	Answers []lhe.Answer[T]
+}
+
+func (a *BucketAnswer[T]) Size() uint64 {
 	size := uint64(0)
 	for _, answer := range a.Answers {
 		size += answer.Size()
@@ -113,71 +188,161 @@ func (m Mode) NumQueriesPer() uint64 {
 *  Util Functions
  */
 
-// Assumes `bigMod` is already set to the correct modulus
-func getCandidate(buf []byte, bigNum, bigMod *big.Int) uint32 {
-	digest := sha256.Sum256(buf)
-	bigNum.SetBytes(digest[:])
-	bigNum.Mod(bigNum, bigMod)
-	return uint32(bigNum.Uint64())
-}
-
-func getBuckets(key uint64, numChoices uint64, bigNum, bigMod *big.Int) []uint32 {
-	// Convert key to bytes
-	buf := make([]byte, 9)
-	binary.LittleEndian.PutUint64(buf, key)
-
-	// Generate `numChoices` bucket choices for each index
-	buckets := make([]uint32, 0)
-	nonce := byte(0)
-	for range numChoices {
-		for {
-			// Compute the next candidate bucket
-			buf[8] = nonce
-			candidate := getCandidate(buf, bigNum, bigMod)
-			nonce += 1
-
-			// Add if the candidate is new
-			if !slices.Contains(buckets, candidate) {
-				buckets = append(buckets, candidate)
-				break
-			}
+// Keyed hash mapping DB entries to their candidate buckets. This needs to be
+// fast since it's evaluated for every DB entry during preprocessing, so we use
+// a single AES block per candidate and reduce with a multiply-shift instead of
+// a modulus.
+type BucketHash struct {
+	block      cipher.Block
+	numBuckets uint64
+}
+
+func NewBucketHash(key *rand.PRGKey, numBuckets uint64) *BucketHash {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	return &BucketHash{block, numBuckets}
+}
+
+func (h *BucketHash) NumBuckets() uint64 {
+	return h.numBuckets
+}
+
+// Append `numChoices` distinct candidate buckets for `key` to `buckets`
+func (h *BucketHash) Choices(key, numChoices uint64, buckets []uint32) []uint32 {
+	var in, out [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(in[:], key)
+
+	start := len(buckets)
+	nonce := uint64(0)
+	for uint64(len(buckets)-start) < numChoices {
+		// Compute the next candidate bucket
+		binary.LittleEndian.PutUint64(in[8:], nonce)
+		h.block.Encrypt(out[:], in[:])
+		candidate, _ := bits.Mul64(binary.LittleEndian.Uint64(out[:]), h.numBuckets)
+		nonce += 1
+
+		// Add if the candidate is new
+		if !slices.Contains(buckets[start:], uint32(candidate)) {
+			buckets = append(buckets, uint32(candidate))
 		}
 	}
 	return buckets
 }
 
-func EncodeDB(items []m.Elem32, numLimbs, batchSize uint64, mode Mode) ([][]m.Elem32, map[uint64]KeyChoices) {
-	N := uint64(len(items)) / numLimbs
-	if uint64(len(items))%numLimbs != 0 {
-		panic("Invalid data")
+// Assignment of DB entries to buckets. Neither the buckets nor the placement
+// of entries are materialized: `Fill` re-hashes each entry and encodes it
+// directly into the final DB of each of its candidate buckets.
+type Layout struct {
+	Num      uint64 // # of DB entries
+	NumLimbs uint64
+	Sizes    []uint64 // # of entries in each bucket
+	Mapping  *Mapping
+
+	hash *BucketHash
+}
+
+// Positions of DB entries within their buckets. Entries are placed in each of
+// their buckets in increasing order, so the position of an entry is the number
+// of earlier entries mapped to the same bucket. Only these counts at every
+// `Stride`-th entry are stored, and positions are derived from the bucket hash
+// on demand by re-hashing the entries since.
+type Mapping struct {
+	NumChoices uint64
+	Stride     uint64
+	Offsets    []uint32 // (block, bucket) -> # of entries in bucket before block
+}
+
+// The buckets holding `key`, and the index of `key` in each
+func (mp *Mapping) Choices(hash *BucketHash, key uint64) KeyChoices {
+	numBuckets := hash.NumBuckets()
+	block := key / mp.Stride
+	offsets := mp.Offsets[block*numBuckets : (block+1)*numBuckets]
+
+	choices := make(KeyChoices, mp.NumChoices)
+	buckets := hash.Choices(key, mp.NumChoices, nil)
+	for _, bucket := range buckets {
+		choices[bucket] = offsets[bucket]
 	}
+	for i := block * mp.Stride; i < key; i++ {
+		for _, bucket := range hash.Choices(i, mp.NumChoices, buckets[:0]) {
+			if index, ok := choices[bucket]; ok {
+				choices[bucket] = index + 1
+			}
+		}
+	}
+	return choices
+}
 
+// Compute the bucket layout for `num` DB entries
+func EncodeDB(num, numLimbs, batchSize uint64, mode Mode, hashKey *rand.PRGKey) *Layout {
 	// Compute the number of buckets
 	numBuckets := mode.NumBuckets(batchSize)
 	numChoices := mode.NumChoices()
+	hash := NewBucketHash(hashKey, numBuckets)
+
+	// Storing the offsets of every block takes about a byte per entry
+	stride := 4 * numBuckets
+	numBlocks := (num + stride - 1) / stride
+	layout := &Layout{
+		Num:      num,
+		NumLimbs: numLimbs,
+		Sizes:    make([]uint64, numBuckets),
+		Mapping: &Mapping{
+			NumChoices: numChoices,
+			Stride:     stride,
+			Offsets:    make([]uint32, numBlocks*numBuckets),
+		},
+		hash: hash,
+	}
 
-	mapping := make(map[uint64]KeyChoices, 0)
-	buckets := make([][]m.Elem32, numBuckets)
-	for i := range buckets {
-		buckets[i] = make([]m.Elem32, 0)
+	// Count the number of entries of each block in each bucket
+	offsets := layout.Mapping.Offsets
+	batching.ParallelFor(int(numBlocks), 0, func(b int) {
+		block := uint64(b)
+		counts := offsets[block*numBuckets : (block+1)*numBuckets]
+		choices := make([]uint32, 0, numChoices)
+		for i := block * stride; i < min((block+1)*stride, num); i++ {
+			for _, bucket := range hash.Choices(i, numChoices, choices[:0]) {
+				counts[bucket] += 1
+			}
+		}
+	})
+
+	// Compute where each block starts within each bucket
+	for block := range numBlocks {
+		counts := offsets[block*numBuckets : (block+1)*numBuckets]
+		for bucket, count := range counts {
+			counts[bucket] = uint32(layout.Sizes[bucket])
+			layout.Sizes[bucket] += uint64(count)
+		}
 	}
 
-	bigNum := big.NewInt(0)
-	bigMod := big.NewInt(int64(len(buckets)))
-	for i := range N {
-		// Get the set of buckets this entry is mapped too
-		bucketsI := getBuckets(uint64(i), numChoices, bigNum, bigMod)
+	return layout
+}
 
-		// Add the entry to each of these buckets and record the index locations
-		item := items[i*numLimbs : (i+1)*numLimbs]
-		keyChoices := make(KeyChoices, numChoices)
-		for _, candidate := range bucketsI {
-			keyChoices[candidate] = uint32(len(buckets[candidate]) / int(numLimbs))
-			buckets[candidate] = append(buckets[candidate], item...)
-		}
-		mapping[uint64(i)] = keyChoices
+// Write each entry of `items` into the DB of each of its buckets
+func (l *Layout) Fill(items []m.Elem32, dbs []*lhe.DB) {
+	if uint64(len(items)) != l.Num*l.NumLimbs || len(dbs) != len(l.Sizes) {
+		panic("Invalid data")
 	}
-	return buckets, mapping
+
+	numBuckets := uint64(len(l.Sizes))
+	mp := l.Mapping
+	numBlocks := uint64(len(mp.Offsets)) / numBuckets
+	batching.ParallelFor(int(numBlocks), 0, func(b int) {
+		block := uint64(b)
+		positions := slices.Clone(mp.Offsets[block*numBuckets : (block+1)*numBuckets])
+		choices := make([]uint32, 0, mp.NumChoices)
+		for i := block * mp.Stride; i < min((block+1)*mp.Stride, l.Num); i++ {
+			item := items[i*l.NumLimbs : (i+1)*l.NumLimbs]
+			for _, bucket := range l.hash.Choices(i, mp.NumChoices, choices[:0]) {
+				dbs[bucket].SetEntry(uint64(positions[bucket]), item)
+				positions[bucket] += 1
+			}
+		}
+	})
 }
 
 func cuckooInsert(
@@ -207,38 +372,56 @@ func cuckooInsert(
 	return cuckooInsert(schedule, choices, oldKey, depth+1, prg)
 }
 
-// Returns a schedule of buckets
-func GenSchedule(indices []uint64, mode Mode, numBuckets int64, prg *rand.BufPRGReader) map[uint32][]uint64 {
+// Returns a schedule of buckets. Keys that can't be placed (e.g. when cuckoo
+// insertion fails) are left out of the schedule.
+//
+// If `column` is non-nil, it gives the column of `key` within `bucket`. Keys
+// that share a column with a key already scheduled in a bucket are retrieved
+// by the same query, so they don't count towards the bucket's capacity. This
+// is only done for hash-based bucketing, where a bucket holds several keys.
+func GenSchedule(
+	indices []uint64,
+	mode Mode,
+	hash *BucketHash,
+	prg *rand.BufPRGReader,
+	column func(key uint64, bucket uint32) uint64,
+) map[uint32][]uint64 {
 	// Get the possible bucket choices for each key
 	numChoices := mode.NumChoices()
 	choices := make(map[uint64][]uint32)
-	bigNum := big.NewInt(0)
-	bigMod := big.NewInt(numBuckets)
 	for _, key := range indices {
-		choices[key] = getBuckets(key, numChoices, bigNum, bigMod)
+		choices[key] = hash.Choices(key, numChoices, nil)
 	}
 
 	schedule := make(map[uint32][]uint64, 0)
 	switch mode {
 	case Hash:
+		columns := make(map[uint32]map[uint64]bool)
 		for _, key := range indices {
-			// TODO: For now we only do single queries to each bucket. Queries
-			// might be overwritten
-			if qs, ok := schedule[choices[key][0]]; ok {
-				// Add if length < R
-				if uint64(len(qs)) < P {
-					schedule[choices[key][0]] = append(schedule[choices[key][0]], key)
+			bucket := choices[key][0]
+			if columns[bucket] == nil {
+				columns[bucket] = make(map[uint64]bool)
+			}
+
+			// Without column information every key needs its own query
+			col := uint64(len(schedule[bucket]))
+			if column != nil {
+				col = column(key, bucket)
+			}
+			if !columns[bucket][col] {
+				if uint64(len(columns[bucket])) == P {
+					continue
 				}
-			} else {
-				schedule[choices[key][0]] = []uint64{key}
+				columns[bucket][col] = true
 			}
+			schedule[bucket] = append(schedule[bucket], key)
 		}
 	case Cuckoo:
 		// Do cuckoo hashing insertion following the approach of Angel et. al
+		// A failed insertion leaves out the last key it evicted, but the
+		// other keys stay scheduled
 		for _, key := range indices {
-			if !cuckooInsert(schedule, choices, key, 0, prg) {
-				return nil
-			}
+			cuckooInsert(schedule, choices, key, 0, prg)
 		}
 	}
 	return schedule
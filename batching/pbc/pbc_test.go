@@ -1,13 +1,13 @@
 package pbc
 
 import (
-	"golang.org/x/exp/maps"
 	"math"
 	"slices"
 	"testing"
 
 	"github.com/ryanleh/secure-inference/batching"
 	"github.com/ryanleh/secure-inference/crypto/rand"
+	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
 
@@ -18,6 +18,7 @@ var key = rand.PRGKey([16]byte{
 func randInstance[T m.Elem](
 	batchSize, bitsPer, rows, cols, pMod uint64,
 	mode Mode,
+	schemes SchemeSelector,
 ) (*Server[T], *m.Matrix[m.Elem32]) {
 	if bitsPer > 63 || bitsPer%32 == 0 {
 		panic("Unsupported entry bits")
@@ -42,6 +43,7 @@ func randInstance[T m.Elem](
 		prg.GenPRGKey(),
 		batching.Balanced,
 		mode,
+		schemes,
 		false,
 	)
 	return server, matrix
@@ -57,7 +59,7 @@ func testBatchPIR[T m.Elem](
 	defer client.Free()
 	defer server.Free()
 	prg := rand.NewBufPRG(rand.NewPRG(&key))
-	params := server.Params()
+	params := server.Params().(*Params[T])
 
 	// Generate client queries
 	client.Init(params)
@@ -74,7 +76,18 @@ func testBatchPIR[T m.Elem](
 
 	// Answer queries
 	answers := server.Answer(queries)
-	results := client.Recover(keys, answers)
+	result, err := client.Recover(keys, answers)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	results := result.Values
+
+	// Every queried index is either retrieved or reported as overflowing
+	for _, idx := range indices {
+		if _, ok := results[idx]; !ok && !slices.Contains(result.Overflow, idx) {
+			t.Fatalf("Index %v neither retrieved nor reported", idx)
+		}
+	}
 
 	// Check that we received the expected number of queries
 	switch params.Mode {
@@ -102,17 +115,18 @@ func testBatchPIR[T m.Elem](
 }
 
 func testBasicBatch[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
+	hybrid := UniformScheme(lhe.SimpleHybrid)
 	dbRows := []uint64{10, 512, 512}
 	dbCols := []uint64{800, 256, 512}
 	batchSize := uint64(32)
 	for i := range dbRows {
 		N := dbRows[i] * dbCols[i]
 		// Test standard hash bucketing
-		server, matrix := randInstance[T](batchSize, bitsPer, dbRows[i], dbCols[i], pMod, Hash)
+		server, matrix := randInstance[T](batchSize, bitsPer, dbRows[i], dbCols[i], pMod, Hash, hybrid)
 		testBatchPIR[T](t, &Client[T]{}, server, matrix, N, bitsPer, pMod)
 
 		// Test cuckoo hashing
-        server, matrix = randInstance[T](batchSize, bitsPer, dbRows[i], dbCols[i], pMod, Cuckoo)
+        server, matrix = randInstance[T](batchSize, bitsPer, dbRows[i], dbCols[i], pMod, Cuckoo, hybrid)
 		testBatchPIR[T](t, &Client[T]{}, server, matrix, N, bitsPer, pMod)
 	}
 }
@@ -122,6 +136,173 @@ func TestBasicBatch32(t *testing.T) {
 	testBasicBatch[m.Elem32](t, 24, uint64(1<<8))
 }
 
+// Mix local and SimplePIR buckets based on the bucket size
+func testMixedSchemes[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
+	dbRows := []uint64{10, 512}
+	dbCols := []uint64{800, 256}
+	batchSize := uint64(32)
+	for i := range dbRows {
+		// Roughly half of the buckets should fall below the threshold
+		N := dbRows[i] * dbCols[i]
+		threshold := Cuckoo.NumChoices() * N / Cuckoo.NumBuckets(batchSize)
+		schemes := ThresholdScheme(threshold, lhe.Simple)
+
+		server, matrix := randInstance[T](batchSize, bitsPer, dbRows[i], dbCols[i], pMod, Cuckoo, schemes)
+		types := make(map[lhe.LHEType]int)
+		for _, hint := range server.Params().(*Params[T]).LHEHints {
+			types[hint.Type()] += 1
+		}
+		if types[lhe.Local] == 0 || types[lhe.Simple] == 0 {
+			t.Fatalf("Expected a mix of bucket types: %v", types)
+		}
+		if server.StateSize() == 0 {
+			t.Fatalf("Server reports no state")
+		}
+		testBatchPIR[T](t, &Client[T]{}, server, matrix, N, bitsPer, pMod)
+	}
+}
+
+func TestMixedSchemes32(t *testing.T) {
+	testMixedSchemes[m.Elem32](t, 8, uint64(1<<8))
+	testMixedSchemes[m.Elem32](t, 48, uint64(1<<8))
+}
+
+func TestMixedSchemes64(t *testing.T) {
+	testMixedSchemes[m.Elem64](t, 15, uint64(1<<16))
+}
+
+// Answer the queries of many clients in a single batch
+func testAnswerBatch[T m.Elem](t *testing.T, mode Mode, bitsPer, pMod uint64) {
+	rows, cols := uint64(64), uint64(128)
+	N := rows * cols
+	batchSize := uint64(16)
+	server, matrix := randInstance[T](batchSize, bitsPer, rows, cols, pMod, mode, UniformScheme(lhe.Local))
+	defer server.Free()
+	params := server.Params()
+
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+	clients := make([]*Client[T], 8)
+	secrets := make([]batching.Secret[T], len(clients))
+	queries := make([]batching.Query[T], len(clients))
+	for i := range clients {
+		clients[i] = &Client[T]{}
+		clients[i].Init(params)
+		defer clients[i].Free()
+
+		indices := make([]uint64, batchSize)
+		for j := range indices {
+			indices[j] = prg.Uint64() % N
+		}
+		secrets[i], queries[i] = clients[i].Query(indices)
+	}
+
+	answers := server.AnswerBatch(queries)
+	for i, client := range clients {
+		result, err := client.Recover(secrets[i], answers[i])
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, idx := range secrets[i].Keys() {
+			if _, ok := result.Values[idx]; !ok {
+				t.Fatalf("Scheduled index %v not retrieved", idx)
+			}
+		}
+		for idx, value := range result.Values {
+			expected := matrix.Data()[idx*numLimbs : (idx+1)*numLimbs]
+			if !slices.Equal(value, expected) {
+				t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, expected)
+			}
+		}
+	}
+}
+
+func TestAnswerBatch32(t *testing.T) {
+	testAnswerBatch[m.Elem32](t, Hash, 24, uint64(1<<8))
+	testAnswerBatch[m.Elem32](t, Cuckoo, 48, uint64(1<<8))
+}
+
+func TestAnswerBatch64(t *testing.T) {
+	testAnswerBatch[m.Elem64](t, Cuckoo, 24, uint64(1<<16))
+}
+
+// Keys sharing a bucket column are retrieved by the same query, so a bucket
+// can retrieve more than `P` keys
+func testSharedColumns[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
+	rows, cols := uint64(8), uint64(32)
+	N := rows * cols
+	batchSize := uint64(16)
+	server, matrix := randInstance[T](batchSize, bitsPer, rows, cols, pMod, Hash, UniformScheme(lhe.Local))
+	client := &Client[T]{}
+	client.Init(server.Params())
+	defer server.Free()
+	defer client.Free()
+
+	indices := make([]uint64, N)
+	for i := range indices {
+		indices[i] = uint64(i)
+	}
+	secret, query := client.Query(indices)
+	result, err := client.Recover(secret, server.Answer(query))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.Values)+len(result.Overflow) != len(indices) {
+		t.Fatalf("Inconsistent result: %v retrieved, %v overflow", len(result.Values), len(result.Overflow))
+	}
+	if uint64(len(result.Values)) <= P*Hash.NumBuckets(batchSize) {
+		t.Fatalf("Expected keys to share queries: %v retrieved", len(result.Values))
+	}
+
+	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+	for idx, value := range result.Values {
+		expected := matrix.Data()[idx*numLimbs : (idx+1)*numLimbs]
+		if !slices.Equal(value, expected) {
+			t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, expected)
+		}
+	}
+}
+
+func TestSharedColumns32(t *testing.T) {
+	testSharedColumns[m.Elem32](t, 24, uint64(1<<8))
+	testSharedColumns[m.Elem32](t, 48, uint64(1<<8))
+}
+
+func TestSharedColumns64(t *testing.T) {
+	testSharedColumns[m.Elem64](t, 24, uint64(1<<16))
+}
+
+// Keys cuckoo insertion can't place are reported as overflow rather than
+// failing the query
+func TestCuckooOverflow(t *testing.T) {
+	rows, cols := uint64(8), uint64(32)
+	batchSize := uint64(16)
+	server, matrix := randInstance[m.Elem32](batchSize, 24, rows, cols, 1<<8, Cuckoo, UniformScheme(lhe.Local))
+	client := &Client[m.Elem32]{}
+	client.Init(server.Params())
+	defer server.Free()
+	defer client.Free()
+
+	// Each bucket retrieves a single key, so some keys can't be placed
+	indices := make([]uint64, 2*Cuckoo.NumBuckets(batchSize))
+	for i := range indices {
+		indices[i] = uint64(i)
+	}
+	secret, query := client.Query(indices)
+	result, err := client.Recover(secret, server.Answer(query))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.Overflow) == 0 || len(result.Values)+len(result.Overflow) != len(indices) {
+		t.Fatalf("Inconsistent result: %v retrieved, %v overflow", len(result.Values), len(result.Overflow))
+	}
+	for idx, value := range result.Values {
+		if !slices.Equal(value, matrix.Data()[idx:idx+1]) {
+			t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, matrix.Data()[idx:idx+1])
+		}
+	}
+}
+
 func testPBC(t *testing.T, mode Mode) {
 	// Generate some random elements in a DB
 	prg := rand.NewBufPRG(rand.NewPRG(&key))
@@ -130,20 +311,49 @@ func testPBC(t *testing.T, mode Mode) {
 	numLimbs := uint64(2)
 
 	db := m.Rand[m.Elem32](prg, N*numLimbs, 1, 0)
-	buckets, mapping := EncodeDB(db.Data(), numLimbs, batchSize, mode)
+	layout := EncodeDB(N, numLimbs, batchSize, mode, &key)
+	hash := NewBucketHash(&key, uint64(len(layout.Sizes)))
+
+	// Write the entries into a raw DB for each bucket
+	bitsPer := 32 * numLimbs
+	buckets := make([]*lhe.DB, len(layout.Sizes))
+	for i := range buckets {
+		buckets[i] = lhe.NewEmptyDB(layout.Sizes[i], bitsPer, 64, 0, lhe.RowMajor)
+	}
+	layout.Fill(db.Data(), buckets)
 
 	// Check that each element appears the correct number of times,
-	// and the mapping is correct
-	for i := range N {
-		keyChoices := mapping[uint64(i)]
+	// and the mapping is correct for the first and last entries of a block as
+	// well as random ones
+	total := uint64(0)
+	for _, size := range layout.Sizes {
+		total += size
+	}
+	if total != N*mode.NumChoices() {
+		t.Fatalf("Invalid bucket sizes: %v vs. %v", total, N*mode.NumChoices())
+	}
+	stride := layout.Mapping.Stride
+	checked := []uint64{0, stride - 1, stride, N - 1}
+	for range 1000 {
+		checked = append(checked, prg.Uint64()%N)
+	}
+	for _, i := range checked {
+		keyChoices := layout.Mapping.Choices(hash, i)
 		if uint64(len(keyChoices)) != mode.NumChoices() {
 			t.Fail()
 		}
 
 		item := db.Data()[i*numLimbs : (i+1)*numLimbs]
 		for bucket, bIndex := range keyChoices {
-			idx := uint64(bIndex) * numLimbs
-			result := buckets[bucket][idx : idx+numLimbs]
+			if uint64(bIndex) >= layout.Sizes[bucket] {
+				t.Fatalf("Index out of range: %v vs. %v", bIndex, layout.Sizes[bucket])
+			}
+			info := buckets[bucket].Info
+			result := make([]m.Elem32, numLimbs)
+			for j := range numLimbs {
+				row := info.Ne*(uint64(bIndex)/info.M) + j
+				result[j] = buckets[bucket].Data.Get(row, uint64(bIndex)%info.M)
+			}
 			if !slices.Equal(result, item) {
 				t.Fatalf("PBC Failure: %v vs. %v", result, item)
 			}
@@ -166,8 +376,8 @@ func testPBC(t *testing.T, mode Mode) {
 		}
 
 		// Generate a schedule and check that it's correct
-		schedule := GenSchedule(queries, mode, int64(len(buckets)), prg)
-		if mode == Cuckoo && (schedule == nil || uint64(len(schedule)) != batchSize) {
+		schedule := GenSchedule(queries, mode, hash, prg, nil)
+		if mode == Cuckoo && uint64(len(schedule)) != batchSize {
 			t.Fatalf("Cuckoo Insertion Failed")
 		}
 
@@ -182,8 +392,9 @@ func testPBC(t *testing.T, mode Mode) {
 
 		for _, key := range queries {
 			if bucket, contains := scheduleInv[key]; contains {
-				if !slices.Contains(maps.Keys(mapping[key]), bucket) {
-					t.Fatalf("Invalid PBC Schedule: %v not in %v", bucket, maps.Keys(mapping[key]))
+				choices := hash.Choices(key, mode.NumChoices(), nil)
+				if !slices.Contains(choices, bucket) {
+					t.Fatalf("Invalid PBC Schedule: %v not in %v", bucket, choices)
 				}
 			}
 		}
@@ -4,7 +4,6 @@ import (
 	"math"
 
 	"github.com/ryanleh/secure-inference/batching"
-	"github.com/ryanleh/secure-inference/crypto"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -13,9 +12,15 @@ import (
 type Server[T m.Elem] struct {
 	lheServers []lhe.Server[T]
 	batchSize  uint64
-	buckets    [][]m.Elem32
-	mapping    map[uint64]KeyChoices
+	hashKey    *rand.PRGKey
+	mapping    *Mapping
 	mode       Mode
+
+	// Batch size of each bucket set by `SetBatch`, if any
+	batch uint64
+
+	// Number of buckets to process concurrently
+	workers int
 }
 
 func MakeServer[T m.Elem](
@@ -24,78 +29,151 @@ func MakeServer[T m.Elem](
 	seed *rand.PRGKey,
 	packing batching.Packing,
 	mode Mode,
+	schemes SchemeSelector,
 	bench bool, // TODO: Remove
 ) *Server[T] {
 	// PRG for creating seeds
 	prg := rand.NewBufPRG(rand.NewPRG(seed))
 
-	// Encode the database into buckets
+	// Map the database entries to buckets
 	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
-	buckets, mapping := EncodeDB(matrix.Data(), numLimbs, batchSize, mode)
+	if uint64(len(matrix.Data()))%numLimbs != 0 {
+		panic("Invalid data")
+	}
+	hashKey := prg.GenPRGKey()
+	layout := EncodeDB(uint64(len(matrix.Data()))/numLimbs, numLimbs, batchSize, mode, hashKey)
+	numBuckets := len(layout.Sizes)
 
 	// Get the re-mapped bucket parameters
-	bucketSizes := make([]uint64, len(buckets))
-	for i := range buckets {
-		bucketSizes[i] = uint64(len(buckets[i]))
+	bucketSizes := make([]uint64, numBuckets)
+	for i := range bucketSizes {
+		bucketSizes[i] = layout.Sizes[i] * numLimbs
 	}
-	rows, cols, pMods := batching.PackingDims[T](bucketSizes, bitsPer, matrix.Rows(), matrix.Cols(), pMod, packing)
-
-	// Initialize an LHE server for each bucket
-	//
-	// TODO: Make this general if we need
-	servers := make([]lhe.Server[T], len(buckets))
-
-	for i := range servers {
-		// Create the LHE server
-		servers[i] = lhe.MakeSimpleServer[T](
-			m.NewFromRaw(buckets[i], rows[i], cols[i]),
-			bitsPer,
-			crypto.NewContext[T](T(0).Bitlen(), cols[i], pMods[i]),
-			prg.GenPRGKey(),
-			lhe.Hybrid,
-            false,
-			bench,
-		)
+	_, cols, pMods, err := batching.PackingDims[T](bucketSizes, bitsPer, matrix.Rows(), matrix.Cols(), pMod, packing)
+	if err != nil {
+		panic(err)
 	}
 
-	return &Server[T]{servers, batchSize, buckets, mapping, mode}
+	// Encode the entries directly into the final DB of each bucket, using the
+	// scheme chosen by `schemes`. Local buckets hold raw limbs.
+	types := make([]lhe.LHEType, numBuckets)
+	dbs := make([]*lhe.DB, numBuckets)
+	for i := range dbs {
+		types[i] = schemes(i, layout.Sizes[i])
+		if types[i] == lhe.Local {
+			dbs[i] = lhe.NewEmptyDB(layout.Sizes[i], bitsPer, cols[i], 0, lhe.RowMajor)
+		} else {
+			dbs[i] = lhe.NewEmptyDB(layout.Sizes[i], bitsPer, cols[i], pMods[i], lhe.RowMajor)
+		}
+	}
+	layout.Fill(matrix.Data(), dbs)
+
+	// Sample the seed for each bucket up front so that the result doesn't
+	// depend on the order in which buckets are preprocessed
+	seeds := make([]*rand.PRGKey, numBuckets)
+	for i := range seeds {
+		seeds[i] = prg.GenPRGKey()
+	}
+
+	// Initialize an LHE server for each bucket. Buckets are independent, so
+	// preprocessing (hint generation) is done concurrently.
+	servers := make([]lhe.Server[T], numBuckets)
+	workers := batching.DefaultWorkers()
+	batching.ParallelFor(numBuckets, workers, func(i int) {
+		servers[i] = lhe.MakeServerFromDB[T](types[i], dbs[i], seeds[i], bench)
+	})
+
+	return &Server[T]{
+		lheServers: servers,
+		batchSize:  batchSize,
+		hashKey:    hashKey,
+		mapping:    layout.Mapping,
+		mode:       mode,
+		workers:    workers,
+	}
 }
 
-func (s *Server[T]) Params() *Params[T] {
+func (s *Server[T]) Params() batching.Params[T] {
 	hints := make([]lhe.Hint[T], len(s.lheServers))
 	for i, server := range s.lheServers {
 		hints[i] = server.Hint()
 	}
-	params := &Params[T]{
+	return &Params[T]{
 		BatchSize:  s.batchSize,
-		NumBuckets: int64(len(s.buckets)),
+		NumBuckets: int64(len(s.lheServers)),
+		Mode:       s.mode,
 		Mapping:    s.mapping,
+		HashKey:    s.hashKey,
 		LHEHints:   hints,
 	}
-
-	if s.mode == Cuckoo {
-		params.Mapping = s.mapping
-	}
-	return params
 }
 
 func (s *Server[T]) SetBatch(batch uint64) {
+	s.batch = batch
 	for _, server := range s.lheServers {
 		server.SetBatch(batch)
 	}
 }
 
-// TODO: Make this multi-client
-func (s *Server[T]) Answer(queries []*Query[T]) []*Answer[T] {
-	answers := make([]*Answer[T], len(s.buckets))
-	for i, query := range queries {
-		answers[i] = &Answer[T]{s.lheServers[i].Answer(query.Queries)}
+// Set the number of buckets that are answered concurrently. Values <= 0 reset
+// to the default.
+//
+// Since answering is memory-bound, it can be worth setting this below the
+// number of cores on machines with limited memory bandwidth.
+func (s *Server[T]) SetWorkers(workers int) {
+	if workers <= 0 {
+		workers = batching.DefaultWorkers()
 	}
-	return answers
+	s.workers = workers
+}
+
+func (s *Server[T]) Answer(q batching.Query[T]) batching.Answer[T] {
+	queries := q.(*Query[T]).Buckets
+
+	// Each bucket is an independent LHE server over disjoint data, so buckets
+	// can be answered concurrently
+	answers := make([]*BucketAnswer[T], len(s.lheServers))
+	batching.ParallelFor(len(queries), s.workers, func(i int) {
+		answers[i] = &BucketAnswer[T]{s.lheServers[i].Answer(queries[i].Queries)}
+	})
+	return &Answer[T]{answers}
+}
+
+// Answer the queries of several clients at once. Each bucket answers the
+// queries of all clients in a single batch.
+func (s *Server[T]) AnswerBatch(qs []batching.Query[T]) []batching.Answer[T] {
+	answers := make([]*Answer[T], len(qs))
+	for i := range answers {
+		answers[i] = &Answer[T]{make([]*BucketAnswer[T], len(s.lheServers))}
+	}
+
+	batching.ParallelFor(len(s.lheServers), s.workers, func(i int) {
+		batches := make([][]lhe.Query[T], len(qs))
+		for j, q := range qs {
+			batches[j] = q.(*Query[T]).Buckets[i].Queries
+		}
+		bucketAnswers := lhe.AnswerBatch(s.lheServers[i], batches)
+		if s.batch != 0 {
+			s.lheServers[i].SetBatch(s.batch)
+		}
+		for j := range qs {
+			answers[j].Buckets[i] = &BucketAnswer[T]{bucketAnswers[j]}
+		}
+	})
+
+	results := make([]batching.Answer[T], len(qs))
+	for i, answer := range answers {
+		results[i] = answer
+	}
+	return results
 }
 
 func (s *Server[T]) StateSize() uint64 {
-	panic("Unimplemented")
+	size := uint64(0)
+	for _, server := range s.lheServers {
+		size += server.StateSize()
+	}
+	return size
 }
 
 func (s *Server[T]) Free() {
@@ -9,6 +9,7 @@ import (
 	"github.com/ryanleh/secure-inference/batching/pbc"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
 
@@ -36,18 +37,19 @@ func benchmarkDPIR[T m.Elem]() {
         prg.GenPRGKey(),
         packing,
         pbc.Hash,
+        pbc.UniformScheme(lhe.SimpleHybrid),
         true,
     )
 
     // Initialize the client
-    client := &pbc.Client[T]{}
+    var client batching.Client[T] = &pbc.Client[T]{}
     client.Init(server.Params())
     fullState := client.StateSize()
 
     // Benchmark the first bucket
     _, fullQueries := client.Query([]uint64{})
        
-    var fullAnswers []*pbc.Answer[T]
+    var fullAnswers batching.Answer[T]
     fullResult := testing.Benchmark(func(b *testing.B) {
         // Answer queries
         b.ResetTimer()
@@ -60,19 +62,8 @@ func benchmarkDPIR[T m.Elem]() {
     fullSec := fullResult.T.Seconds() / float64(fullResult.N)
     fmt.Printf("Full Query (%d iters): %f s\n", fullResult.N, fullSec)
 
-    fullUploadBytes := uint64(0)
-    for _, query := range fullQueries {
-        if query != nil {
-            fullUploadBytes += query.Size()
-        }
-    }
-    
-    fullDownBytes := uint64(0)
-    for _, answer := range fullAnswers {
-        if answer != nil {
-            fullDownBytes += answer.Size()
-        }
-    }
+    fullUploadBytes := fullQueries.Size()
+    fullDownBytes := fullAnswers.Size()
     server.Free()
     client.Free()
 
@@ -93,6 +84,7 @@ func benchmarkDPIR[T m.Elem]() {
         prg.GenPRGKey(),
         packing,
         pbc.Hash,
+        pbc.UniformScheme(lhe.SimpleHybrid),
         true,
     )
 
@@ -103,7 +95,7 @@ func benchmarkDPIR[T m.Elem]() {
     // Benchmark the bucket
     _, popQueries := client.Query([]uint64{})
    
-    var popAnswers []*pbc.Answer[T]
+    var popAnswers batching.Answer[T]
     popResult := testing.Benchmark(func(b *testing.B) {
         // Answer queries
         b.ResetTimer()
@@ -124,20 +116,10 @@ func benchmarkDPIR[T m.Elem]() {
     server.Free()
 
     // Print communication info
-    uploadBytes := uint64(0)
-    for _, query := range popQueries {
-        if query != nil {
-            uploadBytes += query.Size()
-        }
-    }
+    uploadBytes := popQueries.Size()
     avgUploadBytes := alpha * float64(uploadBytes) + (1 - alpha) * float64(fullUploadBytes)
     
-    downloadBytes := uint64(0)
-    for _, answer := range popAnswers {
-        if answer != nil {
-            downloadBytes += answer.Size()
-        }
-    }
+    downloadBytes := popAnswers.Size()
     avgDownloadBytes := alpha * float64(downloadBytes) + (1 - alpha) * float64(fullDownBytes)
     fmt.Printf(
         "Upload: %0.2fMB, Download: %0.2fMB\n",
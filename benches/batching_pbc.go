@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"github.com/ryanleh/secure-inference/batching"
 	"github.com/ryanleh/secure-inference/batching/pbc"
 	"github.com/ryanleh/secure-inference/crypto/rand"
+	"github.com/ryanleh/secure-inference/lhe"
 	m "github.com/ryanleh/secure-inference/matrix"
 	"math"
 	"testing"
@@ -26,7 +28,7 @@ func benchmarkPBC[T m.Elem]() {
     key := rand.RandomPRGKey()
 
     fmt.Print("Initializing server...")
-    server := pbc.MakeServer[T](matrix, *batchSize, *pMod, *bitsPer, key, packing, hashMode, true)
+    server := pbc.MakeServer[T](matrix, *batchSize, *pMod, *bitsPer, key, packing, hashMode, pbc.UniformScheme(lhe.SimpleHybrid), true)
     fmt.Println("Done.")
 
     // Initialize the client
@@ -39,8 +41,8 @@ func benchmarkPBC[T m.Elem]() {
     defer server.Free()
 
     // Generate and answer queries
-    var answers []*pbc.Answer[T]
-    var queries []*pbc.Query[T]
+    var answers batching.Answer[T]
+    var queries batching.Query[T]
     var recovered int
     result := testing.Benchmark(func(b *testing.B) {
         recovered = 0
@@ -57,9 +59,7 @@ func benchmarkPBC[T m.Elem]() {
             queries = qs
 
             // Calculate fraction of inputs recovered successfully
-            for _, secret := range secrets {
-                recovered += len(secret.Keys)
-            }
+            recovered += len(secrets.Keys())
 
             b.StartTimer()
             answers = server.Answer(queries)
@@ -75,18 +75,8 @@ func benchmarkPBC[T m.Elem]() {
     )
 
     // Print communication info
-    uploadBytes := uint64(0)
-    for _, query := range queries {
-        if query != nil {
-            uploadBytes += query.Size()
-        }
-    }
-    downloadBytes := uint64(0)
-    for _, answer := range answers {
-        if answer != nil {
-            downloadBytes += answer.Size()
-        }
-    }
+    uploadBytes := queries.Size()
+    downloadBytes := answers.Size()
     fmt.Printf(
         "Upload: %0.2fMB, Download: %0.2fMB\n",
         float64(uploadBytes)/math.Pow(1024.0, 2),
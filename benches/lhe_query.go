@@ -36,7 +36,7 @@ func benchmarkQuery[T m.Elem]() testing.BenchmarkResult {
             secrets, _ := client.Query(input)
             for i := range secrets {
                 secret := secrets[i].(*lhe.SimpleSecret[T])
-                defer secret.Free()
+                defer secret.Close()
             }
 
 		}
@@ -39,7 +39,7 @@ func benchmarkThroughput[T m.Elem]() {
 		keys, queries := client.Query(inputs)
 		for i := range keys {
 			key := keys[i].(*lhe.SimpleSecret[T])
-			key.Free()
+			key.Close()
 		}
 
 		// Set the batch size
@@ -0,0 +1,189 @@
+package crypto
+
+import (
+	"fmt"
+	"math"
+)
+
+// Parameter generation for the LWE scheme. For a given ciphertext modulus,
+// secret dimension, error distribution and number of samples, this finds the
+// largest plaintext modulus for which answers decrypt correctly, after checking
+// that the parameters meet the target security level.
+//
+// Correctness: an answer over a DB `D` with `M` columns has error `D * e`. As
+// in SimplePIR, DB elements are treated as uniform, so each entry of `D * e` is
+// subgaussian with variance `M * E[d^2] * sigma^2` and decrypts incorrectly
+// with probability at most `failure` as long as it is below
+// `sqrt(2 * ln(2 / failure))` standard deviations, and below `Delta / 2`.
+//
+// Security: the cost of the primal uSVP attack is estimated with the core-SVP
+// methodology of [ADPS16], where BKZ with block size `beta` costs 2^(0.292 *
+// beta). Secrets narrower than the error are accounted for by rescaling the
+// secret coordinates of the embedding lattice [BG14].
+//
+// [ADPS16] Alkim, Ducas, Pöppelmann, Schwabe. Post-quantum key exchange - a new
+// hope. USENIX Security 2016.
+//
+// [BG14] Bai, Galbraith. Lattice decoding attacks on binary LWE. ACISP 2014.
+
+// Default target security level, in bits
+const SecurityLevel = 128
+
+// The distribution of LWE secrets
+type SecretDist int
+
+const (
+	Gaussian SecretDist = iota // The error distribution
+	Ternary                    // Uniform over {-1, 0, 1}
+	Binary                     // Uniform over {0, 1}
+)
+
+// The stddev of a secret coordinate, for error stddev `sigma`
+func (d SecretDist) Stddev(sigma float64) float64 {
+	switch d {
+	case Gaussian:
+		return sigma
+	case Ternary:
+		return math.Sqrt(2.0 / 3.0)
+	case Binary:
+		return 0.5
+	default:
+		panic("Invalid secret distribution")
+	}
+}
+
+// Options for choosing LWE parameters
+type Options struct {
+	Security uint64     // Target security level in bits, or 0 for the default
+	Secret   SecretDist // Secret distribution
+	Centered bool       // Whether DB elements are centered (see `Params`)
+}
+
+func (o Options) security() uint64 {
+	if o.Security == 0 {
+		return SecurityLevel
+	}
+	return o.Security
+}
+
+// Default probability that a single entry of an answer decrypts incorrectly
+var FailureProb = math.Exp2(-40)
+
+// Probability that the noise of a correctly decrypted entry exceeds
+// `Params.SuspectBound`
+var SuspectProb = math.Exp2(-20)
+
+// Estimate the bit security of LWE with secret dimension `n`, ciphertext
+// modulus 2^logq, error stddev `sigma` and secrets drawn from `secret`
+func EstimateSecurity(n, logq uint64, sigma float64, secret SecretDist) float64 {
+	// Find the smallest block size for which the attack succeeds with some
+	// number of samples. Larger block sizes only make the attack easier.
+	scale := sigma / secret.Stddev(sigma)
+	lo, hi := uint64(50), 8*n
+	if !usvpSucceeds(n, logq, sigma, scale, hi) {
+		return math.Inf(1)
+	}
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if usvpSucceeds(n, logq, sigma, scale, mid) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return 0.292 * float64(lo)
+}
+
+// The smallest power-of-two secret dimension that meets the security level
+// `security` for ciphertext modulus 2^logq, error stddev `sigma` and secrets
+// drawn from `secret`
+func SecretDim(logq uint64, sigma float64, secret SecretDist, security uint64) uint64 {
+	n := uint64(1 << 10)
+	for EstimateSecurity(n, logq, sigma, secret) < float64(security) {
+		n *= 2
+	}
+	return n
+}
+
+// The largest plaintext modulus for which answers over `nSamples` columns
+// decrypt correctly except with probability `failure` per entry, with the
+// secret distribution, security level and DB element range given by `opts`.
+// Returns an error if the LWE parameters don't meet the security level or no
+// modulus works.
+//
+// The error of an answer doesn't depend on the secret, which the client
+// removes exactly, so only the security check depends on the secret.
+func MaxPMod(
+	logq, n uint64,
+	sigma float64,
+	nSamples uint64,
+	failure float64,
+	opts Options,
+) (uint64, error) {
+	if bits := EstimateSecurity(n, logq, sigma, opts.Secret); bits < float64(opts.security()) {
+		return 0, fmt.Errorf("LWE with n = %v, q = 2^%v and sigma = %v has only %.1f bits of security", n, logq, sigma, bits)
+	}
+
+	// Binary search for the largest modulus that decrypts correctly
+	lo, hi := uint64(1), uint64(1)<<(logq/2+1)
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if decryptsCorrectly(logq, sigma, nSamples, failure, opts.Centered, mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if lo < 2 {
+		return 0, fmt.Errorf("no plaintext modulus supports %v samples", nSamples)
+	}
+	return lo, nil
+}
+
+/*
+* Util Functions
+ */
+
+// Whether answers with plaintext modulus `p` decrypt correctly
+func decryptsCorrectly(logq uint64, sigma float64, nSamples uint64, failure float64, centered bool, p uint64) bool {
+	bound := math.Sqrt(float64(nSamples)*elemVariance(p, centered)) * sigma * tailBound(failure)
+	delta := math.Floor(math.Exp2(float64(logq)) / float64(p))
+	return bound < delta/2
+}
+
+// Variance of a uniform DB element with plaintext modulus `p`
+func elemVariance(p uint64, centered bool) float64 {
+	variance := float64(p) * float64(p) / 3
+	if centered {
+		variance /= 4
+	}
+	return variance
+}
+
+// Number of stddevs a gaussian exceeds with probability at most `prob`
+func tailBound(prob float64) float64 {
+	return math.Sqrt(2 * math.Log(2/prob))
+}
+
+// Whether the primal uSVP attack with block size `beta` succeeds with some
+// number of samples `m`, i.e., whether the projected norm of the embedded
+// short vector is below the Gram-Schmidt norm that BKZ-`beta` achieves:
+//
+//	sigma * sqrt(beta) <= delta_0^(2 * beta - d) * (q^m * scale^n)^(1 / d)
+//
+// where `d = m + n + 1` is the dimension of the embedding lattice, whose
+// secret coordinates are scaled up by `scale` to match the error
+func usvpSucceeds(n, logq uint64, sigma, scale float64, beta uint64) bool {
+	b := float64(beta)
+	logDelta := math.Log(math.Pow(math.Pi*b, 1/b)*b/(2*math.Pi*math.E)) / (2 * (b - 1))
+	lhs := math.Log(sigma) + math.Log(b)/2
+	step := max(n/64, 1)
+	for m := step; m <= 4*n; m += step {
+		d := float64(m + n + 1)
+		rhs := (2*b-d)*logDelta + (float64(m)*float64(logq)*math.Ln2+float64(n)*math.Log(scale))/d
+		if lhs <= rhs {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+//go:build ignore
+
+// Generates the plaintext modulus tables in `tables.go` (see `PModTable`)
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"slices"
+
+	"github.com/ryanleh/secure-inference/crypto"
+)
+
+var tables = []struct {
+	name   string
+	logq   uint64
+	lo, hi int
+	opts   crypto.Options
+}{
+	{"pMod32", 32, 7, 20, crypto.Options{}},
+	{"pMod64", 64, 12, 20, crypto.Options{}},
+	{"pMod32Centered", 32, 7, 20, crypto.Options{Centered: true}},
+	{"pMod64Centered", 64, 12, 20, crypto.Options{Centered: true}},
+}
+
+func main() {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gen_tables.go; DO NOT EDIT.\n\npackage crypto\n")
+	for _, t := range tables {
+		table, err := crypto.PModTable(t.logq, t.lo, t.hi, t.opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", t.name, err)
+			os.Exit(1)
+		}
+		keys := make([]uint64, 0, len(table))
+		for k := range table {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		fmt.Fprintf(&buf, "\nvar %v = map[uint64]uint64{\n", t.name)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "\t1 << %d: %d,\n", bitLen(k)-1, table[k])
+		}
+		fmt.Fprintf(&buf, "}\n")
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("tables.go", src, 0644); err != nil {
+		panic(err)
+	}
+}
+
+func bitLen(x uint64) int {
+	n := 0
+	for ; x != 0; x >>= 1 {
+		n++
+	}
+	return n
+}
@@ -1,55 +1,132 @@
 package lwe
 
 import (
-	mrand "math/rand"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/big"
+	"math/bits"
 )
 
-// CDF table for gaussian with std-dev 3.2 to match SEALs parameters
-var cdf_table = [...]float64{
-	0.5, 0.952345, 0.822578, 0.644389, 0.457833,
-	0.295023, 0.172422, 0.0913938, 0.0439369, 0.0191572,
-	0.00757568, 0.00271706, 0.000883826, 0.000260749, 6.97696e-05,
-	1.69316e-05, 3.72665e-06, 7.43923e-07, 1.34687e-07, 2.21163e-08,
-	3.29371e-09, 4.44886e-10, 5.45004e-11, 6.05535e-12, 6.10194e-13,
-	5.57679e-14, 4.62263e-15, 3.47522e-16, 2.36954e-17, 1.46533e-18,
-	8.21851e-20, 4.18062e-21, 1.92875e-22, 8.07049e-24, 3.06275e-25,
-	1.05418e-26, 3.29081e-28, 9.31708e-30, 2.39247e-31, 5.57187e-33,
-	1.17691e-34, 2.25463e-36, 3.91737e-38, 6.1731e-40, 8.82266e-42,
-	1.14363e-43, 1.34449e-45, 1.43357e-47, 1.38634e-49, 1.21593e-51,
-	9.67246e-54, 6.97835e-56, 4.56622e-58, 2.70987e-60, 1.45858e-62,
-	7.12032e-65, 3.15252e-67, 1.26591e-69, 4.6104e-72, 1.52287e-74,
-	4.56219e-77, 1.23958e-79, 3.05465e-82, 6.82713e-85, 1.3839e-87,
+// Discrete gaussian sampling by inversion of a cumulative table: a uniform
+// 64-bit value `u` is mapped to the number of table entries at most `u`. Every
+// sample reads the same amount of randomness and scans the whole table without
+// branching on `u`, so sampling runs in constant time.
+//
+// Tables are built at runtime for any stddev. Each entry is accurate to about
+// 2^-53, and the distribution is cut off at `TailCut` stddevs, where the
+// remaining mass is below 2^-64.
+
+// Error distribution stddev, matching SEAL's parameters
+const StdDev = 3.2
+
+// Number of stddevs beyond which samples are cut off
+const TailCut = 10
+
+// The sampler for `StdDev`
+var DefaultSampler = NewGaussSampler(StdDev)
+
+// Number of samples drawn per read in `Fill`
+const fillBatch = 1024
+
+type GaussSampler struct {
+	Sigma float64
+
+	// Samples lie in [-bound, bound]
+	bound int64
+
+	// cdf[i] = round(2^64 * Pr[X <= i - bound]), for i in [0, 2 * bound)
+	cdf []uint64
 }
 
-// The function below is modeled on Martin Albrecht's discrete-Gaussian
-// sampler included in his dgs library:
-//
-//	https://github.com/malb/dgs
-func gaussSample(src mrand.Source, cdf_table []float64) int64 {
-	math_src := mrand.New(src)
-
-	var x int64
-	var y float64
-	for {
-		x = int64(math_src.Intn(len(cdf_table)))
-		y = math_src.Float64()
-
-		if y < cdf_table[x] {
-			break
+// Build a sampler for the discrete gaussian over the integers with stddev
+// `sigma`, i.e., with Pr[X = x] proportional to exp(-x^2 / (2 * sigma^2))
+func NewGaussSampler(sigma float64) *GaussSampler {
+	if !(sigma > 0) || math.IsInf(sigma, 0) {
+		panic("Invalid gaussian stddev")
+	}
+	bound := int64(math.Ceil(sigma * TailCut))
+	rho := func(x int64) float64 {
+		return math.Exp(-float64(x*x) / (2 * sigma * sigma))
+	}
+
+	// Accumulate with enough precision that rounding to 64 bits dominates
+	const prec = 128
+	total := new(big.Float).SetPrec(prec)
+	for x := -bound; x <= bound; x++ {
+		total.Add(total, big.NewFloat(rho(x)))
+	}
+
+	g := &GaussSampler{Sigma: sigma, bound: bound, cdf: make([]uint64, 2*bound)}
+	scale := new(big.Float).SetPrec(prec).SetMantExp(big.NewFloat(1), 64)
+	scale.Quo(scale, total)
+	sum := new(big.Float).SetPrec(prec)
+	entry := new(big.Float).SetPrec(prec)
+	for i := range g.cdf {
+		sum.Add(sum, big.NewFloat(rho(int64(i)-bound)))
+		entry.Mul(sum, scale)
+		entry.Add(entry, big.NewFloat(0.5))
+		v, acc := entry.Uint64()
+		if acc == big.Above {
+			v = math.MaxUint64
 		}
+		g.cdf[i] = v
 	}
+	return g
+}
+
+// Samples lie in [-Bound(), Bound()]
+func (g *GaussSampler) Bound() int64 {
+	return g.bound
+}
 
-	if math_src.Uint64()%2 == 0 {
-		x = -x
+// The probability of sampling `x` under the table
+func (g *GaussSampler) Prob(x int64) float64 {
+	if x < -g.bound || x > g.bound {
+		return 0
+	}
+	i := x + g.bound
+	hi := math.Exp2(64)
+	if i < int64(len(g.cdf)) {
+		hi = float64(g.cdf[i])
+	}
+	lo := 0.0
+	if i > 0 {
+		lo = float64(g.cdf[i-1])
 	}
+	return (hi - lo) / math.Exp2(64)
+}
 
-	return x
+// Draw a single sample using 8 bytes of randomness from `src`
+func (g *GaussSampler) Sample(src io.Reader) int64 {
+	var buf [8]byte
+	if _, err := io.ReadFull(src, buf[:]); err != nil {
+		panic(err)
+	}
+	return g.invert(binary.LittleEndian.Uint64(buf[:]))
 }
 
-func GaussSample32(src mrand.Source) int64 {
-	return gaussSample(src, cdf_table[:])
+// Fill `out` with independent samples, reading randomness in bulk
+func (g *GaussSampler) Fill(src io.Reader, out []int64) {
+	buf := make([]byte, 8*min(len(out), fillBatch))
+	for start := 0; start < len(out); start += fillBatch {
+		batch := out[start:min(start+fillBatch, len(out))]
+		if _, err := io.ReadFull(src, buf[:8*len(batch)]); err != nil {
+			panic(err)
+		}
+		for i := range batch {
+			batch[i] = g.invert(binary.LittleEndian.Uint64(buf[8*i:]))
+		}
+	}
 }
 
-func GaussSample64(src mrand.Source) int64 {
-	return gaussSample(src, cdf_table[:])
+// Map a uniform `u` to a sample, in constant time
+func (g *GaussSampler) invert(u uint64) int64 {
+	var count uint64
+	for _, c := range g.cdf {
+		// The borrow is 1 exactly when u < c
+		_, borrow := bits.Sub64(u, c, 0)
+		count += 1 - borrow
+	}
+	return int64(count) - g.bound
 }
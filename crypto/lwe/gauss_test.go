@@ -0,0 +1,104 @@
+package lwe
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ryanleh/secure-inference/crypto/rand"
+)
+
+var key rand.PRGKey
+
+// The ideal discrete gaussian with stddev `sigma`
+func ideal(sigma float64) func(int64) float64 {
+	total := 0.0
+	for x := -int64(40 * sigma); x <= int64(40*sigma); x++ {
+		total += math.Exp(-float64(x*x) / (2 * sigma * sigma))
+	}
+	return func(x int64) float64 {
+		return math.Exp(-float64(x*x)/(2*sigma*sigma)) / total
+	}
+}
+
+func TestGaussTable(t *testing.T) {
+	for _, sigma := range []float64{0.5, 1.5, StdDev, 8.3, 40} {
+		g := NewGaussSampler(sigma)
+		pmf := ideal(sigma)
+
+		// The table is close to the ideal distribution
+		dist := 0.0
+		for x := -2 * g.Bound(); x <= 2*g.Bound(); x++ {
+			dist += math.Abs(g.Prob(x) - pmf(x))
+		}
+		if dist/2 > math.Exp2(-40) {
+			t.Fatalf("Statistical distance %v for sigma = %v", dist/2, sigma)
+		}
+
+		// Extreme inputs map to the ends of the support
+		if g.invert(0) < -g.Bound() || g.invert(math.MaxUint64) > g.Bound() {
+			t.Fatalf("Samples out of bounds for sigma = %v", sigma)
+		}
+	}
+
+	for _, sigma := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Invalid stddev %v accepted", sigma)
+				}
+			}()
+			NewGaussSampler(sigma)
+		}()
+	}
+}
+
+func TestGaussSample(t *testing.T) {
+	const n = 1 << 20
+	for _, sigma := range []float64{1.5, StdDev, 8.3} {
+		g := NewGaussSampler(sigma)
+		pmf := ideal(sigma)
+		samples := make([]int64, n)
+		g.Fill(rand.NewBufPRG(rand.NewPRG(&key)), samples)
+
+		// Bulk and single sampling agree
+		prg := rand.NewBufPRG(rand.NewPRG(&key))
+		for i := 0; i < 1000; i++ {
+			if v := g.Sample(prg); v != samples[i] {
+				t.Fatalf("Sample %v: %v vs. %v", i, v, samples[i])
+			}
+		}
+
+		// Moments match
+		var sum, sumSq float64
+		counts := make(map[int64]float64)
+		for _, v := range samples {
+			sum += float64(v)
+			sumSq += float64(v * v)
+			counts[v]++
+		}
+		mean := sum / n
+		stddev := math.Sqrt(sumSq/n - mean*mean)
+		if math.Abs(mean) > 6*sigma/math.Sqrt(n) || math.Abs(stddev-sigma) > 0.01*sigma {
+			t.Fatalf("Moments for sigma = %v: mean %v, stddev %v", sigma, mean, stddev)
+		}
+
+		// Chi-squared test against the ideal distribution, merging the
+		// tails into one bin so that every bin is expected to be hit
+		var chi2, tailCount, tailExpected float64
+		bins := 0
+		for x := -g.Bound(); x <= g.Bound(); x++ {
+			if expected := n * pmf(x); expected >= 10 {
+				chi2 += (counts[x] - expected) * (counts[x] - expected) / expected
+				bins++
+			} else {
+				tailCount += counts[x]
+				tailExpected += expected
+			}
+		}
+		chi2 += (tailCount - tailExpected) * (tailCount - tailExpected) / tailExpected
+		df := float64(bins)
+		if chi2 > df+6*math.Sqrt(2*df) {
+			t.Fatalf("Chi-squared statistic %v with %v degrees of freedom for sigma = %v", chi2, df, sigma)
+		}
+	}
+}
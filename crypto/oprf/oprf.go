@@ -0,0 +1,323 @@
+package oprf
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+
+	"filippo.io/bigmod"
+	"filippo.io/nistec"
+)
+
+// An oblivious PRF following RFC 9497 in the base mode with the
+// OPRF(P-256, SHA-256) suite:
+//
+//	F_k(x) = H2(x, k * H1(x))
+//
+// where H1 is the hash to curve of RFC 9380 (P256_XMD:SHA-256_SSWU_RO_). The
+// client blinds H1(x) with a random scalar `r` and sends r * H1(x), the server
+// multiplies it by its key `k`, and the client removes the blinding with
+// `r^-1`. The server learns nothing about `x`, and the client learns F_k(x)
+// and nothing else about `k`.
+//
+// Inputs are secret (e.g. the index a client queries), so everything that
+// touches them runs in constant time: points and scalars use `nistec`, and
+// the field arithmetic of the hash to curve uses `bigmod`.
+
+const contextString = "OPRFV1-\x00-P256-SHA256"
+
+// Size of an encoded request or response (a compressed point)
+const PointSize = 33
+
+// Size of a PRF output
+const OutputSize = sha256.Size
+
+const scalarSize = 32
+
+// A server's PRF key
+type Key struct {
+	k *bigmod.Nat
+}
+
+func NewKey(src io.Reader) *Key {
+	return &Key{randScalar(src)}
+}
+
+// Evaluate the PRF on `input` directly
+func (key *Key) Eval(input []byte) []byte {
+	point := scalarMult(hashToCurve(input, hashToGroupDST), key.k)
+	return finalize(input, point)
+}
+
+// Evaluate the PRF on a blinded input produced by `NewBlind`
+func (key *Key) Evaluate(request []byte) ([]byte, error) {
+	// Only accept compressed points, which also rules out the identity
+	if len(request) != PointSize {
+		return nil, fmt.Errorf("invalid OPRF request")
+	}
+	point, err := nistec.NewP256Point().SetBytes(request)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPRF request: %v", err)
+	}
+	return scalarMult(point, key.k).BytesCompressed(), nil
+}
+
+// The client's state for a single blinded input
+type Blind struct {
+	input []byte
+	rInv  *bigmod.Nat
+}
+
+// Blind `input`, returning the state needed to finalize the server's response
+// and the request to send to the server
+func NewBlind(src io.Reader, input []byte) (*Blind, []byte) {
+	r := randScalar(src)
+	point := scalarMult(hashToCurve(input, hashToGroupDST), r)
+	rInv := bigmod.NewNat().Exp(r, orderMinus2, order)
+	return &Blind{input: input, rInv: rInv}, point.BytesCompressed()
+}
+
+// Recover the PRF output from the server's response
+func (b *Blind) Finalize(response []byte) ([]byte, error) {
+	if len(response) != PointSize {
+		return nil, fmt.Errorf("invalid OPRF response")
+	}
+	point, err := nistec.NewP256Point().SetBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPRF response: %v", err)
+	}
+	return finalize(b.input, scalarMult(point, b.rInv)), nil
+}
+
+/*
+* Util Functions
+ */
+
+// A uniform non-zero scalar, by rejection sampling
+func randScalar(src io.Reader) *bigmod.Nat {
+	buf := make([]byte, scalarSize)
+	for {
+		if _, err := io.ReadFull(src, buf); err != nil {
+			panic(err)
+		}
+		k, err := bigmod.NewNat().SetBytes(buf, order)
+		if err == nil && k.IsZero() == 0 {
+			return k
+		}
+	}
+}
+
+func scalarMult(point *nistec.P256Point, k *bigmod.Nat) *nistec.P256Point {
+	out, err := nistec.NewP256Point().ScalarMult(point, k.Bytes(order))
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func finalize(input []byte, point *nistec.P256Point) []byte {
+	if len(input) >= 1<<16 {
+		panic(fmt.Sprintf("OPRF input of %d bytes is too long", len(input)))
+	}
+	element := point.BytesCompressed()
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(input))))
+	h.Write(input)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(element))))
+	h.Write(element)
+	h.Write([]byte("Finalize"))
+	return h.Sum(nil)
+}
+
+/*
+* Hash to curve (RFC 9380)
+ */
+
+var (
+	fieldP = hexInt("ffffffff00000001000000000000000000000000ffffffffffffffffffffffff")
+	orderN = hexInt("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551")
+	curveB = hexInt("5ac635d8aa3a93e7b3ebbd55769886bc651d06b0cc53b0f63bce3c3e27d2604b")
+
+	// The base field and the group order of P-256
+	field = newModulus(fieldP)
+	order = newModulus(orderN)
+
+	// Exponents for inversion, the Legendre symbol and square roots (since
+	// p = 3 mod 4)
+	fieldInv    = new(big.Int).Sub(fieldP, big.NewInt(2)).Bytes()
+	fieldLegend = new(big.Int).Rsh(fieldP, 1).Bytes()
+	fieldSqrt   = new(big.Int).Rsh(new(big.Int).Add(fieldP, big.NewInt(1)), 2).Bytes()
+	orderMinus2 = new(big.Int).Sub(orderN, big.NewInt(2)).Bytes()
+
+	// Constants of the simplified SWU map for y^2 = x^3 + Ax + B with A = -3
+	// and Z = -10
+	feOne  = newElement(big.NewInt(1))
+	feA    = newElement(big.NewInt(-3))
+	feB    = newElement(curveB)
+	feZ    = newElement(big.NewInt(-10))
+	feMBA  = newElement(fieldDiv(new(big.Int).Neg(curveB), big.NewInt(-3))) // -B / A
+	feBZA  = newElement(fieldDiv(curveB, big.NewInt(30)))                   // B / (Z * A)
+	fe2256 = newElement(new(big.Int).Lsh(big.NewInt(1), 256))               // 2^256
+)
+
+const hashToGroupDST = "HashToGroup-" + contextString
+
+// Hash `input` to a curve point with the random oracle encoding under the
+// domain separation tag `dst`
+func hashToCurve(input []byte, dst string) *nistec.P256Point {
+	u := hashToField(input, dst)
+	q0, q1 := mapToCurve(u[0]), mapToCurve(u[1])
+
+	// The sum is the identity with negligible probability, and RFC 9497
+	// rejects such inputs
+	point := q0.Add(q0, q1)
+	if len(point.Bytes()) == 1 {
+		panic("OPRF input hashes to the identity")
+	}
+	return point
+}
+
+// Hash `msg` to two field elements
+func hashToField(msg []byte, dst string) [2]*bigmod.Nat {
+	// Each element is reduced from 48 bytes to make the bias negligible, as
+	// hi * 2^256 + lo
+	uniform := expandMessageXMD(msg, dst, 2*48)
+	var u [2]*bigmod.Nat
+	for i := range u {
+		chunk := uniform[48*i : 48*(i+1)]
+		hi, err := bigmod.NewNat().SetBytes(chunk[:16], field)
+		if err != nil {
+			panic(err)
+		}
+		lo, err := bigmod.NewNat().SetOverflowingBytes(chunk[16:], field)
+		if err != nil {
+			panic(err)
+		}
+		u[i] = hi.Mul(fe2256, field).Add(lo, field)
+	}
+	return u
+}
+
+// expand_message_xmd with SHA-256
+func expandMessageXMD(msg []byte, dst string, length int) []byte {
+	dstPrime := append([]byte(dst), byte(len(dst)))
+	h := sha256.New()
+	h.Write(make([]byte, h.BlockSize()))
+	h.Write(msg)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(length)))
+	h.Write([]byte{0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	out := []byte{}
+	prev := make([]byte, sha256.Size)
+	for i := 1; len(out) < length; i++ {
+		for j := range prev {
+			prev[j] ^= b0[j]
+		}
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		prev = h.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// The simplified SWU map, as straight-line code so that it runs in constant
+// time
+func mapToCurve(u *bigmod.Nat) *nistec.P256Point {
+	zu2 := feMul(feZ, feMul(u, u))
+	tv1 := feExp(feAdd(feMul(zu2, zu2), zu2), fieldInv)
+
+	// x1 = -B/A * (1 + tv1), or B / (Z * A) if tv1 = 0
+	x1 := feSelect(tv1.IsZero(), feMul(feMBA, feAdd(feOne, tv1)), feBZA)
+	gx1 := curveRHS(x1)
+	x2 := feMul(zu2, x1)
+	gx2 := curveRHS(x2)
+
+	// Take x1 if gx1 is square and x2 otherwise
+	square := feExp(gx1, fieldLegend).Equal(feOne) | gx1.IsZero()
+	x := feSelect(square, x2, x1)
+	y := feExp(feSelect(square, gx2, gx1), fieldSqrt)
+
+	// Fix the sign of y to match u
+	y = feSelect(sgn0(u)^sgn0(y), y, feSub(bigmod.NewNat().ExpandFor(field), y))
+
+	encoded := append([]byte{4}, x.Bytes(field)...)
+	point, err := nistec.NewP256Point().SetBytes(append(encoded, y.Bytes(field)...))
+	if err != nil {
+		panic(err)
+	}
+	return point
+}
+
+// x^3 + Ax + B
+func curveRHS(x *bigmod.Nat) *bigmod.Nat {
+	return feAdd(feMul(feAdd(feMul(x, x), feA), x), feB)
+}
+
+func sgn0(x *bigmod.Nat) uint {
+	b := x.Bytes(field)
+	return uint(b[len(b)-1] & 1)
+}
+
+// `y` if `cond` is 1 and `x` if it is 0, as x + cond * (y - x)
+func feSelect(cond uint, x, y *bigmod.Nat) *bigmod.Nat {
+	c, err := bigmod.NewNat().SetBytes([]byte{byte(cond & 1)}, field)
+	if err != nil {
+		panic(err)
+	}
+	return feAdd(x, feMul(c, feSub(y, x)))
+}
+
+func feAdd(x, y *bigmod.Nat) *bigmod.Nat {
+	return bigmod.NewNat().ExpandFor(field).Add(x, field).Add(y, field)
+}
+
+func feSub(x, y *bigmod.Nat) *bigmod.Nat {
+	return bigmod.NewNat().ExpandFor(field).Add(x, field).Sub(y, field)
+}
+
+func feMul(x, y *bigmod.Nat) *bigmod.Nat {
+	return bigmod.NewNat().ExpandFor(field).Add(x, field).Mul(y, field)
+}
+
+func feExp(x *bigmod.Nat, e []byte) *bigmod.Nat {
+	return bigmod.NewNat().Exp(x, e, field)
+}
+
+func hexInt(s string) *big.Int {
+	x, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid constant " + s)
+	}
+	return x
+}
+
+func newModulus(n *big.Int) *bigmod.Modulus {
+	m, err := bigmod.NewModulusFromBig(n)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// A public constant as a field element
+func newElement(x *big.Int) *bigmod.Nat {
+	x = new(big.Int).Mod(x, fieldP)
+	e, err := bigmod.NewNat().SetBytes(x.Bytes(), field)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// x / y for public constants
+func fieldDiv(x, y *big.Int) *big.Int {
+	inv := new(big.Int).ModInverse(new(big.Int).Mod(y, fieldP), fieldP)
+	return new(big.Int).Mul(x, inv)
+}
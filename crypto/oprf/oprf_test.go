@@ -0,0 +1,114 @@
+package oprf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/ryanleh/secure-inference/crypto/rand"
+)
+
+func TestOPRF(t *testing.T) {
+	prg := rand.NewRandomBufPRG()
+	key := NewKey(prg)
+
+	for _, input := range [][]byte{{}, []byte("a"), []byte("some longer input")} {
+		blind, request := NewBlind(prg, input)
+		if len(request) != PointSize {
+			t.Fatalf("Unexpected request size %v", len(request))
+		}
+		response, err := key.Evaluate(request)
+		if err != nil {
+			t.Fatalf("Evaluation failed: %v", err)
+		}
+		output, err := blind.Finalize(response)
+		if err != nil {
+			t.Fatalf("Finalization failed: %v", err)
+		}
+		if len(output) != OutputSize || !bytes.Equal(output, key.Eval(input)) {
+			t.Fatalf("Oblivious evaluation doesn't match the PRF")
+		}
+
+		// Blinding is randomized
+		_, other := NewBlind(prg, input)
+		if bytes.Equal(request, other) {
+			t.Fatalf("Blinded requests should differ")
+		}
+	}
+
+	// Outputs depend on the input and the key
+	if bytes.Equal(key.Eval([]byte("a")), key.Eval([]byte("b"))) {
+		t.Fatalf("Distinct inputs gave the same output")
+	}
+	if bytes.Equal(key.Eval([]byte("a")), NewKey(prg).Eval([]byte("a"))) {
+		t.Fatalf("Distinct keys gave the same output")
+	}
+
+	// Points off the curve are rejected
+	request := make([]byte, PointSize)
+	request[0] = 4
+	if _, err := key.Evaluate(request); err == nil {
+		t.Fatalf("Invalid request accepted")
+	}
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Invalid hex %v", s)
+	}
+	return b
+}
+
+// Test vectors for P256_XMD:SHA-256_SSWU_RO_ from RFC 9380
+func TestHashToCurve(t *testing.T) {
+	dst := "QUUX-V01-CS02-with-P256_XMD:SHA-256_SSWU_RO_"
+	vectors := []struct{ msg, x, y string }{
+		{"", "2c15230b26dbc6fc9a37051158c95b79656e17a1a920b11394ca91c44247d3e4", "8a7a74985cc5c776cdfe4b1f19884970453912e9d31528c060be9ab5c43e8415"},
+		{"abc", "0bb8b87485551aa43ed54f009230450b492fead5f1cc91658775dac4a3388a0f", "5c41b3d0731a27a7b14bc0bf0ccded2d8751f83493404c84a88e71ffd424212e"},
+	}
+	for _, v := range vectors {
+		expected := append([]byte{4}, fromHex(t, v.x+v.y)...)
+		if point := hashToCurve([]byte(v.msg), dst).Bytes(); !bytes.Equal(point, expected) {
+			t.Fatalf("Hash of %q: %x vs. %x", v.msg, point, expected)
+		}
+	}
+}
+
+// Test vectors for OPRF(P-256, SHA-256) from RFC 9497
+func TestVectors(t *testing.T) {
+	key := NewKey(bytes.NewReader(fromHex(t, "159749d750713afe245d2d39ccfaae8381c53ce92d098a9375ee70739c7ac0bf")))
+	blind := "3338fa65ec36e0290022b48eb562889d89dbfa691d1cde91517fa222ed7ad364"
+	vectors := []struct{ input, request, response, output string }{
+		{
+			"00",
+			"03723a1e5c09b8b9c18d1dcbca29e8007e95f14f4732d9346d490ffc195110368d",
+			"030de02ffec47a1fd53efcdd1c6faf5bdc270912b8749e783c7ca75bb412958832",
+			"a0b34de5fa4c5b6da07e72af73cc507cceeb48981b97b7285fc375345fe495dd",
+		},
+		{
+			"5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a",
+			"03cc1df781f1c2240a64d1c297b3f3d16262ef5d4cf102734882675c26231b0838",
+			"03a0395fe3828f2476ffcd1f4fe540e5a8489322d398be3c4e5a869db7fcb7c52c",
+			"c748ca6dd327f0ce85f4ae3a8cd6d4d5390bbb804c9e12dcf94f853fece3dcce",
+		},
+	}
+	for _, v := range vectors {
+		input := fromHex(t, v.input)
+		b, request := NewBlind(bytes.NewReader(fromHex(t, blind)), input)
+		if !bytes.Equal(request, fromHex(t, v.request)) {
+			t.Fatalf("Blinded element: %x vs. %v", request, v.request)
+		}
+		response, err := key.Evaluate(request)
+		if err != nil || !bytes.Equal(response, fromHex(t, v.response)) {
+			t.Fatalf("Evaluated element: %x vs. %v (%v)", response, v.response, err)
+		}
+		output, err := b.Finalize(response)
+		if err != nil || !bytes.Equal(output, fromHex(t, v.output)) {
+			t.Fatalf("Output: %x vs. %v (%v)", output, v.output, err)
+		}
+		if !bytes.Equal(key.Eval(input), output) {
+			t.Fatalf("Direct evaluation doesn't match the output")
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package crypto
 
 import (
+	"fmt"
+	"math"
 	"math/big"
+	"math/bits"
 )
 
 import (
+	"github.com/ryanleh/secure-inference/crypto/lwe"
+	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/crypto/rlwe"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
@@ -17,14 +22,29 @@ type Params struct {
 	LogQ  uint64  // (log of) ciphertext modulus
 	Delta uint64  // Plaintext multiplier
 	Sigma float64 // Error distribution stddev
+
+	Security uint64     // Target security level in bits
+	Secret   SecretDist // Secret distribution
+
+	// Whether DB elements are centered in [-P/2, P/2] rather than [0, P),
+	// which allows a larger `P` for the same number of samples
+	Centered bool
+
+	// Bound on the noise that servers add to answers to flood the error
+	// term, or 0 if answers aren't flooded (see `EnableFlooding`)
+	Flood uint64
 }
 
 type Context[T m.Elem] struct {
 	Params *Params
 
 	// RLWE context for fast queries. This has the same underlying parameters
-	// as the LWE scheme, except the ciphertext modulus is one bit bigger
+	// as the LWE scheme, except the ciphertext modulus is one bit bigger. This
+	// is nil if SEAL doesn't support the secret dimension.
 	RingContext *rlwe.Context[T]
+
+	// Sampler for LWE errors with stddev `Params.Sigma`
+	Sampler *lwe.GaussSampler
 }
 
 /*
@@ -32,18 +52,58 @@ type Context[T m.Elem] struct {
 */
 
 func NewContext[T m.Elem](logq uint64, nSamples uint64, pMod uint64) *Context[T] {
+	return NewContextWithOptions[T](logq, nSamples, pMod, Options{})
+}
+
+// Create a context for a DB with centered elements (see `lhe.DB.Center`)
+func NewCenteredContext[T m.Elem](logq uint64, nSamples uint64, pMod uint64) *Context[T] {
+	return NewContextWithOptions[T](logq, nSamples, pMod, Options{Centered: true})
+}
+
+// Create a context with the security level, secret distribution and DB
+// element range given by `opts`
+func NewContextWithOptions[T m.Elem](logq uint64, nSamples uint64, pMod uint64, opts Options) *Context[T] {
 	// Initialize LWE context
-	lweParams := NewParamsFixedP(logq, nSamples, pMod)
+	lweParams := NewParams(logq, nSamples, pMod, opts)
 	if lweParams == nil {
 		panic("Invalid LWE Parameters")
 	}
 
-	queryCtx := rlwe.NewContext[T](lweParams.P, lweParams.N, true)
-	return &Context[T]{lweParams, queryCtx}
+	// Non-default options can give a secret dimension SEAL doesn't support,
+	// in which case only LWE queries are available
+	var queryCtx *rlwe.Context[T]
+	if rlwe.SupportsRing[T](lweParams.N) {
+		queryCtx = rlwe.NewContext[T](lweParams.P, lweParams.N, true)
+	}
+	return &Context[T]{lweParams, queryCtx, newSampler(lweParams.Sigma)}
+}
+
+// The sampler for stddev `sigma`, sharing the default table if possible
+func newSampler(sigma float64) *lwe.GaussSampler {
+	if sigma == lwe.StdDev {
+		return lwe.DefaultSampler
+	}
+	return lwe.NewGaussSampler(sigma)
+}
+
+// Add an owner of the context, which must also call `Free`
+func (c *Context[T]) Retain() *Context[T] {
+	if c.RingContext != nil {
+		c.RingContext.Retain()
+	}
+	return c
 }
 
+// Release the context once all of its owners have freed it
 func (c *Context[T]) Free() {
-	c.RingContext.Free()
+	if c.RingContext != nil {
+		c.RingContext.Close()
+	}
+}
+
+// The options these parameters were chosen with
+func (p *Params) Options() Options {
+	return Options{Security: p.Security, Secret: p.Secret, Centered: p.Centered}
 }
 
 func (p *Params) Round(x uint64) uint64 {
@@ -51,34 +111,173 @@ func (p *Params) Round(x uint64) uint64 {
 	return v % p.P
 }
 
-func NewParamsFixedP(logq uint64, nSamples uint64, pMod uint64) *Params {
-	if CheckParams(logq, nSamples, pMod) {
-		return newParamsFixedP(logq, nSamples, pMod)
+// The noise of a noisy plaintext `x` mod 2^LogQ, i.e., its signed distance
+// from the nearest multiple of `Delta` (see `Round`)
+func (p *Params) Noise(x uint64) float64 {
+	v := (x + p.Delta/2) / p.Delta
+	if v >= p.P {
+		// `x` rounds to the encoding of 0 at 2^LogQ (the shift is 0 if
+		// LogQ = 64, where the subtraction wraps around instead)
+		return float64(int64(x) - int64(1)<<p.LogQ)
+	}
+	return float64(int64(x - v*p.Delta))
+}
+
+// The noise of `x` under exact rounding of `x * P / 2^LogQ`, as done for
+// RLWE-based queries (see `rlwe.Context.RoundLWEInplace`)
+func (p *Params) ExactNoise(x uint64) float64 {
+	// x * P = k * 2^LogQ + rem, so `x` is rem / P away from k * 2^LogQ / P
+	_, lo := bits.Mul64(x, p.P)
+	rem := int64(lo)
+	if p.LogQ < 64 {
+		rem = int64(lo & (1<<p.LogQ - 1))
+		if rem >= int64(1)<<(p.LogQ-1) {
+			rem -= int64(1) << p.LogQ
+		}
+	}
+	return float64(rem) / float64(p.P)
+}
+
+// Noise of magnitude below `DecryptionBound` always decrypts correctly
+func (p *Params) DecryptionBound() float64 {
+	return float64(p.Delta / 2)
+}
+
+// High-probability bound on the noise of an answer, including any flooding
+// noise
+func (p *Params) NoiseBound() float64 {
+	return p.AnswerErrorBound() + float64(p.Flood)
+}
+
+// Stddev of the noise of an answer over uniform DB elements, including any
+// flooding noise, under the noise model of the plaintext modulus tables
+func (p *Params) NoiseStdDev() float64 {
+	flood := float64(p.Flood)
+	return math.Sqrt(float64(p.M)*elemVariance(p.P, p.Centered)*p.Sigma*p.Sigma + flood*flood/3)
+}
+
+// Noise beyond which an entry likely decrypted incorrectly: the noise of a
+// correctly decrypted entry only exceeds it with probability `SuspectProb`.
+// Since the plaintext modulus tables allow noise up to `DecryptionBound` with
+// probability `FailureProb`, this is below `DecryptionBound` at the largest
+// supported moduli.
+func (p *Params) SuspectBound() float64 {
+	return p.NoiseStdDev() * tailBound(SuspectProb)
+}
+
+// Statistical security parameter for noise flooding: the flooding noise hides
+// the error terms of an answer up to statistical distance 2^-FloodingSecurity,
+// and each error term exceeds its bound with probability at most
+// 2^-FloodingSecurity.
+const FloodingSecurity = 40
+
+// High-probability bound on the error term `D * e` of an answer over a DB with
+// elements in [0, P) (or [-P/2, P/2] if centered), where `e` is the error of a
+// query
+func (p *Params) AnswerErrorBound() float64 {
+	tail := math.Sqrt(2 * FloodingSecurity * math.Ln2)
+	elem := float64(p.P)
+	if p.Centered {
+		elem /= 2
 	}
+	return elem * p.Sigma * math.Sqrt(float64(p.M)) * tail
+}
 
+// Enable noise flooding for answers with `rows` entries: servers add uniform
+// noise in [-Flood, Flood] to every entry, which statistically hides `D * e`
+// and so reveals nothing about the DB beyond the linear function being
+// evaluated. The statistical distances of the entries add up, so each entry is
+// flooded to within 2^-FloodingSecurity / rows. Returns an error if the flooded
+// answers would no longer decrypt correctly, in which case a smaller plaintext
+// modulus is needed (see `MaxFloodingP`).
+func (p *Params) EnableFlooding(rows uint64) error {
+	bound := p.AnswerErrorBound()
+	flood := math.Ceil(bound * math.Exp2(FloodingSecurity) * float64(max(rows, 1)))
+	if flood+bound >= float64(p.Delta/2) {
+		return fmt.Errorf("flooding noise %v exceeds the decryption bound %v", flood+bound, p.Delta/2)
+	}
+	p.Flood = uint64(flood)
 	return nil
 }
 
-func CheckParams(logq uint64, nSamples uint64, pMod uint64) bool {
-	options := pMod32
-	if logq == 64 {
-		options = pMod64
+// Sample flooding noise uniformly from [-Flood, Flood]
+func (p *Params) FloodingNoise(prg *rand.BufPRGReader) int64 {
+	width := 2*p.Flood + 1
+	limit := math.MaxUint64 - math.MaxUint64%width
+	for {
+		if v := prg.Uint64(); v < limit {
+			return int64(v%width) - int64(p.Flood)
+		}
 	}
+}
 
-	for mNew, pNew := range options {
-		if nSamples <= mNew && pMod <= pNew {
-			return true
+// The largest plaintext modulus for which answers with `rows` entries over
+// `nSamples` columns can be flooded (see `EnableFlooding`), or 0 if there is
+// none
+func MaxFloodingP(logq uint64, nSamples uint64, rows uint64) uint64 {
+	params := newParams(logq, nSamples, 2, Options{})
+	for params.P = 2; ; params.P++ {
+		b := new(big.Int).Lsh(big.NewInt(1), uint(logq))
+		params.Delta = b.Div(b, big.NewInt(int64(params.P))).Uint64()
+		if params.EnableFlooding(rows) != nil {
+			if params.P == 2 {
+				return 0
+			}
+			return params.P - 1
 		}
 	}
+}
+
+func NewParamsFixedP(logq uint64, nSamples uint64, pMod uint64) *Params {
+	return NewParams(logq, nSamples, pMod, Options{})
+}
+
+func CheckParams(logq uint64, nSamples uint64, pMod uint64) bool {
+	return CheckParamsWithOptions(logq, nSamples, pMod, Options{})
+}
+
+// Parameters for a DB with centered elements, which support a larger `pMod`
+func NewParamsCentered(logq uint64, nSamples uint64, pMod uint64) *Params {
+	return NewParams(logq, nSamples, pMod, Options{Centered: true})
+}
+
+func CheckParamsCentered(logq uint64, nSamples uint64, pMod uint64) bool {
+	return CheckParamsWithOptions(logq, nSamples, pMod, Options{Centered: true})
+}
+
+// Parameters with the security level, secret distribution and DB element
+// range given by `opts`, or nil if `pMod` is too large for `nSamples`
+func NewParams(logq uint64, nSamples uint64, pMod uint64, opts Options) *Params {
+	if CheckParamsWithOptions(logq, nSamples, pMod, opts) {
+		return newParams(logq, nSamples, pMod, opts)
+	}
+
+	return nil
+}
 
-	return false
+func CheckParamsWithOptions(logq uint64, nSamples uint64, pMod uint64, opts Options) bool {
+	maxPMod, err := MaxPMod(logq, secretDim(logq, opts), errorStdDev, nSamples, FailureProb, opts)
+	return err == nil && pMod <= maxPMod
+}
+
+// The secret dimension for ciphertext modulus 2^logq: the dimension of the
+// SEAL ring for the default options if there is one, and the smallest secure
+// dimension otherwise
+func secretDim(logq uint64, opts Options) uint64 {
+	if n, ok := secretDims[logq]; ok && opts.Secret == Gaussian && opts.security() == SecurityLevel {
+		return n
+	}
+	return SecretDim(logq, errorStdDev, opts.Secret, opts.security())
 }
 
-func newParamsFixedP(logq uint64, nSamples uint64, pMod uint64) *Params {
+func newParams(logq uint64, nSamples uint64, pMod uint64, opts Options) *Params {
 	p := &Params{
-		LogQ: logq,
-		M:    nSamples,
-		P:    pMod,
+		LogQ:     logq,
+		M:        nSamples,
+		P:        pMod,
+		Security: opts.security(),
+		Secret:   opts.Secret,
+		Centered: opts.Centered,
 	}
 
 	b := big.NewInt(int64(1))
@@ -87,7 +286,7 @@ func newParamsFixedP(logq uint64, nSamples uint64, pMod uint64) *Params {
 	b.Div(b, pInt)
 	p.Delta = uint64(b.Int64())
 
-	p.N = secretDims[logq]
+	p.N = secretDim(logq, opts)
 	p.Sigma = errorStdDev
 	return p
 }
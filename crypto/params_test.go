@@ -0,0 +1,286 @@
+package crypto
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/ryanleh/secure-inference/crypto/rand"
+)
+
+func TestFlooding(t *testing.T) {
+	for _, logq := range []uint64{32, 64} {
+		nSamples, rows := uint64(1<<12), uint64(1<<10)
+		pMod := MaxFloodingP(logq, nSamples, rows)
+		if logq == 32 && pMod != 0 {
+			t.Fatalf("Unexpected flooding modulus %v for q = 2^32", pMod)
+		}
+		if logq == 64 && pMod < 2 {
+			t.Fatalf("No flooding modulus for q = 2^64")
+		}
+
+		// The default moduli are too large to flood
+		params := newParams(logq, nSamples, pMod32[nSamples], Options{})
+		if logq == 64 {
+			params = newParams(logq, nSamples, pMod64[nSamples], Options{})
+		}
+		if params.EnableFlooding(rows) == nil || params.Flood != 0 {
+			t.Fatalf("Flooding enabled with P = %v", params.P)
+		}
+		if pMod == 0 {
+			continue
+		}
+
+		params = newParams(logq, nSamples, pMod, Options{})
+		if err := params.EnableFlooding(rows); err != nil {
+			t.Fatalf("Flooding failed with P = %v: %v", pMod, err)
+		}
+
+		// The noise hides each entry to within 2^-40 / rows
+		if distance := params.AnswerErrorBound() / float64(params.Flood); distance > math.Exp2(-FloodingSecurity)/float64(rows) {
+			t.Fatalf("Flooding distance %v for %v rows", distance, rows)
+		}
+		if float64(params.Flood)+params.AnswerErrorBound() >= float64(params.Delta/2) {
+			t.Fatalf("Flooding breaks decryption")
+		}
+		if err := newParams(logq, nSamples, pMod+1, Options{}).EnableFlooding(rows); err == nil {
+			t.Fatalf("P = %v is not the largest modulus", pMod)
+		}
+
+		// Noise is within the bound and uses both signs
+		prg := rand.NewRandomBufPRG()
+		neg, pos := false, false
+		for range 1000 {
+			noise := params.FloodingNoise(prg)
+			if noise < -int64(params.Flood) || noise > int64(params.Flood) {
+				t.Fatalf("Noise %v out of range", noise)
+			}
+			neg, pos = neg || noise < 0, pos || noise > 0
+		}
+		if !neg || !pos {
+			t.Fatalf("Noise is not centered")
+		}
+	}
+}
+
+func TestCenteredParams(t *testing.T) {
+	for logq, tables := range map[uint64][2]map[uint64]uint64{32: {pMod32, pMod32Centered}, 64: {pMod64, pMod64Centered}} {
+		for nSamples, pMod := range tables[0] {
+			centered := tables[1][nSamples]
+			if centered <= pMod {
+				t.Fatalf("Centered modulus %v not above %v", centered, pMod)
+			}
+			if CheckParams(logq, nSamples, centered) || !CheckParamsCentered(logq, nSamples, centered) {
+				t.Fatalf("Unexpected support for P = %v with %v samples", centered, nSamples)
+			}
+		}
+	}
+
+	// Centering halves the error bound
+	params := NewParamsCentered(32, 1<<10, 3000)
+	if params == nil || !params.Centered {
+		t.Fatalf("Expected centered parameters")
+	}
+	plain := newParams(32, 1<<10, 3000, Options{})
+	if params.AnswerErrorBound()*2 != plain.AnswerErrorBound() {
+		t.Fatalf("Unexpected error bound: %v vs. %v", params.AnswerErrorBound(), plain.AnswerErrorBound())
+	}
+}
+
+func TestEstimator(t *testing.T) {
+	// The fixed secret dimensions are secure, and security grows with the
+	// dimension and shrinks with the modulus
+	for logq, n := range secretDims {
+		if bits := EstimateSecurity(n, logq, errorStdDev, Gaussian); bits < SecurityLevel {
+			t.Fatalf("n = %v, q = 2^%v only has %v bits of security", n, logq, bits)
+		}
+		if EstimateSecurity(n/2, logq, errorStdDev, Gaussian) >= EstimateSecurity(n, logq, errorStdDev, Gaussian) {
+			t.Fatalf("Security doesn't grow with the dimension")
+		}
+		if EstimateSecurity(n, logq+8, errorStdDev, Gaussian) >= EstimateSecurity(n, logq, errorStdDev, Gaussian) {
+			t.Fatalf("Security doesn't shrink with the modulus")
+		}
+		if dim := SecretDim(logq, errorStdDev, Gaussian, SecurityLevel); dim > n || EstimateSecurity(dim/2, logq, errorStdDev, Gaussian) >= SecurityLevel {
+			t.Fatalf("SecretDim(%v) = %v is not minimal", logq, dim)
+		}
+		if _, err := MaxPMod(logq, n/4, errorStdDev, 1<<10, FailureProb, Options{}); err == nil {
+			t.Fatalf("Insecure parameters accepted")
+		}
+	}
+
+	// The largest modulus is tight, and shrinks with the number of samples
+	// and the failure probability
+	for _, logq := range []uint64{32, 48, 64} {
+		n := secretDim(logq, Options{})
+		prev := uint64(math.MaxUint64)
+		for _, nSamples := range []uint64{1 << 8, 1 << 12, 1 << 16, 3 << 16} {
+			pMod, err := MaxPMod(logq, n, errorStdDev, nSamples, FailureProb, Options{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if pMod >= prev {
+				t.Fatalf("Modulus doesn't shrink with samples: %v vs. %v", pMod, prev)
+			}
+			if !CheckParams(logq, nSamples, pMod) || CheckParams(logq, nSamples, pMod+1) {
+				t.Fatalf("P = %v is not the largest modulus for %v samples", pMod, nSamples)
+			}
+			if strict, _ := MaxPMod(logq, n, errorStdDev, nSamples, FailureProb/1024, Options{}); strict >= pMod {
+				t.Fatalf("Modulus doesn't shrink with the failure probability")
+			}
+			prev = pMod
+		}
+	}
+
+	// Arbitrary moduli get secure parameters
+	if params := NewParamsFixedP(48, 1<<12, 1<<16); params == nil || EstimateSecurity(params.N, 48, params.Sigma, Gaussian) < SecurityLevel {
+		t.Fatalf("No secure parameters for q = 2^48")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, logq := range []uint64{32, 64} {
+		// Narrower secrets and higher security levels need larger dimensions
+		n := SecretDim(logq, errorStdDev, Gaussian, SecurityLevel)
+		for _, secret := range []SecretDist{Ternary, Binary} {
+			if EstimateSecurity(n, logq, errorStdDev, secret) >= EstimateSecurity(n, logq, errorStdDev, Gaussian) {
+				t.Fatalf("Secret %v is as secure as gaussian secrets", secret)
+			}
+			if SecretDim(logq, errorStdDev, secret, SecurityLevel) < n {
+				t.Fatalf("Secret %v needs a smaller dimension", secret)
+			}
+		}
+		if SecretDim(logq, errorStdDev, Gaussian, 256) <= n {
+			t.Fatalf("256-bit security doesn't need a larger dimension")
+		}
+
+		// Parameters are chosen to match the options, with the same moduli
+		for _, opts := range []Options{
+			{Secret: Ternary},
+			{Secret: Binary, Centered: true},
+			{Security: 256},
+		} {
+			params := NewParams(logq, 1<<10, 2, opts)
+			if params == nil {
+				t.Fatalf("No parameters for %+v", opts)
+			}
+			if params.Options() != (Options{Security: opts.security(), Secret: opts.Secret, Centered: opts.Centered}) {
+				t.Fatalf("Unexpected options %+v", params.Options())
+			}
+			if params.N != SecretDim(logq, errorStdDev, opts.Secret, opts.security()) {
+				t.Fatalf("Unexpected dimension %v", params.N)
+			}
+			if EstimateSecurity(params.N, logq, params.Sigma, params.Secret) < float64(opts.security()) {
+				t.Fatalf("Insecure parameters for %+v", opts)
+			}
+			maxPMod, err := MaxPMod(logq, params.N, errorStdDev, 1<<10, FailureProb, opts)
+			if err != nil || !CheckParamsWithOptions(logq, 1<<10, maxPMod, opts) || CheckParamsWithOptions(logq, 1<<10, maxPMod+1, opts) {
+				t.Fatalf("Modulus %v is not the largest for %+v", maxPMod, opts)
+			}
+		}
+	}
+
+	// The default options use the SEAL ring dimensions
+	if params := NewParamsFixedP(32, 1<<10, 2); params.N != secretDims[32] || params.Security != SecurityLevel {
+		t.Fatalf("Unexpected default parameters: %+v", params)
+	}
+}
+
+func TestNoise(t *testing.T) {
+	prg := rand.NewRandomBufPRG()
+	for _, logq := range []uint64{32, 64} {
+		params := newParams(logq, 1<<10, 1<<8, Options{})
+		q := new(big.Int).Lsh(big.NewInt(1), uint(logq))
+		for range 1000 {
+			v := prg.Uint64() % params.P
+			e := int64(prg.Uint64()%params.Delta) - int64(params.Delta/2)
+
+			// Noise around multiples of `Delta`, wrapping around mod 2^logq
+			x := big.NewInt(int64(v))
+			x.Mul(x, new(big.Int).SetUint64(params.Delta))
+			x.Add(x, big.NewInt(e))
+			x.Mod(x, q)
+			if params.Noise(x.Uint64()) != float64(e) || params.Round(x.Uint64()) != v {
+				t.Fatalf("Noise %v of %v recovered as %v", e, v, params.Noise(x.Uint64()))
+			}
+
+			// Noise around `v * 2^logq / P`
+			exact := new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(int64(v)), q), new(big.Int).SetUint64(params.P))
+			x = new(big.Int).Quo(exact.Num(), exact.Denom())
+			x.Add(x, big.NewInt(e/2))
+			expected, _ := new(big.Rat).Sub(new(big.Rat).SetInt(x), exact).Float64()
+			x.Mod(x, q)
+			if noise := params.ExactNoise(x.Uint64()); math.Abs(noise-expected) > 1e-6*math.Abs(expected)+1e-9 {
+				t.Fatalf("Exact noise %v recovered as %v", expected, noise)
+			}
+		}
+	}
+
+	// Flooding noise is within the noise bound
+	params := newParams(64, 1<<10, 1<<4, Options{})
+	bound := params.NoiseBound()
+	if err := params.EnableFlooding(1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if params.NoiseBound() <= bound || params.NoiseBound() >= params.DecryptionBound() {
+		t.Fatalf("Unexpected noise bound %v", params.NoiseBound())
+	}
+
+	// At the largest supported moduli, noise near the rounding boundary is
+	// flagged as a likely failure
+	for logq, table := range map[uint64]map[uint64]uint64{32: PMod32, 64: PMod64} {
+		for nSamples, pMod := range table {
+			if pMod == 0 {
+				continue
+			}
+			params := NewParamsFixedP(logq, nSamples, pMod)
+			if suspect := params.SuspectBound(); suspect >= params.DecryptionBound() || suspect < params.DecryptionBound()/2 {
+				t.Fatalf("Suspect bound %v with decryption bound %v", suspect, params.DecryptionBound())
+			}
+		}
+	}
+}
+
+// The committed tables are up to date (see `go generate`)
+func TestTables(t *testing.T) {
+	tables := []struct {
+		table  map[uint64]uint64
+		logq   uint64
+		lo, hi int
+		opts   Options
+	}{
+		{pMod32, 32, 7, 20, Options{}},
+		{pMod64, 64, 12, 20, Options{}},
+		{pMod32Centered, 32, 7, 20, Options{Centered: true}},
+		{pMod64Centered, 64, 12, 20, Options{Centered: true}},
+	}
+	for _, tt := range tables {
+		expected, err := PModTable(tt.logq, tt.lo, tt.hi, tt.opts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(expected) != len(tt.table) {
+			t.Fatalf("Table for q = 2^%v has %v entries instead of %v", tt.logq, len(tt.table), len(expected))
+		}
+		for nSamples, pMod := range expected {
+			if tt.table[nSamples] != pMod {
+				t.Fatalf("Stale modulus for q = 2^%v and %v samples: %v vs. %v", tt.logq, nSamples, tt.table[nSamples], pMod)
+			}
+		}
+	}
+
+	// The noise bound reproduces the previously published moduli, up to the
+	// tail bound they were computed with
+	published := []struct {
+		table    map[uint64]uint64
+		nSamples uint64
+		pMod     uint64
+	}{
+		{pMod32, 1 << 10, 2185},
+		{pMod64, 1 << 12, 101290040},
+	}
+	for _, p := range published {
+		if diff := math.Abs(float64(p.table[p.nSamples])/float64(p.pMod) - 1); diff > 0.005 {
+			t.Fatalf("Modulus for %v samples is %v, published as %v", p.nSamples, p.table[p.nSamples], p.pMod)
+		}
+	}
+}
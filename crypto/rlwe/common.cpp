@@ -32,7 +32,18 @@ skey_t *key_new(context_t *ctx) {
     return new skey_s(*(ctx->ctx->context));
 }
 
+// Overwrite the coefficients of a secret key
+static void key_zero(SecretKey &sk) {
+    auto &pt = sk.data();
+    util::seal_memzero(pt.data(), pt.coeff_count() * sizeof(Plaintext::pt_coeff_type));
+}
+
 void key_free(skey_t *key) {
+    // Zeroize the key before releasing its memory, including the copy held by
+    // the key generator. SEAL allocates the copies held by the encryptor and
+    // decryptor from memory pools that are cleared on destruction.
+    key_zero(key->key.sk);
+    key_zero(const_cast<SecretKey &>(key->key.keygen.secret_key()));
     delete key;
 }
 
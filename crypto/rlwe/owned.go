@@ -0,0 +1,101 @@
+package rlwe
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// Ownership of SEAL objects: every object wrapping a C++ allocation starts
+// with a single owner, who releases it with `Close`. Objects shared between
+// several owners are reference counted: each additional owner takes a
+// reference with `Retain`, every owner closes the object exactly once, and the
+// allocation is released when the last owner closes it. Using an object after
+// it has been released panics.
+//
+// Objects that become unreachable without being closed are released by a
+// finalizer as a safety net, and counted as leaks (see `Leaked`).
+
+var (
+	live   atomic.Int64
+	leaked atomic.Int64
+)
+
+// The number of SEAL objects currently allocated
+func Live() int64 {
+	return live.Load()
+}
+
+// The number of SEAL objects that were released by a finalizer rather than
+// closed
+func Leaked() int64 {
+	return leaked.Load()
+}
+
+// Reference count of an object wrapping a C++ allocation
+type owned struct {
+	refs    atomic.Int64
+	release func()
+}
+
+func (o *owned) owner() *owned {
+	return o
+}
+
+type resource interface {
+	owner() *owned
+}
+
+// Start tracking `r` with a single owner. `release` frees the underlying
+// allocation, and must not reference `r` so that `r` can be collected.
+func track[R resource](r R, release func()) R {
+	o := r.owner()
+	o.refs.Store(1)
+	o.release = release
+	live.Add(1)
+	runtime.SetFinalizer(r, func(r R) {
+		if r.owner().refs.Swap(0) > 0 {
+			leaked.Add(1)
+			live.Add(-1)
+			r.owner().release()
+		}
+	})
+	return r
+}
+
+// Add an owner
+func (o *owned) retain() {
+	for {
+		n := o.refs.Load()
+		if n == 0 {
+			panic("Retaining a released SEAL object")
+		}
+		if o.refs.CompareAndSwap(n, n+1) {
+			return
+		}
+	}
+}
+
+// Drop an owner, releasing the allocation once there are none left. Dropping
+// a released object is a no-op.
+func (o *owned) drop() {
+	for {
+		n := o.refs.Load()
+		if n == 0 {
+			return
+		}
+		if o.refs.CompareAndSwap(n, n-1) {
+			if n == 1 {
+				live.Add(-1)
+				o.release()
+			}
+			return
+		}
+	}
+}
+
+// Panic if the allocation has been released
+func (o *owned) check() {
+	if o.refs.Load() == 0 {
+		panic("Use of a released SEAL object")
+	}
+}
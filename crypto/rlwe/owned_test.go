@@ -0,0 +1,59 @@
+package rlwe
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type resourceStub struct {
+	owned
+}
+
+func TestOwned(t *testing.T) {
+	live := Live()
+	released := 0
+	r := track(&resourceStub{}, func() { released++ })
+	if Live() != live+1 {
+		t.Fatalf("Object not counted as live")
+	}
+
+	// Shared objects are released by their last owner
+	r.retain()
+	r.drop()
+	if released != 0 {
+		t.Fatalf("Released with an owner left")
+	}
+	r.drop()
+	r.drop()
+	if released != 1 || Live() != live {
+		t.Fatalf("Released %v times", released)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Use after release not detected")
+			}
+		}()
+		r.check()
+	}()
+}
+
+func TestLeaked(t *testing.T) {
+	leaked := Leaked()
+	var released atomic.Int64
+	func() {
+		track(&resourceStub{}, func() { released.Add(1) })
+	}()
+
+	// Unreachable objects are eventually released by their finalizer
+	for i := 0; i < 100 && released.Load() == 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if released.Load() != 1 || Leaked() != leaked+1 {
+		t.Fatalf("Leaked object not released")
+	}
+}
@@ -15,6 +15,7 @@ import "C"
 
 import (
 	"math"
+	"runtime"
 	"unsafe"
 
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -22,17 +23,31 @@ import (
 
 const SealSeedLength = 8
 
+// All types below wrap C++ allocations, and must be closed by their owners
+// (see owned.go)
+
 type Context[T m.Elem] struct {
+	owned
 	ctx *C.context_t
 }
 
-type Ciphertext C.ciphertext_t
+type Ciphertext struct {
+	owned
+	ct *C.ciphertext_t
+}
 
-type Plaintext C.plaintext_t
+type Plaintext struct {
+	owned
+	pt *C.plaintext_t
+}
 
-type A C.a_t
+type A struct {
+	owned
+	a *C.a_t
+}
 
 type Key struct {
+	owned
 	key *C.skey_t
 }
 
@@ -49,26 +64,59 @@ func NewContext[T m.Elem](pMod, n uint64, mod_switch bool) *Context[T] {
 		pMod = 95640378
 	}
 
-	return &Context[T]{
-		ctx: C.ctx_new(
-			C.uint64_t(pMod),
-			C.uint64_t(n),
-			C.uint64_t(T(0).Bitlen()),
-			C.bool(mod_switch),
-		),
+	ctx := C.ctx_new(
+		C.uint64_t(pMod),
+		C.uint64_t(n),
+		C.uint64_t(T(0).Bitlen()),
+		C.bool(mod_switch),
+	)
+	return track(&Context[T]{ctx: ctx}, func() { C.ctx_free(ctx) })
+}
+
+// Largest coefficient modulus SEAL accepts for each ring dimension at 128-bit
+// security
+var sealMaxBits = map[uint64]uint64{
+	2048:  54,
+	4096:  109,
+	8192:  218,
+	16384: 438,
+	32768: 881,
+}
+
+// Whether SEAL supports ring dimension `n` with the coefficient modulus of `T`
+// (see `CryptoContext`). `NewContext` aborts the process for any other `n`.
+func SupportsRing[T m.Elem](n uint64) bool {
+	bits := uint64(33)
+	if T(0).Bitlen() == 64 {
+		bits = 32 + 33 + 33
 	}
+	max, ok := sealMaxBits[n]
+	return ok && bits <= max
+}
+
+// Add an owner of the context
+func (ctx *Context[T]) Retain() *Context[T] {
+	ctx.retain()
+	return ctx
+}
+
+func (ctx *Context[T]) Close() {
+	ctx.drop()
 }
 
-func (ctx *Context[T]) Free() {
-	C.ctx_free(ctx.ctx)
+func (ctx *Context[T]) c() *C.context_t {
+	ctx.check()
+	return ctx.ctx
 }
 
 func (ctx *Context[T]) N() uint64 {
-	return uint64(C.ctx_n(ctx.ctx))
+	defer runtime.KeepAlive(ctx)
+	return uint64(C.ctx_n(ctx.c()))
 }
 
 func (ctx *Context[T]) P() uint64 {
-	return uint64(C.ctx_p(ctx.ctx))
+	defer runtime.KeepAlive(ctx)
+	return uint64(C.ctx_p(ctx.c()))
 }
 
 /*
@@ -76,17 +124,24 @@ func (ctx *Context[T]) P() uint64 {
  */
 
 func (ctx *Context[T]) NewKey() *Key {
-	return &Key{
-		key: C.key_new(ctx.ctx),
-	}
+	defer runtime.KeepAlive(ctx)
+	key := C.key_new(ctx.c())
+	return track(&Key{key: key}, func() { C.key_free(key) })
+}
+
+// Zeroize and release the key
+func (key *Key) Close() {
+	key.drop()
 }
 
-func (key *Key) Free() {
-	C.key_free(key.key)
+func (key *Key) c() *C.skey_t {
+	key.check()
+	return key.key
 }
 
 func (key *Key) Size() int {
-	return int(C.key_size(key.key))
+	defer runtime.KeepAlive(key)
+	return int(C.key_size(key.c()))
 }
 
 /*
@@ -94,14 +149,22 @@ func (key *Key) Size() int {
  */
 
 func NewCiphertext() *Ciphertext {
-	return (*Ciphertext)(C.ct_new())
+	ct := C.ct_new()
+	return track(&Ciphertext{ct: ct}, func() { C.ct_free(ct) })
 }
 
-func (ct *Ciphertext) Free() {
-	C.ct_free((*C.ciphertext_t)(ct))
+func (ct *Ciphertext) Close() {
+	ct.drop()
 }
+
+func (ct *Ciphertext) c() *C.ciphertext_t {
+	ct.check()
+	return ct.ct
+}
+
 func (ct *Ciphertext) Size() int {
-	return int(C.ct_size((*C.ciphertext_t)(ct)))
+	defer runtime.KeepAlive(ct)
+	return int(C.ct_size(ct.c()))
 }
 
 /*
@@ -112,11 +175,24 @@ func NewA(key *Key, seed []uint64) *A {
 	if len(seed) != 8 {
 		panic("SEAL seed must be 512-bits")
 	}
-	return (*A)(C.a_new(key.key, (*C.uint64_t)(&seed[0])))
+	defer runtime.KeepAlive(key)
+	a := C.a_new(key.c(), (*C.uint64_t)(&seed[0]))
+	return track(&A{a: a}, func() { C.a_free(a) })
 }
 
-func (a *A) Free() {
-	C.a_free((*C.a_t)(a))
+// Add an owner of the polynomial
+func (a *A) Retain() *A {
+	a.retain()
+	return a
+}
+
+func (a *A) Close() {
+	a.drop()
+}
+
+func (a *A) c() *C.a_t {
+	a.check()
+	return a.a
 }
 
 /*
@@ -124,25 +200,33 @@ func (a *A) Free() {
  */
 
 func NewPlaintext() *Plaintext {
-	return (*Plaintext)(C.pt_new())
+	pt := C.pt_new()
+	return track(&Plaintext{pt: pt}, func() { C.pt_free(pt) })
+}
+
+func (pt *Plaintext) c() *C.plaintext_t {
+	pt.check()
+	return pt.pt
 }
 
 func (pt *Plaintext) Set(vals []uint64) {
-	C.pt_set_64((*C.plaintext_t)(pt), (*C.uint64_t)(&vals[0]), C.size_t(len(vals)))
+	defer runtime.KeepAlive(pt)
+	C.pt_set_64(pt.c(), (*C.uint64_t)(&vals[0]), C.size_t(len(vals)))
 }
 
 // Work-around to set plaintext from genericly-typed values
 func GenericSet[T m.Elem](pt *Plaintext, vals []T) {
+	defer runtime.KeepAlive(pt)
 	switch T(0).Bitlen() {
 	case 32:
 		C.pt_set_32(
-			(*C.plaintext_t)(pt),
+			pt.c(),
 			(*C.uint32_t)(unsafe.Pointer(&vals[0])),
 			C.size_t(len(vals)),
 		)
 	case 64:
 		C.pt_set_64(
-			(*C.plaintext_t)(pt),
+			pt.c(),
 			(*C.uint64_t)(unsafe.Pointer(&vals[0])),
 			C.size_t(len(vals)),
 		)
@@ -151,8 +235,8 @@ func GenericSet[T m.Elem](pt *Plaintext, vals []T) {
 	}
 }
 
-func (pt *Plaintext) Free() {
-	C.pt_free((*C.plaintext_t)(pt))
+func (pt *Plaintext) Close() {
+	pt.drop()
 }
 
 /*
@@ -167,12 +251,13 @@ func (pt *Plaintext) Free() {
 // "transpose" operator on a polynomial here corresponds to a substitution
 // operation.
 func (ctx *Context[T]) ComputeHint(matrix *m.Matrix[m.Elem32], seeds []uint64, numSeeds int) *m.Matrix[T] {
+	defer runtime.KeepAlive(ctx)
 	hint := m.New[T](matrix.Rows(), ctx.N())
 
 	switch T(0).Bitlen() {
 	case 32:
 		C.mul_matrix_As_32(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint32_t)(unsafe.Pointer(&matrix.Data()[0])), //TODO
 			(*C.uint64_t)(&seeds[0]),
 			(*C.uint32_t)(unsafe.Pointer(&hint.Data()[0])),
@@ -182,7 +267,7 @@ func (ctx *Context[T]) ComputeHint(matrix *m.Matrix[m.Elem32], seeds []uint64, n
 		)
 	case 64:
 		C.mul_matrix_As_64(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint32_t)(unsafe.Pointer(&matrix.Data()[0])), //TODO
 			(*C.uint64_t)(&seeds[0]),
 			(*C.uint64_t)(unsafe.Pointer(&hint.Data()[0])),
@@ -197,19 +282,21 @@ func (ctx *Context[T]) ComputeHint(matrix *m.Matrix[m.Elem32], seeds []uint64, n
 }
 
 func (ctx *Context[T]) ExtractLWEKey(key *Key) *m.Matrix[T] {
+	defer runtime.KeepAlive(ctx)
+	defer runtime.KeepAlive(key)
 	skLWE := m.New[T](ctx.N(), 1)
 
 	switch T(0).Bitlen() {
 	case 32:
 		C.key_extract_lwe_32(
-			ctx.ctx,
-			(*C.skey_t)(key.key),
+			ctx.c(),
+			key.c(),
 			(*C.uint32_t)(unsafe.Pointer(&skLWE.Data()[0])),
 		)
 	case 64:
 		C.key_extract_lwe_64(
-			ctx.ctx,
-			(*C.skey_t)(key.key),
+			ctx.c(),
+			key.c(),
 			(*C.uint64_t)(unsafe.Pointer(&skLWE.Data()[0])),
 		)
 	default:
@@ -219,12 +306,13 @@ func (ctx *Context[T]) ExtractLWEKey(key *Key) *m.Matrix[T] {
 }
 
 func (ctx *Context[T]) ExtractLWECt(in []byte, samples uint64) *m.Matrix[T] {
+	defer runtime.KeepAlive(ctx)
 	ctLWE := m.New[T](samples, 1)
 
 	switch T(0).Bitlen() {
 	case 32:
 		C.ct_extract_lwe_32(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint8_t)(&in[0]),
 			C.size_t(len(in)),
 			(C.uint64_t)(samples),
@@ -232,7 +320,7 @@ func (ctx *Context[T]) ExtractLWECt(in []byte, samples uint64) *m.Matrix[T] {
 		)
 	case 64:
 		C.ct_extract_lwe_64(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint8_t)(&in[0]),
 			C.size_t(len(in)),
 			(C.uint64_t)(samples),
@@ -245,10 +333,11 @@ func (ctx *Context[T]) ExtractLWECt(in []byte, samples uint64) *m.Matrix[T] {
 }
 
 func (ctx *Context[T]) ExtractLWECtGPU(in []byte, samples uint64, out unsafe.Pointer, offset int) {
+	defer runtime.KeepAlive(ctx)
 	switch T(0).Bitlen() {
 	case 32:
 		C.ct_extract_lwe_32(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint8_t)(&in[0]),
 			C.size_t(len(in)),
 			(C.uint64_t)(samples),
@@ -256,7 +345,7 @@ func (ctx *Context[T]) ExtractLWECtGPU(in []byte, samples uint64, out unsafe.Poi
 		)
 	case 64:
 		C.ct_extract_lwe_64(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint8_t)(&in[0]),
 			C.size_t(len(in)),
 			(C.uint64_t)(samples),
@@ -268,14 +357,20 @@ func (ctx *Context[T]) ExtractLWECtGPU(in []byte, samples uint64, out unsafe.Poi
 }
 
 func (key *Key) PreprocessEnc(a *A, ct *Ciphertext) {
-	C.key_preprocess_enc(key.key, (*C.a_t)(a), (*C.ciphertext_t)(ct))
+	defer runtime.KeepAlive(key)
+	defer runtime.KeepAlive(a)
+	defer runtime.KeepAlive(ct)
+	C.key_preprocess_enc(key.c(), a.c(), ct.c())
 }
 
 func (ctx *Context[T]) EncryptPreprocessed(key *Key, input []T, ct *Ciphertext) {
+	defer runtime.KeepAlive(ctx)
+	defer runtime.KeepAlive(key)
+	defer runtime.KeepAlive(ct)
 	pt := NewPlaintext()
-	defer pt.Free()
+	defer pt.Close()
 	GenericSet[T](pt, input)
-	C.key_enc_preprocessed(key.key, (*C.plaintext_t)(pt), (*C.ciphertext_t)(ct))
+	C.key_enc_preprocessed(key.c(), pt.c(), ct.c())
 
 	// Truncate to the size of input
 	if uint64(len(input)) < ctx.N() {
@@ -284,20 +379,23 @@ func (ctx *Context[T]) EncryptPreprocessed(key *Key, input []T, ct *Ciphertext)
 }
 
 func (ctx *Context[T]) TruncateCT(ct *Ciphertext, size int) {
-	C.truncate_ct(ctx.ctx, (*C.ciphertext_t)(ct), C.size_t(size))
+	defer runtime.KeepAlive(ctx)
+	defer runtime.KeepAlive(ct)
+	C.truncate_ct(ctx.c(), ct.c(), C.size_t(size))
 }
 
 // TODO: This is messy and should be rewritten
 func (ctx *Context[T]) StoreRandomCTs(samples uint64, seed []uint64) [][]byte {
+	defer runtime.KeepAlive(ctx)
 	if len(seed) != 8 {
 		panic("SEAL seed must be 512-bits")
 	}
-	size := uint64(C.dummy_ct_size(ctx.ctx))
+	size := uint64(C.dummy_ct_size(ctx.c()))
 	num := uint64(math.Ceil(float64(samples) / float64(ctx.N())))
 	buf := make([]byte, size*num)
 	actualSizes := make([]uint64, num)
 	C.store_dummy_cts(
-		ctx.ctx,
+		ctx.c(),
 		(*C.uint64_t)(&seed[0]),
 		(C.size_t)(samples),
 		(*C.uint8_t)(&buf[0]),
@@ -312,11 +410,12 @@ func (ctx *Context[T]) StoreRandomCTs(samples uint64, seed []uint64) [][]byte {
 }
 
 func (ct *Ciphertext) StoreData() []byte {
-	size := int(C.ct_data_size((*C.ciphertext_t)(ct)))
+	defer runtime.KeepAlive(ct)
+	size := int(C.ct_data_size(ct.c()))
 	out := make([]byte, size)
 	actualSize := uint64(0)
 	C.ct_store_data(
-		(*C.ciphertext_t)(ct),
+		ct.c(),
 		(*C.uint8_t)(&out[0]),
 		C.size_t(len(out)),
 		(*C.size_t)(&actualSize),
@@ -325,16 +424,17 @@ func (ct *Ciphertext) StoreData() []byte {
 }
 
 func (ctx *Context[T]) RoundLWEInplace(noisyResult *m.Matrix[T]) {
+	defer runtime.KeepAlive(ctx)
 	switch T(0).Bitlen() {
 	case 32:
 		C.round_lwe_32(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint32_t)(unsafe.Pointer(&noisyResult.Data()[0])),
 			(C.size_t)(noisyResult.Size()),
 		)
 	case 64:
 		C.round_lwe_64(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint64_t)(unsafe.Pointer(&noisyResult.Data()[0])),
 			(C.size_t)(noisyResult.Size()),
 		)
@@ -344,16 +444,17 @@ func (ctx *Context[T]) RoundLWEInplace(noisyResult *m.Matrix[T]) {
 }
 
 func (ctx *Context[T]) LiftPlainInplace(plain *m.Matrix[T]) {
+	defer runtime.KeepAlive(ctx)
 	switch T(0).Bitlen() {
 	case 32:
 		C.lift_lwe_32(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint32_t)(unsafe.Pointer(&plain.Data()[0])),
 			(C.size_t)(plain.Size()),
 		)
 	case 64:
 		C.lift_lwe_64(
-			ctx.ctx,
+			ctx.c(),
 			(*C.uint64_t)(unsafe.Pointer(&plain.Data()[0])),
 			(C.size_t)(plain.Size()),
 		)
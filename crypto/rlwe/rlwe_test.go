@@ -11,38 +11,64 @@ import (
 
 func TestContext(t *testing.T) {
 	ctx := NewContext[m.Elem32](0, 4096, false)
-	defer ctx.Free()
+	defer ctx.Close()
 	if ctx.N() <= 100 {
 		t.FailNow()
 	}
 }
 
+func TestSupportsRing(t *testing.T) {
+	// The default secret dimensions, and larger powers of two up to SEAL's
+	// limit
+	for _, n := range []uint64{2048, 4096, 8192, 32768} {
+		if !SupportsRing[m.Elem32](n) {
+			t.Fatalf("Ring dimension %v is unsupported for 32 bits", n)
+		}
+	}
+	for _, n := range []uint64{4096, 16384} {
+		if !SupportsRing[m.Elem64](n) {
+			t.Fatalf("Ring dimension %v is unsupported for 64 bits", n)
+		}
+	}
+
+	// The coefficient modulus is too large for the dimension, or the
+	// dimension isn't a SEAL ring dimension
+	for _, n := range []uint64{1024, 3000, 65536} {
+		if SupportsRing[m.Elem32](n) {
+			t.Fatalf("Ring dimension %v is supported for 32 bits", n)
+		}
+	}
+	if SupportsRing[m.Elem64](2048) {
+		t.Fatalf("Ring dimension %v is supported for 64 bits", 2048)
+	}
+}
+
 func TestPlaintext(t *testing.T) {
 	ctx := NewContext[m.Elem32](0, 4096, false)
-	defer ctx.Free()
+	defer ctx.Close()
 	pt := NewPlaintext()
-	defer pt.Free()
+	defer pt.Close()
 }
 
 func TestCiphertext(t *testing.T) {
 	ct := NewCiphertext()
-	defer ct.Free()
+	defer ct.Close()
 }
 
 func BenchmarkModSwitch(b *testing.B) {
 	rng := rand.New(rand.NewSource(99))
 	ctx := NewContext[m.Elem32](0, 4096, false)
-	defer ctx.Free()
+	defer ctx.Close()
 
 	ct := NewCiphertext()
-	defer ct.Free()
+	defer ct.Close()
 
 	pt := m.Rand[m.Elem32](rng, ctx.N(), 1, ctx.P())
 
 	// Generate A matrix
 	key := ctx.NewKey()
 	A := NewA(key, make([]uint64, 8))
-	defer key.Free()
+	defer key.Close()
 
 	// Encrypt the plaintext
 	key.PreprocessEnc(A, ct)
@@ -78,16 +104,16 @@ func testHybrid[T m.Elem](t *testing.T, ctx *Context[T], rows, cols, pMod uint64
 	cts := make([]*Ciphertext, num)
 	for i := range cts {
 		cts[i] = NewCiphertext()
-		defer cts[i].Free()
+		defer cts[i].Close()
 	}
 
 	key := ctx.NewKey()
-	defer key.Free()
+	defer key.Close()
 	for i := range num {
 		// Build A
 		seed := seeds[i*SealSeedLength : (i+1)*SealSeedLength]
 		a := NewA(key, seed)
-		defer a.Free()
+		defer a.Close()
 
 		// Grab relevant input
 		start := uint64(i) * ctx.N()
@@ -0,0 +1,61 @@
+// Code generated by gen_tables.go; DO NOT EDIT.
+
+package crypto
+
+var pMod32 = map[uint64]uint64{
+	1 << 7:  3691,
+	1 << 8:  3104,
+	1 << 9:  2610,
+	1 << 10: 2195,
+	1 << 11: 1845,
+	1 << 12: 1552,
+	1 << 13: 1305,
+	1 << 14: 1097,
+	1 << 15: 922,
+	1 << 16: 776,
+	1 << 17: 652,
+	1 << 18: 548,
+	1 << 19: 461,
+	1 << 20: 388,
+}
+
+var pMod64 = map[uint64]uint64{
+	1 << 12: 101718599,
+	1 << 13: 85534805,
+	1 << 14: 71925911,
+	1 << 15: 60482241,
+	1 << 16: 50859299,
+	1 << 17: 42767402,
+	1 << 18: 35962955,
+	1 << 19: 30241120,
+	1 << 20: 25429649,
+}
+
+var pMod32Centered = map[uint64]uint64{
+	1 << 7:  5220,
+	1 << 8:  4390,
+	1 << 9:  3691,
+	1 << 10: 3104,
+	1 << 11: 2610,
+	1 << 12: 2195,
+	1 << 13: 1845,
+	1 << 14: 1552,
+	1 << 15: 1305,
+	1 << 16: 1097,
+	1 << 17: 922,
+	1 << 18: 776,
+	1 << 19: 652,
+	1 << 20: 548,
+}
+
+var pMod64Centered = map[uint64]uint64{
+	1 << 12: 143851823,
+	1 << 13: 120964482,
+	1 << 14: 101718599,
+	1 << 15: 85534805,
+	1 << 16: 71925911,
+	1 << 17: 60482241,
+	1 << 18: 50859299,
+	1 << 19: 42767402,
+	1 << 20: 35962955,
+}
@@ -2,4 +2,9 @@ module github.com/ryanleh/secure-inference
 
 go 1.22
 
-require golang.org/x/exp v0.0.0-20240416160154-fe59bbe5cc7f
+require (
+	filippo.io/bigmod v0.0.3
+	filippo.io/nistec v0.0.3
+)
+
+require golang.org/x/sys v0.11.0 // indirect
@@ -4,13 +4,15 @@ import (
 	"math"
 	"math/big"
     mrand "math/rand"
+	"runtime"
+	"sync"
 
+	"github.com/ryanleh/secure-inference/crypto/oprf"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	m "github.com/ryanleh/secure-inference/matrix"
 	"github.com/ryanleh/secure-inference/matrix/gpu"
 )
 
-// TODO: Map elements to the range [-p/2, p/2] to control noise growth
 // TODO: Add batching for dPIR
 
 // Stores DB metadata
@@ -25,11 +27,28 @@ type DBInfo struct {
 
 	GPU bool // Whether or not we're using a GPU
 
+	Layout Layout // How entries are laid out in the DB matrix
+
+	Centered bool // Whether elements are centered (see `DB.Center`)
+
 	// For in-memory db compression
 	Squishing uint64
 	Cols      uint64
 }
 
+// How DB entries are assigned to columns of the DB matrix. Entries consisting
+// of multiple elems are always stacked vertically within their column.
+type Layout int
+
+const (
+	// Consecutive entries are in consecutive columns
+	RowMajor Layout = iota
+
+	// Consecutive entries are in the same column, so that a single query
+	// retrieves a range of entries (see `DBInfo.ColumnEntries`)
+	ColumnMajor
+)
+
 // Struct implementing an LWE-compatible database. Underlying data entries may
 // be packed into multiple Zp elements.
 type DB struct {
@@ -38,13 +57,14 @@ type DB struct {
 }
 
 // Create a new DB from `data`
-func NewDB(data []m.Elem32, bitsPer uint64, cols uint64, pMod uint64, bench bool) *DB {
+func NewDB(data []m.Elem32, bitsPer uint64, cols uint64, pMod uint64, layout Layout, bench bool) *DB {
     if pMod == 0 {
         panic("Invalid Pmod")
     }
 
 	// Create DB info
 	dbInfo := newDBInfo(uint64(len(data)), bitsPer, cols, pMod)
+	dbInfo.Layout = layout
 	db := &DB{Info: dbInfo}
     if bench {
         rng := mrand.New(mrand.NewSource(0))
@@ -86,7 +106,7 @@ func NewDB(data []m.Elem32, bitsPer uint64, cols uint64, pMod uint64, bench bool
 			for j := range dbInfo.Ne {
 				val.DivMod(val, p, rem)
 				entry := m.Elem32(uint32(rem.Uint64()))
-				db.Data.Set((i/dbInfo.M)*dbInfo.Ne+j, i%dbInfo.M, entry)
+				db.Data.Set(dbInfo.Row(i)+j, dbInfo.Column(i), entry)
 			}
 		}
 	} else {
@@ -101,11 +121,7 @@ func NewDB(data []m.Elem32, bitsPer uint64, cols uint64, pMod uint64, bench bool
 				entry %= p
 
 				// Set the corresponding entry in the DB
-				db.Data.Set(
-					(i/dbInfo.M)*dbInfo.Ne+j,
-					i%dbInfo.M,
-					entry,
-				)
+				db.Data.Set(dbInfo.Row(i)+j, dbInfo.Column(i), entry)
 			}
 		}
 	}
@@ -113,6 +129,107 @@ func NewDB(data []m.Elem32, bitsPer uint64, cols uint64, pMod uint64, bench bool
 	return db
 }
 
+// Create an all-zero DB with room for `entries` entries of `bitsPer` bits.
+// Entries can then be written in place with `SetEntry`.
+//
+// If `pMod` is 0, entries are stored as raw 32-bit limbs (e.g. for a DB that
+// is sent to the client in full).
+func NewEmptyDB(entries, bitsPer, cols, pMod uint64, layout Layout) *DB {
+	dbInfo := NewDBInfo(entries, bitsPer, cols, pMod)
+	dbInfo.Layout = layout
+	return &DB{
+		Info: dbInfo,
+		Data: m.Zeros[m.Elem32](dbInfo.L, dbInfo.M),
+	}
+}
+
+// Encode entry `i`, given as big-endian 32-bit limbs, into the DB.
+//
+// Distinct entries occupy distinct DB elements, so it is safe to call this
+// concurrently for different `i`.
+func (db *DB) SetEntry(i uint64, limbs []m.Elem32) {
+	info := db.Info
+	row := info.Row(i)
+	col := info.Column(i)
+	if info.Centered {
+		defer func() {
+			for j := range info.Ne {
+				db.Data.Set(row+j, col, m.Elem32(info.center(uint64(db.Data.Get(row+j, col)))))
+			}
+		}()
+	}
+
+	// Raw limbs are stacked vertically
+	if info.P == 0 {
+		for j, limb := range limbs {
+			db.Data.Set(row+uint64(j), col, limb)
+		}
+		return
+	}
+
+	// Single Zp element
+	if info.Ne == 1 {
+		db.Data.Set(row, col, limbs[0]%m.Elem32(info.P))
+		return
+	}
+
+	// Multiple Zp elements in little-endian ordering. Avoid bignums when the
+	// full value fits in 64 bits.
+	if info.BitsPer <= 64 {
+		val := uint64(limbs[0])
+		for j := 1; j < len(limbs); j++ {
+			val <<= min(32, info.BitsPer-32*uint64(j))
+			val += uint64(limbs[j])
+		}
+		for j := range info.Ne {
+			db.Data.Set(row+j, col, m.Elem32(val%info.P))
+			val /= info.P
+		}
+		return
+	}
+
+	p := big.NewInt(0).SetUint64(info.P)
+	val := big.NewInt(0).SetUint64(uint64(limbs[0]))
+	adder := big.NewInt(0)
+	rem := big.NewInt(0)
+	for j := 1; j < len(limbs); j++ {
+		val.Lsh(val, uint(min(32, info.BitsPer-32*uint64(j))))
+		adder.SetUint64(uint64(limbs[j]))
+		val.Add(val, adder)
+	}
+	for j := range info.Ne {
+		val.DivMod(val, p, rem)
+		db.Data.Set(row+j, col, m.Elem32(uint32(rem.Uint64())))
+	}
+}
+
+// Mask every entry in-place with a pad derived from the PRF output on its index,
+// for symmetric PIR. Must be called before the hint is computed.
+//
+// This evaluates the PRF once per entry, so is done concurrently.
+func (db *DB) Mask(key *oprf.Key) {
+	if db.Info.P == 0 {
+		panic("Can't mask a DB of raw limbs")
+	}
+	var wg sync.WaitGroup
+	workers := uint64(runtime.NumCPU())
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < db.Info.N; i += workers {
+				pad := entryPad(key.Eval(entryInput(i)), db.Info)
+				row, col := db.Info.Row(i), db.Info.Column(i)
+				for j := range db.Info.Ne {
+					val := (uint64(db.Data.Get(row+j, col)) + pad[j]) % db.Info.P
+					db.Data.Set(row+j, col, m.Elem32(val))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 // Create a random database
 func RandomDB(num, bitsPer uint64, cols uint64, pMod uint64, prg *rand.BufPRGReader) *DB {
 	dbInfo := newDBInfo(num, bitsPer, cols, pMod)
@@ -139,6 +256,28 @@ func (db *DB) Copy() *DB {
 	}
 }
 
+// Map every element `v` of the DB in-place to its centered representative in
+// [-P/2, P/2], which halves the noise in answers (see
+// `crypto.NewCenteredContext`). Must be called before the hint is computed.
+//
+// To leave squishing and the matrix kernels unchanged, a centered element `c`
+// is stored as `c + P/2`, in [0, P), and servers subtract `P/2` times the sum
+// of the query from each answer (see `SimpleServer.Answer`). Since `c = v mod
+// P`, answers decode to the original elements.
+func (db *DB) Center() {
+	if db.Info.P == 0 {
+		panic("Can't center a DB of raw limbs")
+	}
+	if db.Info.Centered {
+		return
+	}
+	data := db.Data.Data()
+	for i := range data {
+		data[i] = m.Elem32(db.Info.center(uint64(data[i])))
+	}
+	db.Info.Centered = true
+}
+
 // Compress the database in-place to increase memory-bandwidth
 func (db *DB) Squish() {
 	// Only compress if parameters are compatible
@@ -153,6 +292,14 @@ func (db *DB) Squish() {
    ===== Helper Funcs =====
 */
 
+// The metadata of a DB of `entries` entries of `bitsPer` bits encoded into
+// `cols` columns, e.g. to find its dimensions without allocating it. As in
+// `NewEmptyDB`, a `pMod` of 0 means the DB stores raw limbs.
+func NewDBInfo(entries, bitsPer, cols, pMod uint64) *DBInfo {
+	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+	return newDBInfo(entries*numLimbs, bitsPer, cols, pMod)
+}
+
 func newDBInfo(num, bitsPer, cols, pMod uint64) *DBInfo {
 
 	info := &DBInfo{
@@ -173,7 +320,7 @@ func newDBInfo(num, bitsPer, cols, pMod uint64) *DBInfo {
 	var totalElems uint64
     if pMod == 0 {
         info.Ne = numLimbs
-        totalElems = info.N
+        totalElems = info.N * info.Ne
     } else if float64(bitsPer) <= math.Log2(float64(pMod)) {
 		info.Ne = 1
 		totalElems = info.N
@@ -193,6 +340,52 @@ func newDBInfo(num, bitsPer, cols, pMod uint64) *DBInfo {
 	return info
 }
 
+// The stored form of element `v` in a centered DB
+func (info *DBInfo) center(v uint64) uint64 {
+	return (v + info.P/2) % info.P
+}
+
+// The element stored as `s` in a centered DB
+func (info *DBInfo) uncenter(s uint64) uint64 {
+	return (s + info.P - info.P/2) % info.P
+}
+
+// The number of entries in each column
+func (info *DBInfo) Height() uint64 {
+	return info.L / info.Ne
+}
+
+// The column holding entry `i`
+func (info *DBInfo) Column(i uint64) uint64 {
+	if info.Layout == ColumnMajor {
+		return i / info.Height()
+	}
+	return i % info.M
+}
+
+// The first row holding entry `i`
+func (info *DBInfo) Row(i uint64) uint64 {
+	if info.Layout == ColumnMajor {
+		return (i % info.Height()) * info.Ne
+	}
+	return (i / info.M) * info.Ne
+}
+
+// The entries held by column `col`, in order
+func (info *DBInfo) ColumnEntries(col uint64) []uint64 {
+	entries := []uint64{}
+	if info.Layout == ColumnMajor {
+		for i := col * info.Height(); i < min((col+1)*info.Height(), info.N); i++ {
+			entries = append(entries, i)
+		}
+		return entries
+	}
+	for i := col; i < info.N; i += info.M {
+		entries = append(entries, i)
+	}
+	return entries
+}
+
 // Reconstruct an element decomposed into multiple Z_p elements
 func (Info *DBInfo) ReconstructElem(vals []m.Elem32) []m.Elem32 {
 	var result []m.Elem32
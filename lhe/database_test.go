@@ -5,6 +5,7 @@ import (
 	"slices"
 	"testing"
 
+	"github.com/ryanleh/secure-inference/crypto/oprf"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
@@ -12,16 +13,24 @@ import (
 func (db *DB) getElem(i uint64) []m.Elem32 {
 	// Extract the relevant elements corresponding to index `i`
 	vals := make([]m.Elem32, db.Info.Ne)
-	row := db.Info.Ne * (i / db.Info.M)
-	col := i % db.Data.Cols()
+	row := db.Info.Row(i)
+	col := db.Info.Column(i)
 	for j := range db.Info.Ne {
 		vals[j] = db.Data.Get(row+j, col)
+		if db.Info.Centered {
+			vals[j] = m.Elem32(db.Info.uncenter(uint64(vals[j])))
+		}
 	}
 	return db.Info.ReconstructElem(vals)
 }
 
 func testDBInit(t *testing.T, data []m.Elem32, bitsPer, cols, pMod uint64) *DB {
-	db := NewDB(data, bitsPer, cols, pMod, false)
+	testDBLayout(t, data, bitsPer, cols, pMod, ColumnMajor)
+	return testDBLayout(t, data, bitsPer, cols, pMod, RowMajor)
+}
+
+func testDBLayout(t *testing.T, data []m.Elem32, bitsPer, cols, pMod uint64, layout Layout) *DB {
+	db := NewDB(data, bitsPer, cols, pMod, layout, false)
 
 	numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
 	for i := range uint64(len(data)) / numLimbs {
@@ -58,3 +67,115 @@ func TestDBLargeEntries(t *testing.T) {
 	matrix = m.Rand[m.Elem32](prg, 512*32, 512, 0)
 	testDBInit(t, matrix.Data(), 1024, matrix.Cols(), 1<<10)
 }
+
+// Encoding entries in place should match encoding the full DB at once
+func TestDBSetEntry(t *testing.T) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	for _, bitsPer := range []uint64{9, 24, 48, 96} {
+		numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+		matrix := m.Rand[m.Elem32](prg, 300*numLimbs, 1, 0)
+		if bitsPer%32 != 0 {
+			for i := range uint64(300) {
+				matrix.Data()[(i+1)*numLimbs-1] %= m.Elem32(1 << (bitsPer - (numLimbs-1)*32))
+			}
+		}
+
+		for _, layout := range []Layout{RowMajor, ColumnMajor} {
+			expected := NewDB(matrix.Data(), bitsPer, 17, 1<<10, layout, false)
+			db := NewEmptyDB(300, bitsPer, 17, 1<<10, layout)
+			for i := range uint64(300) {
+				db.SetEntry(i, matrix.Data()[i*numLimbs:(i+1)*numLimbs])
+			}
+			if !db.Data.Equals(expected.Data) {
+				t.Fatalf("SetEntry mismatch for %v-bit entries (layout %v)", bitsPer, layout)
+			}
+		}
+	}
+}
+
+// Every entry is listed under its own column, and column-major columns hold
+// consecutive entries
+func TestDBColumnEntries(t *testing.T) {
+	for _, layout := range []Layout{RowMajor, ColumnMajor} {
+		db := NewEmptyDB(300, 48, 17, 1<<10, layout)
+		seen := 0
+		for col := range db.Info.M {
+			entries := db.Info.ColumnEntries(col)
+			for k, i := range entries {
+				if db.Info.Column(i) != col {
+					t.Fatalf("Entry %v listed under column %v instead of %v", i, col, db.Info.Column(i))
+				}
+				if layout == ColumnMajor && k > 0 && i != entries[k-1]+1 {
+					t.Fatalf("Column %v is not contiguous: %v", col, entries)
+				}
+			}
+			seen += len(entries)
+		}
+		if seen != 300 {
+			t.Fatalf("Expected 300 entries, got %v", seen)
+		}
+	}
+}
+
+func TestDBMask(t *testing.T) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	prfKey := oprf.NewKey(prg)
+	data := m.Rand[m.Elem32](prg, 1, 300, 1<<16).Data()
+	for _, layout := range []Layout{RowMajor, ColumnMajor} {
+		db := NewDB(data, 16, 17, 1<<10, layout, false)
+		original := db.Data.Copy()
+		db.Mask(prfKey)
+
+		// Removing the pad derived from the PRF on an index recovers its entry
+		changed := 0
+		for i := range db.Info.N {
+			pad := entryPad(prfKey.Eval(entryInput(i)), db.Info)
+			row, col := db.Info.Row(i), db.Info.Column(i)
+			for j := range db.Info.Ne {
+				masked := uint64(db.Data.Get(row+j, col))
+				if masked != uint64(original.Get(row+j, col)) {
+					changed++
+				}
+				if (masked+db.Info.P-pad[j])%db.Info.P != uint64(original.Get(row+j, col)) {
+					t.Fatalf("Unmasking failure @ %v", i)
+				}
+			}
+		}
+		if changed == 0 {
+			t.Fatalf("Masking left the DB unchanged")
+		}
+	}
+}
+
+func TestDBCenter(t *testing.T) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	pMod := uint64(1000)
+	data := m.Rand[m.Elem32](prg, 1, 300, 1<<24).Data()
+	for _, bitsPer := range []uint64{9, 24} {
+		db := NewDB(data, bitsPer, 17, pMod, RowMajor, false)
+		expected := make([][]m.Elem32, db.Info.N)
+		for i := range expected {
+			expected[i] = db.getElem(uint64(i))
+		}
+		db.Center()
+
+		// Elements are stored in [0, P) as their centered representative
+		// shifted by P/2
+		for _, v := range db.Data.Data() {
+			if uint64(v) >= pMod {
+				t.Fatalf("Stored element %v out of range", v)
+			}
+		}
+		for i := range expected {
+			if result := db.getElem(uint64(i)); !slices.Equal(result, expected[i]) {
+				t.Fatalf("Centering failure (%v): %v != %v", i, result, expected[i])
+			}
+		}
+
+		// Entries written after centering are centered too
+		db.SetEntry(5, []m.Elem32{7})
+		if result := db.getElem(5); result[0] != 7 {
+			t.Fatalf("SetEntry failure: %v", result)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package lhe
 
 import (
+	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/crypto/rand"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
 
@@ -18,6 +20,117 @@ const (
 	Local
 )
 
+// Mode used by the SimplePIR-based servers for a given scheme
+func (t LHEType) mode() Mode {
+	if t == SimpleHybrid {
+		return Hybrid
+	}
+	return None
+}
+
+// Create an LHE server of type `scheme` over `matrix`. For SimplePIR-based
+// schemes, the number of LWE samples is given by the number of columns of
+// `matrix`. Entries are placed in the DB according to `layout`.
+func MakeServer[T m.Elem](
+	scheme LHEType,
+	matrix *m.Matrix[m.Elem32],
+	bitsPer, pMod uint64,
+	layout Layout,
+	seed *rand.PRGKey,
+	bench bool, // TODO: Remove
+) Server[T] {
+	switch scheme {
+	case Local:
+		return makeLocalServer[T](matrix, bitsPer, layout)
+	case Simple, SimpleHybrid:
+		ctx := crypto.NewContext[T](T(0).Bitlen(), matrix.Cols(), pMod)
+		db := NewDB(matrix.Data(), bitsPer, ctx.Params.M, ctx.Params.P, layout, bench)
+		return MakeSimpleServerFromDB[T](db, ctx, seed, scheme.mode(), false, bench)
+	default:
+		panic("Invalid LHE type")
+	}
+}
+
+// Create an LHE server of type `scheme` from an already-encoded DB. Local
+// servers expect a DB of raw limbs (i.e., with `P = 0`), and centered DBs (see
+// `DB.Center`) use parameters for centered elements.
+func MakeServerFromDB[T m.Elem](
+	scheme LHEType,
+	db *DB,
+	seed *rand.PRGKey,
+	bench bool, // TODO: Remove
+) Server[T] {
+	switch scheme {
+	case Local:
+		return MakeLocalServerFromDB[T](db)
+	case Simple, SimpleHybrid:
+		opts := crypto.Options{Centered: db.Info.Centered}
+		ctx := crypto.NewContextWithOptions[T](T(0).Bitlen(), db.Info.M, db.Info.P, opts)
+		return MakeSimpleServerFromDB[T](db, ctx, seed, scheme.mode(), false, bench)
+	default:
+		panic("Invalid LHE type")
+	}
+}
+
+// Create an uninitialized LHE client of the type that produced `hint`
+func NewClient[T m.Elem](hint Hint[T]) Client[T] {
+	switch hint.Type() {
+	case Local:
+		return &LocalClient[T]{}
+	case Simple, SimpleHybrid:
+		return &SimpleClient[T]{}
+	default:
+		panic("Invalid LHE type")
+	}
+}
+
+// Answer the queries of several clients with a single call to `server`,
+// returning the answers for each client's queries. This sets the batch size
+// of `server` to the total number of queries.
+func AnswerBatch[T m.Elem](server Server[T], batches [][]Query[T]) [][]Answer[T] {
+	queries := []Query[T]{}
+	for _, batch := range batches {
+		queries = append(queries, batch...)
+	}
+	results := make([][]Answer[T], len(batches))
+	if len(queries) == 0 {
+		return results
+	}
+
+	server.SetBatch(uint64(len(queries)))
+	answers := server.Answer(queries)
+
+	// On a GPU, the answers to all queries are the columns of a single matrix
+	// (see `SimpleServer.Answer`), so split them up by client
+	if simple, ok := server.(*SimpleServer[T]); ok && simple.gpuCtx != nil {
+		full := answers[0].(*SimpleAnswer[T])
+		answer := full.Answer
+		offset := uint64(0)
+		for i, batch := range batches {
+			cols := m.New[T](answer.Rows(), uint64(len(batch)))
+			for j := range answer.Rows() {
+				for k := range uint64(len(batch)) {
+					cols.Set(j, k, answer.Get(j, offset+k))
+				}
+			}
+			split := &SimpleAnswer[T]{Answer: cols}
+			if full.Responses != nil {
+				split.Responses = full.Responses[offset : offset+uint64(len(batch))]
+			}
+			results[i] = []Answer[T]{split}
+			offset += uint64(len(batch))
+		}
+		return results
+	}
+
+	offset := 0
+	for i, batch := range batches {
+		results[i] = answers[offset : offset+len(batch)]
+		offset += len(batch)
+	}
+	return results
+}
+
 // The interface for an LHE client
 type Client[T m.Elem] interface {
 	// Initialize an LHE client using a hint
@@ -30,7 +143,7 @@ type Client[T m.Elem] interface {
 	DummyQuery(uint64) ([]Secret[T], []Query[T])
 
 	// Decrypt an LHE answer
-	Recover([]Secret[T], []Answer[T]) []*m.Matrix[T]
+	Recover([]Secret[T], []Answer[T]) ([]*m.Matrix[T], error)
 
 	// Get database info
 	DBInfo() *DBInfo
@@ -71,6 +184,9 @@ type Server[T m.Elem] interface {
 // define the 'dummy' interfaces below which the various types will implement.
 type Hint[T m.Elem] interface {
 	hint()
+
+	// The type of LHE scheme that produced this hint
+	Type() LHEType
 }
 
 type Secret[T m.Elem] interface {
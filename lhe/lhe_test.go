@@ -6,7 +6,9 @@ import (
 	"testing"
 
 	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/crypto/oprf"
 	"github.com/ryanleh/secure-inference/crypto/rand"
+	"github.com/ryanleh/secure-inference/crypto/rlwe"
 	m "github.com/ryanleh/secure-inference/matrix"
 )
 
@@ -94,7 +96,10 @@ func testLHEHelper[T m.Elem](
 
 		// Answer queries
 		answers := server.Answer(queries)
-		results := client.Recover(keys, answers)
+		results, err := client.Recover(keys, answers)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 
 		// Check results
 		for i := range results {
@@ -125,6 +130,32 @@ func testLHE[T m.Elem](t *testing.T, bitsPer, pMod uint64) {
 	}
 }
 
+func testLocal[T m.Elem](t *testing.T, bitsPer uint64) {
+	dbRows := []uint64{13, 512}
+	dbCols := []uint64{15, 256}
+	batchSize := uint64(3)
+	for i := range dbRows {
+		c, s, m := randInstance[T](Local, bitsPer, dbRows[i], dbCols[i], 1<<8, false)
+		if n := c.DBInfo().N; n != dbRows[i]*dbCols[i] {
+			t.Fatalf("Client reports %d entries instead of %d", n, dbRows[i]*dbCols[i])
+		}
+		if s.DB() == nil || s.DB().Info.N != dbRows[i]*dbCols[i] || s.StateSize() < c.StateSize() {
+			t.Fatalf("Invalid server DB or state size")
+		}
+		testLHEHelper[T](t, c, s, m, batchSize)
+	}
+}
+
+func TestLocal32(t *testing.T) {
+	testLocal[m.Elem32](t, 7)
+	testLocal[m.Elem32](t, 48)
+}
+
+func TestLocal64(t *testing.T) {
+	testLocal[m.Elem64](t, 15)
+	testLocal[m.Elem64](t, 48)
+}
+
 func TestSmallEntries32(t *testing.T) {
 	testLHE[m.Elem32](t, 7, uint64(1<<8))
 }
@@ -143,6 +174,257 @@ func TestLargeEntries64(t *testing.T) {
 	testLHE[m.Elem64](t, 48, uint64(1<<16))
 }
 
+// Centered DBs decrypt correctly with a plaintext modulus above the
+// non-centered tables
+func testCentered[T m.Elem](t *testing.T, bitsPer, rows, cols, pMod uint64) {
+	if crypto.CheckParams(T(0).Bitlen(), cols, pMod) || !crypto.CheckParamsCentered(T(0).Bitlen(), cols, pMod) {
+		panic("Modulus should only be supported for centered DBs")
+	}
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	matrix := m.Rand[m.Elem32](prg, rows, cols, 1<<bitsPer)
+	for _, scheme := range []LHEType{Simple, SimpleHybrid} {
+		db := NewDB(matrix.Data(), bitsPer, cols, pMod, RowMajor, false)
+		db.Center()
+		server := MakeServerFromDB[T](scheme, db, &key, false)
+		client := NewClient[T](server.Hint())
+		client.Init(server.Hint())
+		testLHEHelper[T](t, client, server, matrix, 3)
+	}
+}
+
+func TestCentered32(t *testing.T) {
+	testCentered[m.Elem32](t, 11, 64, 512, 3600)
+}
+
+func TestCentered64(t *testing.T) {
+	testCentered[m.Elem64](t, 26, 64, 4096, 1<<27)
+}
+
+// Clients sample secrets matching the parameters in the hint
+func testOptions[T m.Elem](t *testing.T, bitsPer, rows, cols, pMod uint64) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	matrix := m.Rand[m.Elem32](prg, rows, cols, 1<<bitsPer)
+	for _, opts := range []crypto.Options{
+		{Secret: crypto.Ternary},
+		{Secret: crypto.Binary},
+		{Security: 256},
+	} {
+		ctx := crypto.NewContextWithOptions[T](T(0).Bitlen(), cols, pMod, opts)
+		server := MakeSimpleServer[T](matrix, bitsPer, ctx, &key, None, false, false)
+		client := NewClient[T](server.Hint())
+		client.Init(server.Hint())
+		if client.(*SimpleClient[T]).ctx.Params.Options() != ctx.Params.Options() {
+			t.Fatalf("Client options don't match the server")
+		}
+		testLHEHelper[T](t, client, server, matrix, 3)
+	}
+}
+
+func TestOptions32(t *testing.T) {
+	testOptions[m.Elem32](t, 8, 64, 512, 1<<8)
+}
+
+func TestOptions64(t *testing.T) {
+	testOptions[m.Elem64](t, 16, 64, 1024, 1<<16)
+}
+
+// Answers have noise within the bounds of the parameters
+func testNoise[T m.Elem](t *testing.T, bitsPer, rows, cols, pMod uint64) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	matrix := m.Rand[m.Elem32](prg, rows, cols, 1<<bitsPer)
+	for _, mode := range []Mode{None, Hybrid} {
+		ctx := crypto.NewContext[T](T(0).Bitlen(), cols, pMod)
+		server := MakeSimpleServer[T](matrix, bitsPer, ctx, &key, mode, false, false)
+		client := NewClient[T](server.Hint()).(*SimpleClient[T])
+		client.Init(server.Hint())
+
+		stats := MeasureNoise[T](client, server, 4, 2)
+		if stats.Samples == 0 || stats.Samples%(4*2) != 0 || stats.Suspect != 0 {
+			t.Fatalf("Unexpected noise stats: %+v", stats)
+		}
+		if stats.Max == 0 || stats.Max > stats.NoiseBound || stats.FailureProb() > crypto.FailureProb {
+			t.Fatalf("Noise out of bounds: %+v", stats)
+		}
+
+		// Reports are consistent with the noise
+		input := m.New[T](cols, 1)
+		input.Set(prg.Uint64()%cols, 0, 1)
+		secrets, queries := client.Query([]*m.Matrix[T]{input})
+		_, reports, err := client.RecoverWithNoise(secrets, server.Answer(queries))
+		if err != nil || len(reports) != 1 || reports[0].Failed() || reports[0].MinMargin() < stats.DecryptionBound-stats.SuspectBound {
+			t.Fatalf("Unexpected noise report")
+		}
+
+		// Noise near the rounding boundary is flagged, but not noise within
+		// the bound
+		params := ctx.Params
+		noised := m.New[T](2, 1)
+		noised.Set(0, 0, T(params.Delta+uint64(stats.SuspectBound/2)))
+		noised.Set(1, 0, T(2*params.Delta+uint64((stats.SuspectBound+stats.DecryptionBound)/2)))
+		if report := client.noiseReport(noised); !slices.Equal(report.Suspect, []uint64{1}) {
+			t.Fatalf("Unexpected suspect elements %v", report.Suspect)
+		}
+		client.Free()
+		server.Free()
+	}
+}
+
+// Use the largest supported moduli, where the noise comes closest to the
+// rounding boundary
+func TestNoise32(t *testing.T) {
+	testNoise[m.Elem32](t, 8, 64, 1<<10, crypto.PMod32[1<<10])
+}
+
+func TestNoise64(t *testing.T) {
+	testNoise[m.Elem64](t, 16, 64, 1<<12, crypto.PMod64[1<<12])
+}
+
+func TestSecretClose(t *testing.T) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	inner := m.Rand[m.Elem64](prg, 64, 1, 0)
+	data := inner.Data()
+	secret := &SimpleSecret[m.Elem64]{innerSecret: inner}
+	secret.Close()
+	if secret.innerSecret != nil || slices.ContainsFunc(data, func(v m.Elem64) bool { return v != 0 }) {
+		t.Fatalf("Secret not zeroized")
+	}
+	secret.Close()
+}
+
+// Secrets recover a single answer unless reuse is allowed
+func testSecretReuse[T m.Elem](t *testing.T, mode Mode) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	matrix := m.Rand[m.Elem32](prg, 64, 512, 1<<8)
+	ctx := crypto.NewContext[T](T(0).Bitlen(), 512, 1<<8)
+	server := MakeSimpleServer[T](matrix, 8, ctx, &key, mode, false, false)
+	defer server.Free()
+	client := &SimpleClient[T]{}
+	client.Init(server.Hint())
+	defer client.Free()
+
+	input := m.Rand[T](prg, 512, 1, 1<<8)
+	secrets, queries := client.Query([]*m.Matrix[T]{input})
+	answers := server.Answer(queries)
+	if _, err := client.Recover(secrets, answers); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if inner := secrets[0].(*SimpleSecret[T]).innerSecret; inner != nil {
+		t.Fatalf("Secret not freed after use")
+	}
+	if _, err := client.Recover(secrets, answers); err != ErrSecretReused {
+		t.Fatalf("Secret reuse not detected: %v", err)
+	}
+
+	// With hint compression, the caller sets the hint token of each secret
+	// and owns it
+	client.compressHint = true
+	secrets, queries = client.Query([]*m.Matrix[T]{input})
+	secret := secrets[0].(*SimpleSecret[T])
+	secret.SetInner(m.Mul(client.hint, secret.GetInner()))
+	if _, err := client.Recover(secrets, server.Answer(queries)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if secret.GetInner() == nil {
+		t.Fatalf("Caller-owned secret freed after use")
+	}
+	secret.Close()
+	client.compressHint = false
+
+	// Benchmarks can answer the same queries repeatedly. Recovering
+	// modifies answers in place, so each is only recovered once.
+	client.AllowSecretReuse()
+	secrets, queries = client.Query([]*m.Matrix[T]{input})
+	first, _ := client.Recover(secrets, server.Answer(queries))
+	if second, err := client.Recover(secrets, server.Answer(queries)); err != nil || !first[0].Equals(second[0]) {
+		t.Fatalf("Reused secret gave a different result")
+	}
+	secrets[0].(*SimpleSecret[T]).Close()
+}
+
+func TestSecretReuse(t *testing.T) {
+	testSecretReuse[m.Elem32](t, None)
+	testSecretReuse[m.Elem32](t, Hybrid)
+	testSecretReuse[m.Elem64](t, None)
+}
+
+// Symmetric PIR clients recover the queried entries, and invalid OPRF
+// requests or responses fail recovery rather than crashing either side
+func TestSymmetric(t *testing.T) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	data := m.Rand[m.Elem32](prg, 1, 300, 1<<8).Data()
+	ctx := crypto.NewContext[m.Elem32](32, 32, 1<<8)
+	db := NewDB(data, 8, ctx.Params.M, ctx.Params.P, ColumnMajor, false)
+	server := MakeSymmetricServerFromDB[m.Elem32](db, ctx, &key, oprf.NewKey(prg), None, false)
+	defer server.Free()
+	client := &SimpleClient[m.Elem32]{}
+	client.Init(server.Hint())
+	defer client.Free()
+
+	indices := []uint64{5, 100, 299}
+	secrets, queries := client.QueryEntries(indices)
+	results, err := client.Recover(secrets, server.Answer(queries))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, idx := range indices {
+		if value := results[i].Get(db.Info.Row(idx), 0); value != data[idx] {
+			t.Fatalf("Recovery error @ %v: %v vs. %v", idx, value, data[idx])
+		}
+	}
+
+	// A malformed request gets an empty response
+	secrets, queries = client.QueryEntries(indices[:1])
+	queries[0].(*SimpleQuery[m.Elem32]).Request = []byte{1, 2, 3}
+	answers := server.Answer(queries)
+	if _, err := client.Recover(secrets, answers); err == nil {
+		t.Fatalf("Expected an answer without an OPRF response to be rejected")
+	}
+
+	// An invalid response is rejected
+	secrets, queries = client.QueryEntries(indices[:1])
+	answers = server.Answer(queries)
+	answers[0].(*SimpleAnswer[m.Elem32]).Responses[0] = make([]byte, oprf.PointSize)
+	if _, err := client.Recover(secrets, answers); err == nil {
+		t.Fatalf("Expected an invalid OPRF response to be rejected")
+	}
+}
+
+// Long-running clients and servers release everything they allocate
+func TestLeaks(t *testing.T) {
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	matrix := m.Rand[m.Elem32](prg, 64, 512, 1<<8)
+	live := rlwe.Live()
+	for _, mode := range []Mode{None, Hybrid} {
+		ctx := crypto.NewContext[m.Elem32](32, 512, 1<<8)
+		server := MakeSimpleServer[m.Elem32](matrix, 8, ctx, &key, mode, false, false)
+		// The prefix holds every entry, so the fork's hint is also its hint
+		prefix := server.Prefix(64 * 512)
+		client := &SimpleClient[m.Elem32]{}
+		client.Init(server.Hint())
+		fork := client.Fork()
+
+		for range 10 {
+			input := m.Rand[m.Elem32](prg, 512, 1, 1<<8)
+			secrets, queries := fork.Query([]*m.Matrix[m.Elem32]{input})
+			fork.Recover(secrets, server.Answer(queries))
+		}
+		_, queries := client.DummyQuery(2)
+		server.Answer(queries)
+
+		// Shared objects outlive their first owner
+		client.Free()
+		server.Free()
+		input := m.Rand[m.Elem32](prg, 512, 1, 1<<8)
+		secrets, queries := fork.Query([]*m.Matrix[m.Elem32]{input})
+		fork.Recover(secrets, prefix.Answer(queries))
+		fork.Free()
+		prefix.Free()
+	}
+	if rlwe.Live() != live {
+		t.Fatalf("%v SEAL objects leaked", rlwe.Live()-live)
+	}
+}
+
 // ------- Latency Benches -------
 
 func bench[T m.Elem](
@@ -178,6 +460,10 @@ func bench[T m.Elem](
 			server.Answer(queries)
 		}
 	case 2:
+		// Recover the same answers repeatedly
+		if simple, ok := client.(*SimpleClient[T]); ok {
+			simple.AllowSecretReuse()
+		}
 		keys, queries := client.Query(inputs)
 		answers := server.Answer(queries)
 		b.ResetTimer()
@@ -0,0 +1,209 @@
+package lhe
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/crypto/rand"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+// Private evaluation of a linear layer `W * x` using SimplePIR-based LHE: the
+// server holds the weight matrix `W` as its DB and the client queries with its
+// input `x`, so the server learns nothing about `x` and the client learns only
+// `W * x`.
+//
+// Real values are encoded as fixed-point integers by scaling and rounding, and
+// then into Z_p as signed values mod `P`. Results are correct as long as every
+// output fits in (-P/2, P/2), which `LinearParams.Check` guarantees given
+// bounds on the weights and inputs.
+
+// Parameters of an encrypted linear layer
+type LinearParams struct {
+	P    uint64 // Plaintext modulus
+	Cols uint64 // Input dimension
+
+	// Fixed-point scales: a real value `v` is encoded as `round(v * scale)`
+	WeightScale float64
+	InputScale  float64
+
+	// Bounds on the magnitude of each weight and input
+	MaxWeight float64
+	MaxInput  float64
+
+	// Whether the server floods its answers, so that the client learns
+	// nothing about `W` beyond `W * x` (see `crypto.Params.EnableFlooding`)
+	Flood bool
+}
+
+// Check that any layer within the bounds of `p` is evaluated without overflow
+// mod `P`
+func (p *LinearParams) Check() error {
+	if p.P < 2 || p.Cols == 0 {
+		return fmt.Errorf("invalid dimensions: P = %v, cols = %v", p.P, p.Cols)
+	}
+	if p.WeightScale <= 0 || p.InputScale <= 0 || p.MaxWeight <= 0 || p.MaxInput <= 0 {
+		return fmt.Errorf("scales and bounds must be positive")
+	}
+	if bound := p.MaxOutput() * p.WeightScale * p.InputScale; bound > float64((p.P-1)/2) {
+		return fmt.Errorf("outputs up to %v overflow P = %v", bound, p.P)
+	}
+	return nil
+}
+
+// Bound on the magnitude of each output
+func (p *LinearParams) MaxOutput() float64 {
+	weight := math.Round(p.MaxWeight * p.WeightScale)
+	input := math.Round(p.MaxInput * p.InputScale)
+	return float64(p.Cols) * weight * input / (p.WeightScale * p.InputScale)
+}
+
+// Encode a real `v` with magnitude at most `bound` into Z_p
+func (p *LinearParams) encode(v, scale, bound float64) (uint64, error) {
+	if math.IsNaN(v) || math.Abs(v) > bound {
+		return 0, fmt.Errorf("value %v out of range [-%v, %v]", v, bound, bound)
+	}
+	x := int64(math.Round(v * scale))
+	if x < 0 {
+		return uint64(x + int64(p.P)), nil
+	}
+	return uint64(x), nil
+}
+
+// Decode an output from Z_p
+func (p *LinearParams) decode(v uint64) float64 {
+	x := int64(v % p.P)
+	if x > int64(p.P/2) {
+		x -= int64(p.P)
+	}
+	return float64(x) / (p.WeightScale * p.InputScale)
+}
+
+// Hint
+type LinearHint[T m.Elem] struct {
+	Params *LinearParams
+	Rows   uint64
+	Hint   Hint[T]
+}
+
+/*
+* Server
+ */
+
+type LinearServer[T m.Elem] struct {
+	params *LinearParams
+	rows   uint64
+	server *SimpleServer[T]
+}
+
+// Create a server for the layer with weights `weights`, given as a list of
+// rows of length `params.Cols`
+func NewLinearServer[T m.Elem](
+	weights [][]float64,
+	params *LinearParams,
+	seed *rand.PRGKey,
+	mode Mode,
+) (*LinearServer[T], error) {
+	if err := params.Check(); err != nil {
+		return nil, err
+	}
+	if !crypto.CheckParams(T(0).Bitlen(), params.Cols, params.P) {
+		return nil, fmt.Errorf("no LWE parameters for P = %v and %v cols", params.P, params.Cols)
+	}
+
+	// Encode `W` into Z_p with one row per DB row
+	data := make([]m.Elem32, 0, uint64(len(weights))*params.Cols)
+	for i, row := range weights {
+		if uint64(len(row)) != params.Cols {
+			return nil, fmt.Errorf("row %v has %v weights instead of %v", i, len(row), params.Cols)
+		}
+		for _, w := range row {
+			v, err := params.encode(w, params.WeightScale, params.MaxWeight)
+			if err != nil {
+				return nil, fmt.Errorf("weight (%v): %v", i, err)
+			}
+			data = append(data, m.Elem32(v))
+		}
+	}
+	bitsPer := uint64(math.Floor(math.Log2(float64(params.P))))
+	db := NewDB(data, bitsPer, params.Cols, params.P, RowMajor, false)
+
+	ctx := crypto.NewContext[T](T(0).Bitlen(), params.Cols, params.P)
+	if params.Flood {
+		if err := ctx.Params.EnableFlooding(db.Info.L); err != nil {
+			ctx.Free()
+			return nil, err
+		}
+	}
+	server := MakeSimpleServerFromDB[T](db, ctx, seed, mode, false, false)
+	server.SetBatch(1)
+	return &LinearServer[T]{params, uint64(len(weights)), server}, nil
+}
+
+func (s *LinearServer[T]) Hint() *LinearHint[T] {
+	return &LinearHint[T]{Params: s.params, Rows: s.rows, Hint: s.server.Hint()}
+}
+
+func (s *LinearServer[T]) Answer(query Query[T]) Answer[T] {
+	return s.server.Answer([]Query[T]{query})[0]
+}
+
+func (s *LinearServer[T]) Free() {
+	s.server.Free()
+}
+
+/*
+* Client
+ */
+
+type LinearClient[T m.Elem] struct {
+	params *LinearParams
+	rows   uint64
+	client *SimpleClient[T]
+}
+
+func (c *LinearClient[T]) Init(hint *LinearHint[T]) {
+	if err := hint.Params.Check(); err != nil {
+		panic(err)
+	}
+	c.params = hint.Params
+	c.rows = hint.Rows
+	c.client = &SimpleClient[T]{}
+	c.client.Init(hint.Hint)
+}
+
+// Encrypt the input `x` of length `Cols`. Returns an error if any input is out
+// of range.
+func (c *LinearClient[T]) Query(x []float64) (Secret[T], Query[T], error) {
+	if uint64(len(x)) != c.params.Cols {
+		return nil, nil, fmt.Errorf("input has length %v instead of %v", len(x), c.params.Cols)
+	}
+	input := m.New[T](c.params.Cols, 1)
+	for j, v := range x {
+		e, err := c.params.encode(v, c.params.InputScale, c.params.MaxInput)
+		if err != nil {
+			return nil, nil, fmt.Errorf("input (%v): %v", j, err)
+		}
+		input.Set(uint64(j), 0, T(e))
+	}
+	secrets, queries := c.client.Query([]*m.Matrix[T]{input})
+	return secrets[0], queries[0], nil
+}
+
+// Decrypt `W * x` from the answer to a query
+func (c *LinearClient[T]) Recover(secret Secret[T], answer Answer[T]) ([]float64, error) {
+	results, err := c.client.Recover([]Secret[T]{secret}, []Answer[T]{answer})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]float64, c.rows)
+	for i := range out {
+		out[i] = c.params.decode(uint64(results[0].Get(uint64(i), 0)))
+	}
+	return out, nil
+}
+
+func (c *LinearClient[T]) Free() {
+	c.client.Free()
+}
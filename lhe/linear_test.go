@@ -0,0 +1,110 @@
+package lhe
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ryanleh/secure-inference/crypto/rand"
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+func TestLinearParams(t *testing.T) {
+	params := &LinearParams{P: 1 << 16, Cols: 64, WeightScale: 4, InputScale: 4, MaxWeight: 2, MaxInput: 4}
+	if err := params.Check(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if params.MaxOutput() != 64*2*4 {
+		t.Fatalf("Unexpected output bound %v", params.MaxOutput())
+	}
+
+	// Signed values round-trip through Z_p
+	for _, v := range []float64{0, 1.25, -1.25, -4, 4, 0.1} {
+		e, err := params.encode(v, params.InputScale, params.MaxInput)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if e >= params.P || params.decode(e)*params.WeightScale != math.Round(v*params.InputScale)/params.InputScale {
+			t.Fatalf("Encoding failure: %v -> %v", v, e)
+		}
+	}
+	for _, v := range []float64{4.5, -5, math.NaN(), math.Inf(1)} {
+		if _, err := params.encode(v, params.InputScale, params.MaxInput); err == nil {
+			t.Fatalf("Out of range value %v accepted", v)
+		}
+	}
+
+	// Layers whose outputs can wrap around mod P are rejected
+	params.Cols = 1 << 10
+	if params.Check() == nil {
+		t.Fatalf("Overflowing parameters accepted")
+	}
+}
+
+func testLinear[T m.Elem](t *testing.T, mode Mode, flood bool) {
+	params := &LinearParams{P: 1 << 8, Cols: 16, WeightScale: 2, InputScale: 2, MaxWeight: 1, MaxInput: 1, Flood: flood}
+	rows := 10
+	if flood {
+		// Flooding noise grows with the number of rows, and at this `P` there
+		// is only room to flood a single row
+		rows = 1
+	}
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	random := func() float64 {
+		return float64(int64(prg.Uint64()%5)-2) / 2
+	}
+
+	weights := make([][]float64, rows)
+	for i := range weights {
+		weights[i] = make([]float64, params.Cols)
+		for j := range weights[i] {
+			weights[i][j] = random()
+		}
+	}
+	server, err := NewLinearServer[T](weights, params, &key, mode)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer server.Free()
+
+	client := &LinearClient[T]{}
+	client.Init(server.Hint())
+	defer client.Free()
+
+	x := make([]float64, params.Cols)
+	for j := range x {
+		x[j] = random()
+	}
+	secret, query, err := client.Query(x)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	result, err := client.Recover(secret, server.Answer(query))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, row := range weights {
+		expected := 0.0
+		for j, w := range row {
+			expected += w * x[j]
+		}
+		if result[i] != expected {
+			t.Fatalf("Output %v: %v vs. %v", i, result[i], expected)
+		}
+	}
+
+	x[0] = 2
+	if _, _, err := client.Query(x); err == nil {
+		t.Fatalf("Out of range input accepted")
+	}
+}
+
+func TestLinear32(t *testing.T) {
+	testLinear[m.Elem32](t, None, false)
+	testLinear[m.Elem32](t, Hybrid, false)
+}
+
+func TestLinear64(t *testing.T) {
+	testLinear[m.Elem64](t, None, false)
+	testLinear[m.Elem64](t, Hybrid, false)
+	testLinear[m.Elem64](t, None, true)
+}
@@ -1,6 +1,7 @@
 package lhe
 
 import (
+    "math"
     "unsafe"
 	
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -11,7 +12,9 @@ import (
  */
 type LocalHint[T m.Elem] struct {
 	DB *m.Matrix[T]
+    N       uint64 // number of DB entries
     BitsPer uint64
+	Layout  Layout
 }
 
 type LocalSecret[T m.Elem] struct {
@@ -29,18 +32,26 @@ func (e *Empty[T]) Size() uint64 {
 	return 0
 }
 
+func (h *LocalHint[T]) Type() LHEType {
+	return Local
+}
+
 /*
 * Client
  */
 type LocalClient[T m.Elem] struct {
 	db *m.Matrix[T]
+    num     uint64
     bitsPer uint64
+	layout  Layout
 }
 
 func (c *LocalClient[T]) Init(h Hint[T]) {
 	hint := h.(*LocalHint[T])
 	c.db = hint.DB
+    c.num = hint.N
     c.bitsPer = hint.BitsPer
+	c.layout = hint.Layout
 }
 
 func (c *LocalClient[T]) Query(inputs []*m.Matrix[T]) ([]Secret[T], []Query[T]) {
@@ -59,7 +70,7 @@ func (c *LocalClient[T]) DummyQuery(num uint64) ([]Secret[T], []Query[T]) {
 	return secrets, queries
 }
 
-func (c *LocalClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) []*m.Matrix[T] {
+func (c *LocalClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) ([]*m.Matrix[T], error) {
 	results := make([]*m.Matrix[T], 0, len(secrets))
 	for i := range secrets {
 		if secrets[i] != nil {
@@ -68,16 +79,19 @@ func (c *LocalClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) []*m.
 			results = append(results, result)
 		}
 	}
-	return results
+	return results, nil
 }
 
 func (c *LocalClient[T]) DBInfo() *DBInfo {
-    return newDBInfo(c.db.Size(), c.bitsPer, c.db.Cols(), 0)
+    // The DB matrix may be padded past the last entry
+    info := NewDBInfo(c.num, c.bitsPer, c.db.Cols(), 0)
+	info.Layout = c.layout
+	return info
 }
 
 func (c *LocalClient[T]) StateSize() uint64 {
 	// Just returns the size of the matrix
-	return c.db.Size() * 4
+	return c.db.Size() * T(0).Bitlen() / 8
 }
 
 func (c *LocalClient[T]) Free() {}
@@ -87,23 +101,47 @@ func (c *LocalClient[T]) Free() {}
  */
 
 type LocalServer[T m.Elem] struct {
-	db *m.Matrix[T]
-    bitsPer uint64
+	db  *m.Matrix[T]
+    raw *DB // `db` before conversion to `T`
 }
 
 func MakeLocalServer[T m.Elem](matrix *m.Matrix[m.Elem32], bitsPer uint64) *LocalServer[T] {
-    // TODO: Tmp
+	return makeLocalServer[T](matrix, bitsPer, RowMajor)
+}
+
+func makeLocalServer[T m.Elem](matrix *m.Matrix[m.Elem32], bitsPer uint64, layout Layout) *LocalServer[T] {
+    // Lay the data out so that the limbs of each entry are stacked vertically
+    // in the entry's column, matching the layout of an encoded `DB`
+    numLimbs := uint64(math.Ceil(float64(bitsPer) / 32.0))
+    data := matrix.Data()
+    if uint64(len(data))%numLimbs != 0 {
+        panic("Invalid data")
+    }
+    db := NewEmptyDB(uint64(len(data))/numLimbs, bitsPer, matrix.Cols(), 0, layout)
+    for i := range uint64(len(data)) / numLimbs {
+        db.SetEntry(i, data[i*numLimbs:(i+1)*numLimbs])
+    }
+    return MakeLocalServerFromDB[T](db)
+}
+
+// Create a local server from a DB of raw limbs (i.e., with `P = 0`)
+func MakeLocalServerFromDB[T m.Elem](db *DB) *LocalServer[T] {
+    if db.Info.P != 0 {
+        panic("Local DB must store raw limbs")
+    }
+
     switch T(0).Bitlen() {
     case 32:
-        return &LocalServer[T]{(*m.Matrix[T])(unsafe.Pointer(matrix)), bitsPer}
+        return &LocalServer[T]{(*m.Matrix[T])(unsafe.Pointer(db.Data)), db}
     case 64:
-        panic("Unimplemented")
+        return &LocalServer[T]{any(db.Data.Make64()).(*m.Matrix[T]), db}
     }
     return nil
 }
 
 func (s *LocalServer[T]) Hint() Hint[T] {
-    return &LocalHint[T]{DB: s.db, BitsPer: s.bitsPer}
+    info := s.raw.Info
+    return &LocalHint[T]{DB: s.db, N: info.N, BitsPer: info.BitsPer, Layout: info.Layout}
 }
 
 func (s *LocalServer[T]) SetBatch(batch uint64) {}
@@ -117,11 +155,16 @@ func (s *LocalServer[T]) Answer(queries []Query[T]) []Answer[T] {
 }
 
 func (s *LocalServer[T]) DB() *DB {
-	return nil
+	return s.raw
 }
 
 func (s *LocalServer[T]) StateSize() uint64 {
-	panic("Unimplemented")
+	// Just returns the size of the matrix, plus the raw DB if it was converted
+	size := s.db.Size() * T(0).Bitlen() / 8
+	if T(0).Bitlen() != 32 {
+		size += s.raw.Data.Size() * 4
+	}
+	return size
 }
 
 func (s *LocalServer[T]) Free() {}
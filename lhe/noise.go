@@ -0,0 +1,145 @@
+package lhe
+
+import (
+	"math"
+)
+
+import (
+	m "github.com/ryanleh/secure-inference/matrix"
+)
+
+// Noise reporting for SimplePIR-based LHE. After removing `H * s`, each
+// element of an answer is `Delta * v + noise`, and decrypts correctly as long
+// as the noise is below `Delta / 2`. The client can't tell a correct
+// decryption from an incorrect one, but noise close to the rounding boundary
+// (see `crypto.Params.SuspectBound`) is very unlikely in a correct decryption,
+// so such elements are flagged as likely failures.
+//
+// Noise is measured relative to the nearest plaintext, so it is exact for
+// every element that decrypts correctly.
+
+// Noise in a recovered answer
+type NoiseReport struct {
+	// Noise of each element
+	Noise []float64
+
+	// Distance of each element's noise from the rounding boundary
+	Margins []float64
+
+	// Elements whose noise is close enough to the rounding boundary that they
+	// likely decrypted incorrectly
+	Suspect []uint64
+}
+
+// The smallest margin of any element
+func (r *NoiseReport) MinMargin() float64 {
+	margin := math.Inf(1)
+	for _, v := range r.Margins {
+		margin = min(margin, v)
+	}
+	return margin
+}
+
+// Whether any element likely decrypted incorrectly
+func (r *NoiseReport) Failed() bool {
+	return len(r.Suspect) > 0
+}
+
+func (c *SimpleClient[T]) noiseReport(noised *m.Matrix[T]) *NoiseReport {
+	params := c.ctx.Params
+	boundary := params.DecryptionBound()
+	bound := params.SuspectBound()
+	report := &NoiseReport{
+		Noise:   make([]float64, noised.Size()),
+		Margins: make([]float64, noised.Size()),
+	}
+	for i, v := range noised.Data() {
+		// Hybrid answers are rounded exactly (see `rlwe.Context.RoundLWEInplace`)
+		var noise float64
+		if c.mode == Hybrid {
+			noise = params.ExactNoise(uint64(v))
+		} else {
+			noise = params.Noise(uint64(v))
+		}
+		report.Noise[i] = noise
+		report.Margins[i] = boundary - math.Abs(noise)
+		if math.Abs(noise) > bound {
+			report.Suspect = append(report.Suspect, uint64(i))
+		}
+	}
+	return report
+}
+
+/*
+* Diagnostics
+ */
+
+// Empirical noise statistics of answers
+type NoiseStats struct {
+	Samples uint64 // Number of elements measured
+	Mean    float64
+	StdDev  float64
+	Max     float64 // Largest noise magnitude
+	Suspect uint64  // Elements flagged as likely failures
+
+	// Noise bounds of the parameters (see `crypto.Params`)
+	NoiseBound      float64
+	SuspectBound    float64
+	DecryptionBound float64
+}
+
+// Estimated probability that a single element decrypts incorrectly, assuming
+// gaussian noise with the measured mean and stddev
+func (s *NoiseStats) FailureProb() float64 {
+	if s.StdDev == 0 {
+		return 0
+	}
+	lo := (-s.DecryptionBound - s.Mean) / (s.StdDev * math.Sqrt2)
+	hi := (s.DecryptionBound - s.Mean) / (s.StdDev * math.Sqrt2)
+	return (math.Erfc(-lo) + math.Erfc(hi)) / 2
+}
+
+// Measure the noise of answers from `server` over `runs` batches of `batch`
+// queries for random DB columns, to validate parameter choices empirically.
+// Queries select a single column, as PIR queries do: the noise bounds only hold
+// while the product of the DB and the input doesn't wrap around mod `P`. The
+// noise of answers over a real DB may be well below the bounds, which assume
+// uniform DB elements.
+func MeasureNoise[T m.Elem](client *SimpleClient[T], server Server[T], runs, batch int) *NoiseStats {
+	params := client.ctx.Params
+	stats := &NoiseStats{
+		NoiseBound:      params.NoiseBound(),
+		SuspectBound:    params.SuspectBound(),
+		DecryptionBound: params.DecryptionBound(),
+	}
+	server.SetBatch(uint64(batch))
+
+	var sum, sumSq float64
+	for range runs {
+		inputs := make([]*m.Matrix[T], batch)
+		for i := range inputs {
+			inputs[i] = m.New[T](client.dbInfo.M, 1)
+			inputs[i].Set(client.prg.Uint64()%client.dbInfo.M, 0, 1)
+		}
+		secrets, queries := client.Query(inputs)
+		_, reports, err := client.RecoverWithNoise(secrets, server.Answer(queries))
+		if err != nil {
+			// Secrets are fresh, so this is unreachable
+			panic(err)
+		}
+		for _, report := range reports {
+			for _, noise := range report.Noise {
+				sum += noise
+				sumSq += noise * noise
+				stats.Max = max(stats.Max, math.Abs(noise))
+			}
+			stats.Samples += uint64(len(report.Noise))
+			stats.Suspect += uint64(len(report.Suspect))
+		}
+	}
+	if stats.Samples > 0 {
+		stats.Mean = sum / float64(stats.Samples)
+		stats.StdDev = math.Sqrt(max(sumSq/float64(stats.Samples)-stats.Mean*stats.Mean, 0))
+	}
+	return stats
+}
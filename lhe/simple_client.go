@@ -1,7 +1,11 @@
 package lhe
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/crypto/oprf"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/crypto/rlwe"
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -27,6 +31,30 @@ type SimpleClient[T m.Elem] struct {
     // TODO: This currently is only supported when running with the `service`
     // folder
     compressHint bool
+
+	// Whether the hint is shared with another client
+	sharedHint bool
+
+	// Whether the server is a symmetric PIR server, in which case queries
+	// must be made with `QueryEntries`
+	symmetric bool
+
+	// Whether secrets may recover more than one answer (see
+	// `AllowSecretReuse`)
+	reuse bool
+}
+
+// Returned by `Recover` when a secret recovers more than one answer
+var ErrSecretReused = errors.New("LWE secret used to recover more than one answer")
+
+// Allow secrets to recover more than one answer, for benchmarks that answer
+// the same queries repeatedly. Secrets are then no longer freed by `Recover`,
+// so must be freed by the caller.
+//
+// NOTE: This is insecure outside of benchmarks, since answers to the same
+// query leak information about the secret.
+func (c *SimpleClient[T]) AllowSecretReuse() {
+	c.reuse = true
 }
 
 func (c *SimpleClient[T]) Init(h Hint[T]) {
@@ -38,16 +66,22 @@ func (c *SimpleClient[T]) Init(h Hint[T]) {
 	c.mode = hint.Mode
 	c.hint = hint.Hint
     c.compressHint = hint.CompressHint
+	c.sharedHint = hint.Shared
+	c.symmetric = hint.Symmetric
 
 	// Initialize crypto contexts
-	c.ctx = crypto.NewContext[T](hint.Params.LogQ, hint.Params.M, hint.Params.P)
+	c.ctx = crypto.NewContextWithOptions[T](hint.Params.LogQ, hint.Params.M, hint.Params.P, hint.Params.Options())
 
 	// Generate A matrices
 	if hint.Mode == Hybrid {
+		if c.ctx.RingContext == nil {
+			panic("Hybrid mode requires a secret dimension SEAL supports")
+		}
 		prg := rand.NewBufPRG(rand.NewPRG(hint.Seed))
 		seeds, numA := GenASeeds[T](prg, c.dbInfo, c.ctx.RingContext)
 		c.polysA = make([]*rlwe.A, numA)
 		key := c.ctx.RingContext.NewKey()
+		defer key.Close()
 		for i := range c.polysA {
 			seed := seeds[i*rlwe.SealSeedLength : (i+1)*rlwe.SealSeedLength]
 			c.polysA[i] = rlwe.NewA(key, seed)
@@ -59,6 +93,33 @@ func (c *SimpleClient[T]) Init(h Hint[T]) {
 }
 
 func (c *SimpleClient[T]) Query(inputs []*m.Matrix[T]) ([]Secret[T], []Query[T]) {
+	if c.symmetric {
+		panic("Symmetric PIR servers must be queried with QueryEntries")
+	}
+	return c.query(inputs)
+}
+
+// Query the DB entries at `indices`, one query each. For symmetric PIR
+// servers, each query also requests the pad of its entry, so that `Recover`
+// only reveals the queried entry rather than its whole DB column.
+func (c *SimpleClient[T]) QueryEntries(indices []uint64) ([]Secret[T], []Query[T]) {
+	inputs := make([]*m.Matrix[T], len(indices))
+	for i, idx := range indices {
+		inputs[i] = m.New[T](c.dbInfo.M, 1)
+		inputs[i].Set(c.dbInfo.Column(idx), 0, 1)
+	}
+	secrets, queries := c.query(inputs)
+	if c.symmetric {
+		for i, idx := range indices {
+			secret := secrets[i].(*SimpleSecret[T])
+			secret.index = idx
+			secret.blind, queries[i].(*SimpleQuery[T]).Request = oprf.NewBlind(c.prg, entryInput(idx))
+		}
+	}
+	return secrets, queries
+}
+
+func (c *SimpleClient[T]) query(inputs []*m.Matrix[T]) ([]Secret[T], []Query[T]) {
 	secrets := make([]Secret[T], len(inputs))
 	queries := make([]Query[T], len(inputs))
 	if c.mode == Hybrid {
@@ -67,13 +128,12 @@ func (c *SimpleClient[T]) Query(inputs []*m.Matrix[T]) ([]Secret[T], []Query[T])
 			// Sample secret key
 			rlweSecret := c.ctx.RingContext.NewKey()
 			innerSecret := c.ctx.RingContext.ExtractLWEKey(rlweSecret)
-			secret := &SimpleSecret[T]{innerSecret, rlweSecret}
+			secret := newSecret(innerSecret, rlweSecret)
 
 			// For each `a` polynomial, compute `a * s + e + delta * m`
 			query := &SimpleQuery[T]{FastQuery: make([]CipherBlob, len(c.polysA))}
 			for j, polyA := range c.polysA {
 				ct := rlwe.NewCiphertext()
-				defer ct.Free()
 
 				// Extract data to embed in this ciphertext
 				start := uint64(j) * c.ctx.Params.N
@@ -84,6 +144,7 @@ func (c *SimpleClient[T]) Query(inputs []*m.Matrix[T]) ([]Secret[T], []Query[T])
 				secret.rlweSecret.PreprocessEnc(polyA, ct)
 				c.ctx.RingContext.EncryptPreprocessed(secret.rlweSecret, data, ct)
 				query.FastQuery[j] = ct.StoreData()
+				ct.Close()
 			}
 			secrets[i] = secret
 			queries[i] = query
@@ -91,11 +152,11 @@ func (c *SimpleClient[T]) Query(inputs []*m.Matrix[T]) ([]Secret[T], []Query[T])
 	} else {
 		for i := range inputs {
 			// Sample secret key
-			secret := &SimpleSecret[T]{innerSecret: m.Gaussian[T](c.prg, c.ctx.Params.N, 1)}
+			secret := newSecret[T](c.sampleSecret(), nil)
 
 			// Compute `A * s + e + delta * m`
 			query := &SimpleQuery[T]{}
-			err := m.Gaussian[T](c.prg, c.dbInfo.M, 1)
+			err := m.GaussianFrom[T](c.prg, c.ctx.Sampler, c.dbInfo.M, 1)
 			matrixAseeded := m.NewSeeded[T](
 				[]m.IoRandSource{rand.NewBufPRG(rand.NewPRG(c.seedA))},
 				[]uint64{c.dbInfo.M},
@@ -121,6 +182,20 @@ func (c *SimpleClient[T]) Query(inputs []*m.Matrix[T]) ([]Secret[T], []Query[T])
 	return secrets, queries
 }
 
+// Sample an LWE secret from the distribution of the parameters
+func (c *SimpleClient[T]) sampleSecret() *m.Matrix[T] {
+	switch c.ctx.Params.Secret {
+	case crypto.Gaussian:
+		return m.GaussianFrom[T](c.prg, c.ctx.Sampler, c.ctx.Params.N, 1)
+	case crypto.Ternary:
+		return m.Ternary[T](c.prg, c.ctx.Params.N, 1)
+	case crypto.Binary:
+		return m.Binary[T](c.prg, c.ctx.Params.N, 1)
+	default:
+		panic("Invalid secret distribution")
+	}
+}
+
 func (c *SimpleClient[T]) DummyQuery(num uint64) ([]Secret[T], []Query[T]) {
 	secrets := make([]Secret[T], num)
 	queries := make([]Query[T], num)
@@ -152,11 +227,48 @@ func (c *SimpleClient[T]) DummyQuery(num uint64) ([]Secret[T], []Query[T]) {
 			queries[i] = query
 		}
 	}
+
+	// Dummy queries request the pad of a random entry, so that they look
+	// like real queries to a symmetric PIR server
+	if c.symmetric {
+		for i := range queries {
+			_, request := oprf.NewBlind(c.prg, entryInput(c.prg.Uint64()%c.dbInfo.N))
+			queries[i].(*SimpleQuery[T]).Request = request
+		}
+	}
 	return secrets, queries
 }
 
-func (c *SimpleClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) []*m.Matrix[T] {
+// Decrypt answers. Secrets are single-use: `Recover` closes them, and returns
+// `ErrSecretReused` if any of them already recovered an answer. For symmetric
+// PIR servers, it also fails if an answer lacks a valid OPRF response.
+//
+// With hint compression, the caller sets the inner secret of each secret to its
+// hint token (see `SimpleSecret.SetInner`), so it owns the secrets and must
+// close them itself.
+func (c *SimpleClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) ([]*m.Matrix[T], error) {
+	results, _, err := c.recover(secrets, answers, false)
+	return results, err
+}
+
+// Recover answers along with a report of the noise in each, which flags
+// elements that likely decrypted incorrectly (see `NoiseReport`)
+func (c *SimpleClient[T]) RecoverWithNoise(secrets []Secret[T], answers []Answer[T]) ([]*m.Matrix[T], []*NoiseReport, error) {
+	return c.recover(secrets, answers, true)
+}
+
+func (c *SimpleClient[T]) recover(secrets []Secret[T], answers []Answer[T], report bool) ([]*m.Matrix[T], []*NoiseReport, error) {
+	// Secrets are single-use, so check them all before using any
+	if !c.reuse {
+		for i := range len(answers) {
+			if secrets[i].(*SimpleSecret[T]).used {
+				return nil, nil, ErrSecretReused
+			}
+		}
+	}
+
 	results := make([]*m.Matrix[T], 0, len(answers))
+	var reports []*NoiseReport
 
 	for i := range len(answers) {
 		// Probably bad code where we type cast to the specific impl of the interface
@@ -167,10 +279,11 @@ func (c *SimpleClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) []*m
 			continue
 		}
 
-        // TODO: E2E tests currently rerun with the same secret multiple times
-        if !c.compressHint {
-            defer secret.Free()
-        }
+		// Used secrets are zeroized, unless the caller owns them
+		secret.used = true
+		if !c.reuse && !c.compressHint {
+			defer secret.Close()
+		}
 
 		var answer *SimpleAnswer[T]
 		if c.dbInfo.GPU {
@@ -180,7 +293,10 @@ func (c *SimpleClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) []*m
 			for j := range a.Rows() {
 				colCopy.Data()[j] = a.Get(j, uint64(i))
 			}
-			answer = &SimpleAnswer[T]{colCopy}
+			answer = &SimpleAnswer[T]{Answer: colCopy}
+			if responses := answers[0].(*SimpleAnswer[T]).Responses; c.symmetric && i < len(responses) {
+				answer.Responses = responses[i : i+1]
+			}
 		} else {
 			answer = answers[i].(*SimpleAnswer[T])
 		}
@@ -196,6 +312,9 @@ func (c *SimpleClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) []*m
 		// Subtract `H*s` from ciphertext
 		ans := answer.Answer
 		ans.Sub(token)
+		if report {
+			reports = append(reports, c.noiseReport(ans))
+		}
 
 		// Round to recover final result
 		//
@@ -212,9 +331,36 @@ func (c *SimpleClient[T]) Recover(secrets []Secret[T], answers []Answer[T]) []*m
 				result.Set(row, 0, T(denoised%c.dbInfo.P))
 			}
 		}
+		if c.symmetric {
+			var err error
+			if result, err = c.unmask(secret, answer, result); err != nil {
+				return nil, nil, err
+			}
+		}
 		results = append(results, result)
 	}
-	return results
+	return results, reports, nil
+}
+
+// Remove the pad from the queried entry in the decrypted column `column`. All
+// other entries are masked by pads the client can't compute, so are zeroed.
+func (c *SimpleClient[T]) unmask(secret *SimpleSecret[T], answer *SimpleAnswer[T], column *m.Matrix[T]) (*m.Matrix[T], error) {
+	if secret.blind == nil || len(answer.Responses) == 0 {
+		return nil, fmt.Errorf("symmetric PIR answer without an OPRF response")
+	}
+	output, err := secret.blind.Finalize(answer.Responses[0])
+	if err != nil {
+		return nil, err
+	}
+	pad := entryPad(output, c.dbInfo)
+
+	result := m.Zeros[T](column.Rows(), 1)
+	row := c.dbInfo.Row(secret.index)
+	for j := range c.dbInfo.Ne {
+		val := (uint64(column.Get(row+j, 0)) + c.dbInfo.P - pad[j]) % c.dbInfo.P
+		result.Set(row+j, 0, T(val))
+	}
+	return result, nil
 }
 
 func (c *SimpleClient[T]) DBInfo() *DBInfo {
@@ -222,17 +368,34 @@ func (c *SimpleClient[T]) DBInfo() *DBInfo {
 }
 
 func (c *SimpleClient[T]) StateSize() uint64 {
-	// Just returns the size of the hint
-	if c.hint != nil {
+	// Just returns the size of the hint, unless it is stored by another client
+	if c.hint != nil && !c.sharedHint {
 		return c.hint.Size() * T(0).Bitlen() / 8
 	}
 	return 0
 }
 
+// Create a client sharing the hint and crypto objects of `c`, e.g. to generate
+// queries concurrently. Both clients must be freed.
+func (c *SimpleClient[T]) Fork() *SimpleClient[T] {
+	fork := *c
+	fork.ctx = c.ctx.Retain()
+	fork.polysA = make([]*rlwe.A, len(c.polysA))
+	for i, a := range c.polysA {
+		fork.polysA[i] = a.Retain()
+	}
+	fork.prg = rand.NewRandomBufPRG()
+	return &fork
+}
+
+// Must call to free C++ memory. Freeing a client more than once is a no-op.
 func (c *SimpleClient[T]) Free() {
-	// Must call to free C++ memory
-	c.ctx.Free()
+	if c.ctx != nil {
+		c.ctx.Free()
+		c.ctx = nil
+	}
 	for i := range c.polysA {
-		c.polysA[i].Free()
+		c.polysA[i].Close()
 	}
+	c.polysA = nil
 }
@@ -4,10 +4,12 @@ import (
 	"encoding/binary"
 	"io"
 	"math"
+	"runtime"
 )
 
 import (
 	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/crypto/oprf"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	"github.com/ryanleh/secure-inference/crypto/rlwe"
 	m "github.com/ryanleh/secure-inference/matrix"
@@ -32,12 +34,55 @@ type SimpleHint[T m.Elem] struct {
 	Hint         *m.Matrix[T]
 	Mode         Mode
     CompressHint bool
+
+	// Whether `Hint` is a view of a hint the client already stores (see
+	// `RestoreHint`)
+	Shared bool
+
+	// Whether the server only reveals queried entries (see
+	// `MakeSymmetricServerFromDB`)
+	Symmetric bool
+}
+
+// A copy of `h` without the hint matrix, for servers created with `Prefix`
+// whose hint the client can derive instead
+func DropHint[T m.Elem](h Hint[T]) Hint[T] {
+	hint := *h.(*SimpleHint[T])
+	hint.Hint = nil
+	return &hint
+}
+
+// Restore the hint matrix of `h`, which was dropped with `DropHint`, from the
+// hint of the server that `h`'s server is a prefix of
+func RestoreHint[T m.Elem](h Hint[T], from Hint[T]) Hint[T] {
+	hint := *h.(*SimpleHint[T])
+	full := from.(*SimpleHint[T])
+	if full.Hint == nil || *full.Seed != *hint.Seed || full.DBInfo.M != hint.DBInfo.M {
+		panic("Hint is not a prefix of the given hint")
+	}
+	hint.Hint = full.Hint.GetRow(0, hint.DBInfo.L)
+	hint.Shared = true
+	return &hint
+}
+
+func (h *SimpleHint[T]) Type() LHEType {
+	if h.Mode == Hybrid {
+		return SimpleHybrid
+	}
+	return Simple
 }
 
 // Secret
 type SimpleSecret[T m.Elem] struct {
 	innerSecret *m.Matrix[T] // Regev secret key or decryption helper
 	rlweSecret  *rlwe.Key    // RLWE-encoding of secret key
+
+	// For symmetric PIR, the queried entry and the OPRF state for its pad
+	index uint64
+	blind *oprf.Blind
+
+	// Whether the secret has been used to recover an answer
+	used bool
 }
 
 func (s *SimpleSecret[T]) GetInner() *m.Matrix[T] {
@@ -48,16 +93,33 @@ func (s *SimpleSecret[T]) SetInner(m *m.Matrix[T]) {
     s.innerSecret = m
 }
 
-func (s *SimpleSecret[T]) Free() {
+// A secret that is zeroized by a finalizer if it is never closed
+func newSecret[T m.Elem](innerSecret *m.Matrix[T], rlweSecret *rlwe.Key) *SimpleSecret[T] {
+	secret := &SimpleSecret[T]{innerSecret: innerSecret, rlweSecret: rlweSecret}
+	runtime.SetFinalizer(secret, (*SimpleSecret[T]).Close)
+	return secret
+}
+
+// Zeroize and release the secret. Closing a secret more than once is a no-op.
+func (s *SimpleSecret[T]) Close() {
+	if s.innerSecret != nil {
+		clear(s.innerSecret.Data())
+		s.innerSecret = nil
+	}
 	if s.rlweSecret != nil {
-		s.rlweSecret.Free()
+		s.rlweSecret.Close()
+		s.rlweSecret = nil
 	}
+	s.blind = nil
 }
 
 // Query
 type SimpleQuery[T m.Elem] struct {
 	Query     *m.Matrix[T]
 	FastQuery []CipherBlob
+
+	// For symmetric PIR, the blinded index of the queried entry
+	Request []byte
 }
 
 func (q *SimpleQuery[T]) Size() uint64 {
@@ -70,12 +132,15 @@ func (q *SimpleQuery[T]) Size() uint64 {
 			size += uint64(len(query))
 		}
 	}
-	return size
+	return size + uint64(len(q.Request))
 }
 
 // Answer
 type SimpleAnswer[T m.Elem] struct {
 	Answer *m.Matrix[T]
+
+	// For symmetric PIR, the OPRF evaluation of each answered query's request
+	Responses [][]byte
 }
 
 func (a *SimpleAnswer[T]) Size() uint64 {
@@ -83,6 +148,9 @@ func (a *SimpleAnswer[T]) Size() uint64 {
 	if a.Answer != nil {
 		size += (T(0).Bitlen() * a.Answer.Size()) / 8
 	}
+	for _, response := range a.Responses {
+		size += uint64(len(response))
+	}
 	return size
 }
 
@@ -96,6 +164,24 @@ func (a *SimpleAnswer[T]) answer() {}
 * Util functions
  */
 
+// The OPRF input for entry `i`
+func entryInput(i uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, i)
+}
+
+// The pad masking an entry in symmetric PIR, derived from the PRF output on its
+// index
+func entryPad(output []byte, info *DBInfo) []uint64 {
+	var key rand.PRGKey
+	copy(key[:], output)
+	prg := rand.NewBufPRG(rand.NewPRG(&key))
+	pad := make([]uint64, info.Ne)
+	for j := range pad {
+		pad[j] = prg.Uint64() % info.P
+	}
+	return pad
+}
+
 // Sample a random SEAL seed
 func SampleSEALSeeds(prg *rand.BufPRGReader, num int) []uint64 {
 	// SEAL uses 512-bit seeds
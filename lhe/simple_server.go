@@ -4,6 +4,7 @@ import (
     mrand "math/rand"
 
 	"github.com/ryanleh/secure-inference/crypto"
+	"github.com/ryanleh/secure-inference/crypto/oprf"
 	"github.com/ryanleh/secure-inference/crypto/rand"
 	m "github.com/ryanleh/secure-inference/matrix"
 	"github.com/ryanleh/secure-inference/matrix/gpu"
@@ -31,6 +32,12 @@ type SimpleServer[T m.Elem] struct {
     // TODO: This currently is only supported when running with the `service`
     // folder
     compressHint bool
+
+	// For symmetric PIR, the key of the PRF masking each entry
+	prfKey *oprf.Key
+
+	// Randomness for flooding answers, if enabled
+	prg *rand.BufPRGReader
 }
 
 func MakeSimpleServer[T m.Elem](
@@ -44,10 +51,42 @@ func MakeSimpleServer[T m.Elem](
 ) *SimpleServer[T] {
 	params := cryptoCtx.Params
 
-	// Encode the matrix into a DB and initialize the GPU context if available
-	db := NewDB(matrix.Data(), dbElemBits, params.M, params.P, bench)
+	// Encode the matrix into a DB
+	db := NewDB(matrix.Data(), dbElemBits, params.M, params.P, RowMajor, bench)
 	//println("DB with size: ", db.Data.Rows(), ", ", db.Data.Cols(), "-- P = ", params.P)
 
+	return MakeSimpleServerFromDB[T](db, cryptoCtx, seed, mode, compressHint, bench)
+}
+
+// Create a server from an already-encoded DB. The DB must have been encoded
+// using the same number of columns and plaintext modulus as `cryptoCtx`.
+//
+// In Hybrid mode, clients sample secrets with SEAL, which always generates
+// gaussian secrets, so `cryptoCtx` must use gaussian secrets and a secret
+// dimension SEAL supports.
+func MakeSimpleServerFromDB[T m.Elem](
+	db *DB,
+	cryptoCtx *crypto.Context[T],
+	seed *rand.PRGKey,
+	mode Mode,
+    compressHint bool,
+	bench bool, // TODO: Remove
+) *SimpleServer[T] {
+	params := cryptoCtx.Params
+	if db.Info.M != params.M || db.Info.P != params.P {
+		panic("DB does not match crypto parameters")
+	}
+	if params.Centered && !db.Info.Centered {
+		panic("Centered parameters require a centered DB")
+	}
+	if mode == Hybrid && params.Secret != crypto.Gaussian {
+		panic("Hybrid mode only supports gaussian secrets")
+	}
+	if mode == Hybrid && cryptoCtx.RingContext == nil {
+		panic("Hybrid mode requires a secret dimension SEAL supports")
+	}
+
+	// Initialize the GPU context if available
 	var gpuCtx *gpu.Context[T]
 	if gpu.UseGPU() {
 		gpuCtx = gpu.NewContext[T](db.Info.L, db.Info.M, params.N)
@@ -70,9 +109,15 @@ func MakeSimpleServer[T m.Elem](
 			} else {
 				hint = m.Mul(db.Data, matrixA)
 			}
+			if db.Info.Centered {
+				centerHint(hint, m.Mul(biasRow(db.Info), matrixA))
+			}
 		} else {
 			seeds, numA := GenASeeds[T](prg, db.Info, cryptoCtx.RingContext)
 			hint = cryptoCtx.RingContext.ComputeHint(db.Data, seeds, numA)
+			if db.Info.Centered {
+				centerHint(hint, cryptoCtx.RingContext.ComputeHint(biasRow(db.Info), seeds, numA))
+			}
 		}
 	}
 
@@ -85,6 +130,11 @@ func MakeSimpleServer[T m.Elem](
 		db.Squish()
 	}
 
+	var floodPRG *rand.BufPRGReader
+	if params.Flood != 0 {
+		floodPRG = rand.NewRandomBufPRG()
+	}
+
 	return &SimpleServer[T]{
 		seed,
 		mode,
@@ -93,6 +143,65 @@ func MakeSimpleServer[T m.Elem](
 		cryptoCtx,
 		gpuCtx,
         compressHint,
+		nil,
+		floodPRG,
+	}
+}
+
+// Create a symmetric PIR server from an already-encoded DB: each entry is
+// masked with a pad derived from a PRF on its index, and each query must come
+// with an OPRF request for the pad of the queried entry (see
+// `SimpleClient.QueryEntries`). A client thus learns a single entry per query,
+// rather than the whole DB column. `db` is masked in-place.
+func MakeSymmetricServerFromDB[T m.Elem](
+	db *DB,
+	cryptoCtx *crypto.Context[T],
+	seed *rand.PRGKey,
+	prfKey *oprf.Key,
+	mode Mode,
+	bench bool, // TODO: Remove
+) *SimpleServer[T] {
+	db.Mask(prfKey)
+	server := MakeSimpleServerFromDB[T](db, cryptoCtx, seed, mode, false, bench)
+	server.prfKey = prfKey
+	return server
+}
+
+// Create a server over the first `entries` entries of the DB, rounded up to a
+// whole number of DB rows. The new server shares the DB, seed and parameters
+// of `s`, so its hint is the first rows of the hint of `s` and is computed for
+// free. Clients holding the hint of `s` can derive it (see `RestoreHint`).
+func (s *SimpleServer[T]) Prefix(entries uint64) *SimpleServer[T] {
+	info := *s.db.Info
+	info.N = min(entries, info.N)
+	info.L = ((info.N + info.M - 1) / info.M) * info.Ne
+	db := &DB{Info: &info, Data: s.db.Data.GetRow(0, info.L)}
+
+	var gpuCtx *gpu.Context[T]
+	if s.gpuCtx != nil {
+		gpuCtx = gpu.NewContext[T](info.L, info.M, s.cryptoCtx.Params.N)
+		gpuCtx.Allocate(info.L, info.M, 1)
+		gpuCtx.SetA(db.Data)
+	}
+
+	var hint *m.Matrix[T]
+	if s.hint != nil {
+		hint = s.hint.GetRow(0, info.L)
+	}
+	var floodPRG *rand.BufPRGReader
+	if s.prg != nil {
+		floodPRG = rand.NewRandomBufPRG()
+	}
+	return &SimpleServer[T]{
+		s.seed,
+		s.mode,
+		db,
+		hint,
+		s.cryptoCtx.Retain(),
+		gpuCtx,
+		s.compressHint,
+		s.prfKey,
+		floodPRG,
 	}
 }
 
@@ -111,6 +220,7 @@ func (s *SimpleServer[T]) Hint() Hint[T] {
 		Mode:   s.mode,
         Hint:   s.hint,
         CompressHint: s.compressHint,
+		Symmetric:    s.prfKey != nil,
 	}
 	return hint
 }
@@ -148,10 +258,36 @@ func (s *SimpleServer[T]) Answer(queries []Query[T]) []Answer[T] {
 				s.gpuCtx.SetB(query.Query, int(s.db.Info.M)*i, false, false)
 			}
 		}
+		// Hybrid queries are only extracted on the device, so for centered
+		// DBs they are extracted again here to compute their offsets
+		var bias []T
+		if s.db.Info.Centered {
+			bias = make([]T, len(queries))
+			for i := range queries {
+				bias[i] = s.bias(s.hostQuery(queries[i].(*SimpleQuery[T])))
+			}
+		}
 
 		// Sync data and perform matrix computation
 		s.gpuCtx.SyncDevice(1)
-		answers[0] = &SimpleAnswer[T]{s.gpuCtx.GEMM()}
+		answers[0] = &SimpleAnswer[T]{Answer: s.gpuCtx.GEMM()}
+		if bias != nil {
+			answer := answers[0].(*SimpleAnswer[T]).Answer
+			for j := range answer.Rows() {
+				for i := range bias {
+					answer.Set(j, uint64(i), answer.Get(j, uint64(i))-bias[i])
+				}
+			}
+		}
+		if s.prg != nil {
+			s.flood(answers[0].(*SimpleAnswer[T]).Answer)
+		}
+
+		// The answer to every query is a column of the single answer, so it
+		// also carries the OPRF responses for every query
+		if s.prfKey != nil {
+			answers[0].(*SimpleAnswer[T]).Responses = s.evaluate(queries)
+		}
 	} else {
 		answers = make([]Answer[T], len(queries))
 		for i := range queries {
@@ -159,11 +295,7 @@ func (s *SimpleServer[T]) Answer(queries []Query[T]) []Answer[T] {
 			ct := query.Query
 			if s.mode == Hybrid {
 				// Extract CT LWE representation and modulus switch
-				tmpCT := m.New[T](0, 0)
-				for j := range query.FastQuery {
-					numSamples := min(s.db.Info.M-uint64(j)*s.cryptoCtx.Params.N, s.cryptoCtx.Params.N)
-					tmpCT.Concat(s.cryptoCtx.RingContext.ExtractLWECt(query.FastQuery[j], numSamples))
-				}
+				tmpCT := s.hostQuery(query)
 
 				// Pad the query to match the dimensions of the compressed DB if
 				// applicable
@@ -176,9 +308,18 @@ func (s *SimpleServer[T]) Answer(queries []Query[T]) []Answer[T] {
 			// Compute the matrix product
 			var answer SimpleAnswer[T]
 			if s.db.Info.Squishing != 0 {
-				answer = SimpleAnswer[T]{m.MulVecPacked(s.db.Data, ct)}
+				answer = SimpleAnswer[T]{Answer: m.MulVecPacked(s.db.Data, ct)}
 			} else {
-				answer = SimpleAnswer[T]{m.MulVec(s.db.Data, ct)}
+				answer = SimpleAnswer[T]{Answer: m.MulVec(s.db.Data, ct)}
+			}
+			if s.db.Info.Centered {
+				answer.Answer.SubConst(s.bias(ct))
+			}
+			if s.prg != nil {
+				s.flood(answer.Answer)
+			}
+			if s.prfKey != nil {
+				answer.Responses = s.evaluate(queries[i : i+1])
 			}
 			answers[i] = &answer
 		}
@@ -186,10 +327,83 @@ func (s *SimpleServer[T]) Answer(queries []Query[T]) []Answer[T] {
 	return answers
 }
 
+// The LWE representation of a query in host memory
+func (s *SimpleServer[T]) hostQuery(query *SimpleQuery[T]) *m.Matrix[T] {
+	if s.mode != Hybrid {
+		return query.Query
+	}
+	ct := m.New[T](0, 0)
+	for j := range query.FastQuery {
+		numSamples := min(s.db.Info.M-uint64(j)*s.cryptoCtx.Params.N, s.cryptoCtx.Params.N)
+		ct.Concat(s.cryptoCtx.RingContext.ExtractLWECt(query.FastQuery[j], numSamples))
+	}
+	return ct
+}
+
+// The offset in each entry of the answer to `ct` over a centered DB, which is
+// stored shifted by `P/2` (see `DB.Center`)
+func (s *SimpleServer[T]) bias(ct *m.Matrix[T]) T {
+	sum := T(0)
+	for _, v := range ct.Data() {
+		sum += v
+	}
+	return T(s.db.Info.P/2) * sum
+}
+
+// Add flooding noise to every entry of `answer` so that it reveals nothing
+// about the DB beyond the result (see `crypto.Params.EnableFlooding`)
+func (s *SimpleServer[T]) flood(answer *m.Matrix[T]) {
+	data := answer.Data()
+	for i := range data {
+		data[i] += T(s.cryptoCtx.Params.FloodingNoise(s.prg))
+	}
+}
+
+// A row of `P/2`s, whose product with `A` is subtracted from each row of the
+// hint of a centered DB
+func biasRow(info *DBInfo) *m.Matrix[m.Elem32] {
+	row := m.New[m.Elem32](1, info.M)
+	for j := range info.M {
+		row.Set(0, j, m.Elem32(info.P/2))
+	}
+	return row
+}
+
+func centerHint[T m.Elem](hint *m.Matrix[T], bias *m.Matrix[T]) {
+	for i := range hint.Rows() {
+		for j := range hint.Cols() {
+			hint.Set(i, j, hint.Get(i, j)-bias.Get(0, j))
+		}
+	}
+}
+
+// Evaluate the OPRF on the request of each query. Requests come from clients,
+// so invalid ones are answered with an empty response, which the client
+// rejects (see `SimpleClient.Recover`).
+func (s *SimpleServer[T]) evaluate(queries []Query[T]) [][]byte {
+	responses := make([][]byte, len(queries))
+	for i := range queries {
+		query, ok := queries[i].(*SimpleQuery[T])
+		if !ok {
+			continue
+		}
+		if response, err := s.prfKey.Evaluate(query.Request); err == nil {
+			responses[i] = response
+		}
+	}
+	return responses
+}
+
 func (s *SimpleServer[T]) DB() *DB {
 	return s.db
 }
 
+// Returns the size of the DB and hint. Servers created by `Prefix` report the
+// size of the part of the state they share with their parent.
 func (s *SimpleServer[T]) StateSize() uint64 {
-	panic("Unimplemented")
+	size := s.db.Data.Size() * 4
+	if s.hint != nil {
+		size += s.hint.Size() * T(0).Bitlen() / 8
+	}
+	return size
 }
@@ -243,20 +243,18 @@ func (m *Matrix[T]) Equals(n *Matrix[T]) bool {
 	return true
 }
 
+// Elements from the discrete gaussian with stddev `lwe.StdDev`
 func Gaussian[T Elem](src IoRandSource, rows, cols uint64) *Matrix[T] {
-	out := New[T](rows, cols)
-	samplef := lwe.GaussSample32
-	switch T(0).Bitlen() {
-	case 32:
-		// Do nothing
-	case 64:
-		samplef = lwe.GaussSample64
-	default:
-		panic("Shouldn't get here")
-	}
+	return GaussianFrom[T](src, lwe.DefaultSampler, rows, cols)
+}
 
-	for i := 0; i < len(out.data); i++ {
-		out.data[i] = T(samplef(src))
+// Elements from the discrete gaussian of `sampler`
+func GaussianFrom[T Elem](src IoRandSource, sampler *lwe.GaussSampler, rows, cols uint64) *Matrix[T] {
+	out := New[T](rows, cols)
+	samples := make([]int64, len(out.data))
+	sampler.Fill(src, samples)
+	for i, v := range samples {
+		out.data[i] = T(v)
 	}
 	return out
 }
@@ -143,6 +143,24 @@ void matMul32VecPacked64(Elem64 *out, const Elem32 *a, const Elem64 *b,
       tmp8 += val8*b[index2];
       index2 += 1;
 
+      val  = (Elem64)((db >> BASIS2_32) & MASK_32);
+      val2 = (Elem64)((db2 >> BASIS2_32) & MASK_32);
+      val3 = (Elem64)((db3 >> BASIS2_32) & MASK_32);
+      val4 = (Elem64)((db4 >> BASIS2_32) & MASK_32);
+      val5 = (Elem64)((db5 >> BASIS2_32) & MASK_32);
+      val6 = (Elem64)((db6 >> BASIS2_32) & MASK_32);
+      val7 = (Elem64)((db7 >> BASIS2_32) & MASK_32);
+      val8 = (Elem64)((db8 >> BASIS2_32) & MASK_32);
+      tmp  += val*b[index2];
+      tmp2 += val2*b[index2];
+      tmp3 += val3*b[index2];
+      tmp4 += val4*b[index2];
+      tmp5 += val5*b[index2];
+      tmp6 += val6*b[index2];
+      tmp7 += val7*b[index2];
+      tmp8 += val8*b[index2];
+      index2 += 1;
+
       index += 1;
     }
     out[i]   += tmp;
@@ -221,6 +221,36 @@ func testMulPacked[U Elem](t *testing.T, r1 uint64, c1 uint64) {
 	}
 }
 
+// A DB of 32-bit elements with 64-bit queries
+func testMulPackedMixed(t *testing.T, r1 uint64, c1 uint64) {
+	rand := rand.NewRandomBufPRG()
+
+	m2 := Rand[Elem64](rand, c1, 1, 0)
+	m1 := Rand[Elem32](rand, r1, c1, 1<<squishBasis32)
+
+	res1 := New[Elem64](r1, 1)
+	for i := range r1 {
+		for j := range c1 {
+			res1.data[i] += Elem64(m1.Get(i, j)) * m2.Get(j, 0)
+		}
+	}
+	m1.Squish()
+
+	newCols := m1.Cols() * m1.SquishRatio()
+	m2.AppendZeros(newCols - m2.Rows())
+
+	res2 := MulVecPacked(m1, m2)
+
+	if !res1.Equals(res2) {
+		t.Fail()
+	}
+}
+
+func TestMulVecPackedMixed(t *testing.T) {
+	testMulPackedMixed(t, 8, 13)
+	testMulPackedMixed(t, 810, 132)
+}
+
 func TestMulVecPacked32(t *testing.T) {
 	testMulPacked[Elem32](t, 8, 13)
 }
@@ -42,6 +42,9 @@ func main() {
 	defer client.Free()
     log.Printf("\tTook: %0.2fs", time.Since(start).Seconds())
 
+    // The same queries are answered on every iteration below
+    client.AllowSecretReuse()
+
     // Generate client queries
 	prg := rand.NewBufPRG(rand.NewPRG(&key))
     dbInfo := client.DBInfo()
@@ -49,7 +52,7 @@ func main() {
     for i := range inputs {
         index := prg.Uint64() % dbInfo.N
         inputs[i] = m.New[m.Elem32](dbInfo.M, 1)
-        inputs[i].Data()[index%dbInfo.M] = 1
+        inputs[i].Data()[dbInfo.Column(index)] = 1
     }
 
     // Register queries
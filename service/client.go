@@ -111,6 +111,14 @@ func (c *Client) Free() {
 }
 
 
+// Allow the same queries to be answered repeatedly, for benchmarks (see
+// `lhe.SimpleClient.AllowSecretReuse`)
+func (c *Client) AllowSecretReuse() {
+    if client, ok := c.pirClient.(*lhe.SimpleClient[m.Elem32]); ok {
+        client.AllowSecretReuse()
+    }
+}
+
 // Make a query
 func (c *Client) Query(inputs []*m.Matrix[m.Elem32]) []lhe.Secret[m.Elem32] {
     keys, queries := c.pirClient.Query(inputs)
@@ -154,7 +162,12 @@ func (c *Client) Query(inputs []*m.Matrix[m.Elem32]) []lhe.Secret[m.Elem32] {
 func (c *Client) Answer(keys []lhe.Secret[m.Elem32]) (float64, float64, []*m.Matrix[m.Elem32]) {
     switch c.pirType {
     case lhe.Local:
-        return 0.0, 0.0, c.pirClient.Recover(keys, nil)
+        result, err := c.pirClient.Recover(keys, nil)
+        if err != nil {
+            log.Printf("Error recovering answer")
+            panic(err)
+        }
+        return 0.0, 0.0, result
     case lhe.Simple, lhe.SimpleHybrid:
         // Fetch hint and PIR response in parallel
         var pTime, hTime float64
@@ -200,7 +213,12 @@ func (c *Client) Answer(keys []lhe.Secret[m.Elem32]) (float64, float64, []*m.Mat
        
         var result []*m.Matrix[m.Elem32]
         if c.hcConn != nil {
-           result = c.pirClient.Recover(keys, reply.Answers)
+           var err error
+           result, err = c.pirClient.Recover(keys, reply.Answers)
+           if err != nil {
+               log.Printf("Error recovering answer")
+               panic(err)
+           }
         }
         return pTime, hTime, result
     default: